@@ -2,69 +2,185 @@ package bencode
 
 import (
 	"fmt"
+	"io"
+	"slices"
 	"strconv"
 	"strings"
 	"unicode"
 )
 
 type TorrentInfo struct {
-	Announce  string    `json:"announce"`
-	CreatedBy string    `json:"created by"`
-	Info      InnerInfo `json:"info"`
+	Announce     string     `bencode:"announce,omitempty"`
+	AnnounceList [][]string `bencode:"announce-list,omitempty"`
+	CreatedBy    string     `bencode:"created by,omitempty"`
+	Info         InnerInfo  `bencode:"info"`
+
+	// RawInfo holds the info dictionary exactly as it appeared in the metainfo file.
+	// The info hash must be computed over these bytes, since re-encoding InnerInfo
+	// drops any keys it does not model.
+	RawInfo []byte `bencode:"-"`
 }
 
 type InnerInfo struct {
-	Length      int    `json:"length"`
-	Name        string `json:"name"`
-	PieceLength int    `json:"piece length"`
-	Pieces      []byte `json:"pieces"`
+	Length      int    `bencode:"length,omitempty"`
+	Files       []File `bencode:"files,omitempty"`
+	Name        string `bencode:"name"`
+	PieceLength int    `bencode:"piece length"`
+	Pieces      []byte `bencode:"pieces"`
 }
 
-func Info(bencodedString string) (*TorrentInfo, error) {
-	decoded, _, err := Decode[any](bencodedString)
-	if err != nil {
-		return nil, err
+// Trackers returns the torrent's tracker tiers as described by BEP 12.
+// When announce-list is absent, the announce URL forms the only tier.
+func (t *TorrentInfo) Trackers() [][]string {
+	tiers := make([][]string, 0, len(t.AnnounceList)+1)
+	for _, tier := range t.AnnounceList {
+		if len(tier) > 0 {
+			tiers = append(tiers, slices.Clone(tier))
+		}
+	}
+	if len(tiers) == 0 && t.Announce != "" {
+		tiers = append(tiers, []string{t.Announce})
 	}
+	return tiers
+}
 
-	decodedMap, ok := decoded.(map[string]any)
-	if !ok {
-		return nil, fmt.Errorf("decoded data is not a dictionary")
+// File is a single entry of a multi-file torrent's info.files list.
+type File struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+	MD5Sum string   `bencode:"md5sum,omitempty"`
+}
+
+// IsMultiFile reports whether the info dictionary describes a directory of files
+// rather than a single file.
+func (i *InnerInfo) IsMultiFile() bool {
+	return len(i.Files) > 0
+}
+
+// TotalLength returns the number of bytes covered by the torrent's pieces.
+// For multi-file torrents this is the sum of all file lengths.
+func (i *InnerInfo) TotalLength() int {
+	if !i.IsMultiFile() {
+		return i.Length
 	}
 
-	torrentInfo := &TorrentInfo{}
+	total := 0
+	for _, file := range i.Files {
+		total += file.Length
+	}
+	return total
+}
+
+// Info parses the contents of a metainfo (.torrent) file.
+func Info(bencodedString string) (*TorrentInfo, error) {
+	return ReadInfo(strings.NewReader(bencodedString))
+}
+
+// ReadInfo parses a metainfo (.torrent) file from r. Keys outside the info dictionary
+// are streamed and those it does not model skipped, while the info dictionary is
+// captured whole into RawInfo, so it is held in memory along with its piece hashes.
+func ReadInfo(r io.Reader) (*TorrentInfo, error) {
+	return readInfo(r, false)
+}
 
-	if announce, ok := decodedMap["announce"].(string); ok {
-		torrentInfo.Announce = announce
+// ReadInfoStrict is like ReadInfo but only accepts canonically encoded metainfo,
+// as described by Decoder.Strict. Use it for torrents from untrusted sources.
+func ReadInfoStrict(r io.Reader) (*TorrentInfo, error) {
+	return readInfo(r, true)
+}
+
+func readInfo(r io.Reader, strict bool) (*TorrentInfo, error) {
+	d := NewDecoder(r)
+	if strict {
+		d.Strict()
 	}
 
-	if createdBy, ok := decodedMap["created by"].(string); ok {
-		torrentInfo.CreatedBy = createdBy
+	tok, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+	if tok != Delim('d') {
+		return nil, fmt.Errorf("metainfo is not a dictionary")
 	}
 
-	if info, ok := decodedMap["info"].(map[string]any); ok {
-		if length, ok := info["length"].(int); ok {
-			torrentInfo.Info.Length = length
+	torrentInfo := &TorrentInfo{}
+	for d.More() {
+		key, err := d.Token()
+		if err != nil {
+			return nil, err
 		}
 
-		if name, ok := info["name"].(string); ok {
-			torrentInfo.Info.Name = name
+		switch key {
+		case "announce":
+			err = d.Decode(&torrentInfo.Announce)
+		case "announce-list":
+			err = d.Decode(&torrentInfo.AnnounceList)
+		case "created by":
+			err = d.Decode(&torrentInfo.CreatedBy)
+		case "info":
+			torrentInfo.RawInfo, err = d.decodeRaw(&torrentInfo.Info)
+		default:
+			err = d.skipValue()
 		}
-
-		if pieceLength, ok := info["piece length"].(int); ok {
-			torrentInfo.Info.PieceLength = pieceLength
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		if pieces, ok := info["pieces"].(string); ok {
-			torrentInfo.Info.Pieces = []byte(pieces)
+	if _, err := d.Token(); err != nil {
+		return nil, err
+	}
+	if strict {
+		if _, err := d.Token(); err != io.EOF {
+			return nil, d.syntaxError("unexpected data after metainfo dictionary")
 		}
 	}
 
+	if len(torrentInfo.RawInfo) == 0 {
+		return nil, fmt.Errorf("metainfo has no info dictionary")
+	}
+	if err := torrentInfo.Info.Validate(); err != nil {
+		return nil, err
+	}
+
 	return torrentInfo, nil
 }
 
+// maxPieceLength bounds the piece length Validate accepts. Pieces are held in memory
+// whole while they are downloaded, verified and served.
+const maxPieceLength = 64 << 20
+
+// Validate checks that the info dictionary describes a torrent that can be transferred:
+// a positive piece length of at most 64 MiB, whole piece hashes, one per piece of the total length, and
+// files with a path and a non-negative length.
+func (i *InnerInfo) Validate() error {
+	if i.PieceLength <= 0 || i.PieceLength > maxPieceLength {
+		return fmt.Errorf("invalid piece length %d", i.PieceLength)
+	}
+	if len(i.Pieces)%20 != 0 {
+		return fmt.Errorf("invalid pieces length %d, not a multiple of 20", len(i.Pieces))
+	}
+	if i.Length < 0 {
+		return fmt.Errorf("invalid length %d", i.Length)
+	}
+	for n, file := range i.Files {
+		if len(file.Path) == 0 {
+			return fmt.Errorf("invalid files entry %d: missing path", n)
+		}
+		if file.Length < 0 {
+			return fmt.Errorf("invalid files entry %d: length %d", n, file.Length)
+		}
+	}
+	total := i.TotalLength()
+	if want := (total + i.PieceLength - 1) / i.PieceLength; len(i.Pieces)/20 != want {
+		return fmt.Errorf("info has %d piece hashes, expected %d for %d bytes", len(i.Pieces)/20, want, total)
+	}
+	return nil
+}
+
 func Decode[T any](bencodedString string) (T, int, error) {
 	var empty T
-	
+
 	convertResult := func(value any, length int, err error) (T, int, error) {
 		if err != nil {
 			return empty, 0, err
@@ -194,6 +310,9 @@ func decodeString(bencodedString string) (string, int, error) {
 	if err != nil {
 		return "", 0, err
 	}
+	if length < 0 || length > len(bencodedString)-firstColonIndex-1 {
+		return "", 0, fmt.Errorf("invalid string length %d: exceeds remaining input", length)
+	}
 
 	totalLength := firstColonIndex + 1 + length // 1 for the ':' + length of number + string content
 	return bencodedString[firstColonIndex+1 : firstColonIndex+1+length], totalLength, nil
@@ -0,0 +1,125 @@
+package bencode
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadInfoHashesRawInfo(t *testing.T) {
+	// The info dictionaries carry keys InnerInfo does not model, which must still count
+	// towards the info hash.
+	tests := []struct {
+		file     string
+		infoHash string
+		name     string
+		length   int
+		pieces   int
+	}{
+		// private, source and md5sum.
+		{"private.torrent", "951a6a75dd8b3a337b1dce940012fdb05c601482", "report.pdf", 40000, 3},
+		// name.utf-8 beside a Latin-1 name, path.utf-8, a file md5sum and private=0.
+		{"utf8.torrent", "197de54436c4dc508a6d093091578ea7f24b8303", "caf\xe9", 32768, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, read := range []struct {
+				name string
+				read func([]byte) (*TorrentInfo, error)
+			}{
+				{"ReadInfo", func(data []byte) (*TorrentInfo, error) { return ReadInfo(bytes.NewReader(data)) }},
+				{"ReadInfoStrict", func(data []byte) (*TorrentInfo, error) { return ReadInfoStrict(bytes.NewReader(data)) }},
+			} {
+				info, err := read.read(data)
+				if err != nil {
+					t.Fatalf("%s: %v", read.name, err)
+				}
+				if info.Info.Name != tt.name || info.Info.TotalLength() != tt.length || len(info.Info.Pieces)/20 != tt.pieces {
+					t.Errorf("%s: got name %q, length %d, %d pieces", read.name, info.Info.Name, info.Info.TotalLength(), len(info.Info.Pieces)/20)
+				}
+
+				hexHash, infoHash, err := HashInfo(info)
+				if err != nil {
+					t.Fatalf("HashInfo: %v", err)
+				}
+				if hexHash != tt.infoHash || hex.EncodeToString(infoHash) != tt.infoHash {
+					t.Errorf("%s: info hash %s, want %s", read.name, hexHash, tt.infoHash)
+				}
+				if !bytes.Contains(data, info.RawInfo) {
+					t.Errorf("%s: RawInfo is not the info dictionary as it appears in the file", read.name)
+				}
+			}
+		})
+	}
+}
+
+func TestReadInfoReencodingLosesKeys(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "private.torrent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := ReadInfo(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without RawInfo the hash falls back to re-encoding InnerInfo, which drops
+	// private and source and so identifies a different torrent.
+	reencoded := &TorrentInfo{Info: info.Info}
+	hexHash, _, err := HashInfo(reencoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hexHash == "951a6a75dd8b3a337b1dce940012fdb05c601482" {
+		t.Fatal("re-encoded info kept every key; the test data no longer covers RawInfo")
+	}
+
+	// Writing the metainfo back out keeps the info dictionary byte for byte.
+	out, err := MarshalMetainfo(info)
+	if err != nil {
+		t.Fatalf("MarshalMetainfo: %v", err)
+	}
+	again, err := ReadInfo(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("ReadInfo of MarshalMetainfo output: %v", err)
+	}
+	if sha1.Sum(again.RawInfo) != sha1.Sum(info.RawInfo) {
+		t.Error("MarshalMetainfo changed the info dictionary")
+	}
+}
+
+func TestReadInfoRejectsInvalidInfo(t *testing.T) {
+	pieces := string(bytes.Repeat([]byte{'x'}, 20))
+	tests := []struct {
+		name string
+		info string
+	}{
+		{"zero piece length", "d6:lengthi10e4:name1:a12:piece lengthi0e6:pieces20:" + pieces + "e"},
+		{"piece length above the cap", "d6:lengthi10e4:name1:a12:piece lengthi67108865e6:pieces20:" + pieces + "e"},
+		{"partial piece hash", "d6:lengthi10e4:name1:a12:piece lengthi16e6:pieces19:" + pieces[:19] + "e"},
+		{"negative length", "d6:lengthi-10e4:name1:a12:piece lengthi16e6:pieces0:e"},
+		{"negative file length", "d5:filesld6:lengthi-1e4:pathl1:beee4:name1:a12:piece lengthi16e6:pieces0:e"},
+		{"file without path", "d5:filesld6:lengthi10e4:pathleee4:name1:a12:piece lengthi16e6:pieces20:" + pieces + "e"},
+		{"too few pieces", "d6:lengthi40e4:name1:a12:piece lengthi16e6:pieces20:" + pieces + "e"},
+		{"too many pieces", "d6:lengthi10e4:name1:a12:piece lengthi16e6:pieces40:" + pieces + pieces + "e"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Info("d4:info" + tt.info + "e"); err == nil {
+				t.Error("Info accepted invalid info")
+			}
+		})
+	}
+
+	if _, err := Info("d8:announce3:urle"); err == nil {
+		t.Error("Info accepted metainfo without an info dictionary")
+	}
+}
@@ -57,21 +57,42 @@ func Encode[T any](value T) (string, error) {
 	}
 }
 
+// HashInfo returns the SHA-1 info hash of the torrent as a hex string and as raw bytes.
+// The hash is taken over RawInfo when the torrent was parsed from a metainfo file;
+// otherwise the info dictionary is rebuilt from the fields of InnerInfo.
 func HashInfo(info *TorrentInfo) (string, []byte, error) {
-	infoMap := map[string]any{
-		"length":       info.Info.Length,
-		"name":         info.Info.Name,
-		"piece length": info.Info.PieceLength,
-		"pieces":       info.Info.Pieces,
+	if len(info.RawInfo) > 0 {
+		infoHash := sha1.Sum(info.RawInfo)
+		return fmt.Sprintf("%x", infoHash), infoHash[:], nil
 	}
 
-	encoded, err := Encode(infoMap)
+	encoded, err := Marshal(info.Info)
 	if err != nil {
 		return "", nil, fmt.Errorf("failed to encode info: %v", err)
 	}
 
 	h := sha1.New()
-	h.Write([]byte(encoded))
+	h.Write(encoded)
 	infoHash := h.Sum(nil)
 	return fmt.Sprintf("%x", infoHash), infoHash, nil
 }
+
+// MarshalMetainfo encodes the torrent as the contents of a metainfo (.torrent) file.
+// The info dictionary is written from RawInfo when it is set, so the info hash is kept.
+func MarshalMetainfo(info *TorrentInfo) ([]byte, error) {
+	raw := RawMessage(info.RawInfo)
+	if len(raw) == 0 {
+		encoded, err := Marshal(info.Info)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode info: %v", err)
+		}
+		raw = encoded
+	}
+
+	return Marshal(struct {
+		Announce     string     `bencode:"announce,omitempty"`
+		AnnounceList [][]string `bencode:"announce-list,omitempty"`
+		CreatedBy    string     `bencode:"created by,omitempty"`
+		Info         RawMessage `bencode:"info"`
+	}{info.Announce, info.AnnounceList, info.CreatedBy, raw})
+}
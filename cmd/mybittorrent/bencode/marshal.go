@@ -0,0 +1,234 @@
+package bencode
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RawMessage is a raw encoded bencode value. It can be used to delay decoding
+// of part of a message or to embed a pre-encoded value when marshaling.
+type RawMessage []byte
+
+var rawMessageType = reflect.TypeOf(RawMessage(nil))
+
+// Marshal returns the bencode encoding of v.
+//
+// Strings and byte slices encode as byte strings, signed and unsigned integers
+// and bools encode as integers, slices and arrays as lists, and maps with string
+// keys and structs as dictionaries with their keys sorted. Struct fields are
+// keyed by the name in their `bencode:"name,omitempty"` tag, falling back to the
+// field name; a tag of "-" skips the field. Nil pointers and interfaces are omitted
+// from dictionaries since bencode has no null value.
+func Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := marshalValue(&buf, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writer is implemented by both *bytes.Buffer and *bufio.Writer.
+type writer interface {
+	io.Writer
+	io.ByteWriter
+	io.StringWriter
+}
+
+func marshalValue(buf writer, v reflect.Value) error {
+	if !v.IsValid() {
+		return fmt.Errorf("bencode: cannot marshal nil value")
+	}
+
+	if v.Type() == rawMessageType {
+		if v.Len() == 0 {
+			return fmt.Errorf("bencode: cannot marshal empty RawMessage")
+		}
+		buf.Write(v.Bytes())
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return fmt.Errorf("bencode: cannot marshal nil %s", v.Type())
+		}
+		return marshalValue(buf, v.Elem())
+
+	case reflect.String:
+		writeString(buf, v.String())
+
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteString("i1e")
+		} else {
+			buf.WriteString("i0e")
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buf.WriteByte('i')
+		buf.WriteString(strconv.FormatInt(v.Int(), 10))
+		buf.WriteByte('e')
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		buf.WriteByte('i')
+		buf.WriteString(strconv.FormatUint(v.Uint(), 10))
+		buf.WriteByte('e')
+
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			writeBytes(buf, byteSlice(v))
+			return nil
+		}
+		buf.WriteByte('l')
+		for i := range v.Len() {
+			if err := marshalValue(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("bencode: unsupported map key type %s", v.Type().Key())
+		}
+		keys := make([]string, 0, v.Len())
+		for _, key := range v.MapKeys() {
+			keys = append(keys, key.String())
+		}
+		slices.Sort(keys)
+
+		buf.WriteByte('d')
+		for _, key := range keys {
+			value := v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key()))
+			if isNilValue(value) {
+				continue
+			}
+			writeString(buf, key)
+			if err := marshalValue(buf, value); err != nil {
+				return fmt.Errorf("bencode: failed to marshal key %q: %w", key, err)
+			}
+		}
+		buf.WriteByte('e')
+
+	case reflect.Struct:
+		buf.WriteByte('d')
+		for _, field := range cachedFields(v.Type()) {
+			value := v.FieldByIndex(field.index)
+			if isNilValue(value) || (field.omitEmpty && isEmptyValue(value)) {
+				continue
+			}
+			writeString(buf, field.name)
+			if err := marshalValue(buf, value); err != nil {
+				return fmt.Errorf("bencode: failed to marshal field %q: %w", field.name, err)
+			}
+		}
+		buf.WriteByte('e')
+
+	default:
+		return fmt.Errorf("bencode: unsupported type %s", v.Type())
+	}
+
+	return nil
+}
+
+func writeString(buf writer, s string) {
+	buf.WriteString(strconv.Itoa(len(s)))
+	buf.WriteByte(':')
+	buf.WriteString(s)
+}
+
+func writeBytes(buf writer, b []byte) {
+	buf.WriteString(strconv.Itoa(len(b)))
+	buf.WriteByte(':')
+	buf.Write(b)
+}
+
+// byteSlice returns the contents of a byte slice or byte array value.
+func byteSlice(v reflect.Value) []byte {
+	if v.Kind() == reflect.Slice {
+		return v.Bytes()
+	}
+	b := make([]byte, v.Len())
+	reflect.Copy(reflect.ValueOf(b), v)
+	return b
+}
+
+func isNilValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	case reflect.Slice:
+		return v.Type() == rawMessageType && v.IsNil()
+	}
+	return false
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+// field describes how a struct field maps onto a dictionary key.
+type field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+var fieldCache sync.Map // map[reflect.Type][]field
+
+// cachedFields returns the encodable fields of struct type t sorted by key,
+// which is the order bencode requires dictionary keys to appear in.
+func cachedFields(t reflect.Type) []field {
+	if cached, ok := fieldCache.Load(t); ok {
+		return cached.([]field)
+	}
+
+	fields := make([]field, 0, t.NumField())
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+
+		tag := sf.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = sf.Name
+		}
+
+		fields = append(fields, field{
+			name:      name,
+			index:     sf.Index,
+			omitEmpty: slices.Contains(strings.Split(options, ","), "omitempty"),
+		})
+	}
+
+	slices.SortStableFunc(fields, func(a, b field) int {
+		return strings.Compare(a.name, b.name)
+	})
+
+	cached, _ := fieldCache.LoadOrStore(t, fields)
+	return cached.([]field)
+}
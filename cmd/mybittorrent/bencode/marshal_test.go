@@ -0,0 +1,228 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type optional struct {
+	Name    string     `bencode:"name"`
+	Count   int        `bencode:"count,omitempty"`
+	Flag    bool       `bencode:"flag,omitempty"`
+	Tags    []string   `bencode:"tags,omitempty"`
+	Extra   RawMessage `bencode:"extra,omitempty"`
+	Next    *optional  `bencode:"next,omitempty"`
+	Ignored string     `bencode:"-"`
+	Default uint8
+}
+
+func intPtr(n int) *int { return &n }
+
+func TestMarshalRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   any // marshaled, and compared with the result of unmarshaling into its type
+		encoded string
+	}{
+		{"int", 42, "i42e"},
+		{"negative int", int64(-7), "i-7e"},
+		{"uint", uint32(4000000000), "i4000000000e"},
+		{"bool", true, "i1e"},
+		{"string", "spam", "4:spam"},
+		{"empty string", "", "0:"},
+		{"bytes", []byte{0, 0xff, 'e'}, "3:\x00\xffe"},
+		{"byte array", [4]byte{'a', 'b', 'c', 'd'}, "4:abcd"},
+		{"list", []int{1, 2, 3}, "li1ei2ei3ee"},
+		{"nested list", [][]string{{"a"}, {}}, "ll1:aelee"},
+		{"map sorted by key", map[string]int{"b": 2, "a": 1, "c": 3}, "d1:ai1e1:bi2e1:ci3ee"},
+		// Keys sort as raw bytes: upper case before lower case, and a prefix first.
+		{"map raw byte order", map[string]int{"a": 1, "B": 2, "ab": 3, "\xff": 4}, "d1:Bi2e1:ai1e2:abi3e1:\xffi4ee"},
+		{"empty map", map[string]string{}, "de"},
+		{"omitempty all empty", optional{}, "d7:Defaulti0e4:name0:e"},
+		{"omitempty all set", optional{
+			Name:    "x",
+			Count:   2,
+			Flag:    true,
+			Tags:    []string{"t"},
+			Extra:   RawMessage("li1ee"),
+			Next:    &optional{Name: "y"},
+			Default: 9,
+		}, "d7:Defaulti9e5:counti2e5:extrali1ee4:flagi1e4:name1:x4:nextd7:Defaulti0e4:name1:ye4:tagsl1:tee"},
+		{"raw message", RawMessage("d1:ai1ee"), "d1:ai1ee"},
+		{"raw message in map", map[string]RawMessage{"k": RawMessage("3:abc")}, "d1:k3:abce"},
+		{"pointer", intPtr(5), "i5e"},
+		{"any", map[string]any{"list": []any{1, "two"}, "n": 3}, "d4:listli1e3:twoe1:ni3ee"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := Marshal(tt.value)
+			if err != nil {
+				t.Fatalf("Marshal: %v", err)
+			}
+			if string(encoded) != tt.encoded {
+				t.Errorf("Marshal = %q, want %q", encoded, tt.encoded)
+			}
+
+			var buf bytes.Buffer
+			if err := NewEncoder(&buf).Encode(tt.value); err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			if buf.String() != tt.encoded {
+				t.Errorf("Encode = %q, want %q", buf.String(), tt.encoded)
+			}
+
+			decoded := reflect.New(reflect.TypeOf(tt.value))
+			if err := Unmarshal([]byte(tt.encoded), decoded.Interface()); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			if got := decoded.Elem().Interface(); !reflect.DeepEqual(got, tt.value) {
+				t.Errorf("Unmarshal = %#v, want %#v", got, tt.value)
+			}
+		})
+	}
+}
+
+func TestMarshalOmitsNil(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   any
+		encoded string
+	}{
+		{"nil map values", map[string]*int{"a": nil, "b": intPtr(2)}, "d1:bi2ee"},
+		{"nil interface values", map[string]any{"a": nil, "b": "x"}, "d1:b1:xe"},
+		{"nil raw message field", struct {
+			A RawMessage `bencode:"a"`
+			B int        `bencode:"b"`
+		}{B: 1}, "d1:bi1ee"},
+		{"nil pointer field", struct {
+			A *int `bencode:"a"`
+		}{}, "de"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := Marshal(tt.value)
+			if err != nil {
+				t.Fatalf("Marshal: %v", err)
+			}
+			if string(encoded) != tt.encoded {
+				t.Errorf("Marshal = %q, want %q", encoded, tt.encoded)
+			}
+		})
+	}
+}
+
+func TestMarshalErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		value any
+	}{
+		{"nil", nil},
+		{"nil pointer", (*int)(nil)},
+		{"empty raw message", RawMessage{}},
+		{"float", 1.5},
+		{"non-string map key", map[int]int{1: 1}},
+		{"unsupported field", struct{ F func() }{F: func() {}}},
+		{"unsupported list element", []any{1, 2.5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if encoded, err := Marshal(tt.value); err == nil {
+				t.Errorf("Marshal = %q, want an error", encoded)
+			}
+		})
+	}
+}
+
+func TestUnmarshalRawMessage(t *testing.T) {
+	// RawMessage keeps the exact bytes, even when they are not canonical.
+	var v struct {
+		Info  RawMessage `bencode:"info"`
+		After int        `bencode:"z"`
+	}
+	data := "d4:infod1:bi1e1:ai02ee1:zi3ee"
+	if err := Unmarshal([]byte(data), &v); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if string(v.Info) != "d1:bi1e1:ai02ee" || v.After != 3 {
+		t.Errorf("got info %q and z %d", v.Info, v.After)
+	}
+
+	// A pointer to a RawMessage is allocated and filled the same way.
+	var p struct {
+		Info  *RawMessage `bencode:"info"`
+		Other *RawMessage `bencode:"other"`
+	}
+	if err := Unmarshal([]byte(data), &p); err != nil {
+		t.Fatalf("Unmarshal into *RawMessage: %v", err)
+	}
+	if p.Info == nil || string(*p.Info) != "d1:bi1e1:ai02ee" || p.Other != nil {
+		t.Errorf("got info %v and other %v", p.Info, p.Other)
+	}
+}
+
+func TestUnmarshalSkipsUnknownKeys(t *testing.T) {
+	var v optional
+	data := "d1:ad1:xli1ei2eee4:name3:abc7:unknown3:xyze"
+	if err := Unmarshal([]byte(data), &v); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if v.Name != "abc" {
+		t.Errorf("got name %q, want abc", v.Name)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	var typeErr *UnmarshalTypeError
+	var syntaxErr *SyntaxError
+	tests := []struct {
+		name   string
+		data   string
+		target any
+		want   any // pointer to the error type expected
+	}{
+		{"integer into string", "i1e", new(string), &typeErr},
+		{"string into int", "1:a", new(int), &typeErr},
+		{"overflow int8", "i300e", new(int8), &typeErr},
+		{"negative into uint", "i-1e", new(uint), &typeErr},
+		{"bool out of range", "i2e", new(bool), &typeErr},
+		{"byte array length", "3:abc", new([4]byte), &typeErr},
+		{"list too long for array", "li1ei2ee", new([1]int), &typeErr},
+		{"list into struct", "le", new(optional), &typeErr},
+		{"dict into slice", "de", new([]int), &typeErr},
+		{"field type", "d4:name" + "i1ee", new(optional), &typeErr},
+		{"trailing data", "i1ei2e", new(int), &syntaxErr},
+		{"truncated", "d4:name", new(optional), &syntaxErr},
+		{"invalid character", "x", new(any), &syntaxErr},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Unmarshal([]byte(tt.data), tt.target)
+			if err == nil {
+				t.Fatal("Unmarshal succeeded")
+			}
+			if !errors.As(err, tt.want) {
+				t.Errorf("Unmarshal returned %T (%v)", err, err)
+			}
+		})
+	}
+
+	if err := Unmarshal([]byte("i1e"), 1); err == nil {
+		t.Error("Unmarshal into a non-pointer succeeded")
+	}
+}
+
+func TestUnmarshalTypeErrorPath(t *testing.T) {
+	var v struct {
+		Files []File `bencode:"files"`
+	}
+	err := Unmarshal([]byte("d5:filesld6:lengthi1e4:pathl1:aeed6:length1:xeee"), &v)
+	var typeErr *UnmarshalTypeError
+	if !errors.As(err, &typeErr) {
+		t.Fatalf("Unmarshal returned %v, want an UnmarshalTypeError", err)
+	}
+	if typeErr.Path != "files[1].length" || typeErr.Offset != 42 {
+		t.Errorf("error at %s offset %d, want files[1].length offset 42", typeErr.Path, typeErr.Offset)
+	}
+}
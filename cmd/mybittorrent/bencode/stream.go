@@ -0,0 +1,427 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+// Delim marks the start ('l' or 'd') or end ('e') of a list or dictionary in the token stream.
+type Delim byte
+
+func (d Delim) String() string {
+	return string(d)
+}
+
+// Token holds a value of one of these types:
+//
+//	Delim   for the start and end of lists and dictionaries
+//	int64   for integers
+//	string  for byte strings, including dictionary keys
+type Token any
+
+// container is a list or dictionary opened through Token that has not been closed yet.
+type container struct {
+	kind    byte
+	keyNext bool
+	key     string
+	index   int
+	keys    keyOrder
+}
+
+// Decoder reads and decodes bencode values from an input stream.
+// It only buffers what it needs to produce the current token or value,
+// so arbitrarily long streams can be processed with bounded memory.
+type Decoder struct {
+	r       *bufio.Reader
+	off     int64
+	capture *bytes.Buffer
+	stack   []container
+	path    []pathElem
+	depth   int
+	strict  bool
+}
+
+// NewDecoder returns a new decoder that reads from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// InputOffset returns the number of bytes consumed from the input stream so far.
+func (d *Decoder) InputOffset() int64 {
+	return d.off
+}
+
+// More reports whether there is another element in the current list or dictionary,
+// or another top-level value in the stream.
+func (d *Decoder) More() bool {
+	c, err := d.r.Peek(1)
+	return err == nil && c[0] != 'e'
+}
+
+// Token returns the next token in the input stream. At the end of the input
+// stream Token returns nil, io.EOF.
+//
+// Token validates the nesting of lists and dictionaries and that dictionary
+// keys are strings; callers may mix Token with Decode to read nested values whole.
+func (d *Decoder) Token() (Token, error) {
+	c, err := d.r.Peek(1)
+	if err != nil {
+		if errors.Is(err, io.EOF) && len(d.stack) == 0 {
+			return nil, io.EOF
+		}
+		return nil, d.syntaxError("unexpected end of input")
+	}
+
+	if top := d.top(); top != nil && top.kind == 'd' && top.keyNext && c[0] != 'e' && !isDigit(c[0]) {
+		return nil, d.syntaxError("dictionary key must be a string, found %q", c[0])
+	}
+
+	switch {
+	case c[0] == 'l' || c[0] == 'd':
+		if len(d.stack)+d.depth >= maxDepth {
+			return nil, d.syntaxError("exceeded maximum nesting depth of %d", maxDepth)
+		}
+		d.readByte()
+		d.stack = append(d.stack, container{kind: c[0], keyNext: true})
+		return Delim(c[0]), nil
+
+	case c[0] == 'e':
+		top := d.top()
+		if top == nil {
+			return nil, d.syntaxError("unexpected end marker")
+		}
+		if top.kind == 'd' && !top.keyNext {
+			return nil, d.syntaxError("dictionary key without value")
+		}
+		d.readByte()
+		d.stack = d.stack[:len(d.stack)-1]
+		d.valueDone()
+		return Delim('e'), nil
+
+	case c[0] == 'i':
+		text, err := d.readInteger()
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return nil, d.syntaxError("integer %s overflows int64", text)
+		}
+		d.valueDone()
+		return n, nil
+
+	case isDigit(c[0]):
+		start := d.off
+		b, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		if top := d.top(); top != nil && top.kind == 'd' && top.keyNext {
+			if err := d.checkKey(&top.keys, b, start); err != nil {
+				return nil, err
+			}
+			top.key = string(b)
+		}
+		d.valueDone()
+		return string(b), nil
+
+	default:
+		return nil, d.syntaxError("invalid character %q looking for beginning of value", c[0])
+	}
+}
+
+// Decode reads the next complete bencoded value from its input and stores it
+// in the value pointed to by v, following the rules of Unmarshal.
+func (d *Decoder) Decode(v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("bencode: Decode requires a non-nil pointer, got %T", v)
+	}
+
+	if top := d.top(); top != nil && top.kind == 'd' && top.keyNext {
+		return d.syntaxError("Decode called where a dictionary key is expected")
+	}
+
+	if err := d.value(rv.Elem()); err != nil {
+		return err
+	}
+	d.valueDone()
+	return nil
+}
+
+// decodeRaw is like Decode but also returns the exact bytes the value was encoded with.
+func (d *Decoder) decodeRaw(v any) ([]byte, error) {
+	return d.captureValue(func() error {
+		return d.Decode(v)
+	})
+}
+
+// skipValue consumes the next value in the current container without decoding it.
+func (d *Decoder) skipValue() error {
+	if top := d.top(); top != nil && top.kind == 'd' && top.keyNext {
+		return d.syntaxError("value expected where a dictionary key is expected")
+	}
+	if err := d.skip(); err != nil {
+		return err
+	}
+	d.valueDone()
+	return nil
+}
+
+func (d *Decoder) top() *container {
+	if len(d.stack) == 0 {
+		return nil
+	}
+	return &d.stack[len(d.stack)-1]
+}
+
+// valueDone records that a complete value was consumed from the open container.
+func (d *Decoder) valueDone() {
+	top := d.top()
+	switch {
+	case top == nil:
+	case top.kind == 'd':
+		top.keyNext = !top.keyNext
+	case top.kind == 'l':
+		top.index++
+	}
+}
+
+func (d *Decoder) syntaxError(format string, args ...any) error {
+	return d.syntaxErrorAt(d.off, format, args...)
+}
+
+func (d *Decoder) syntaxErrorAt(offset int64, format string, args ...any) error {
+	return &SyntaxError{Offset: offset, Path: d.pathString(), msg: fmt.Sprintf(format, args...)}
+}
+
+func (d *Decoder) typeError(value string, t reflect.Type, offset int64) error {
+	return &UnmarshalTypeError{Value: value, Type: t, Offset: offset, Path: d.pathString()}
+}
+
+func (d *Decoder) peek() (byte, error) {
+	c, err := d.r.Peek(1)
+	if err != nil {
+		return 0, d.syntaxError("unexpected end of input")
+	}
+	return c[0], nil
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		return 0, d.syntaxError("unexpected end of input")
+	}
+	d.off++
+	if d.capture != nil {
+		d.capture.WriteByte(c)
+	}
+	return c, nil
+}
+
+func (d *Decoder) expect(c byte) error {
+	next, err := d.peek()
+	if err != nil {
+		return err
+	}
+	if next != c {
+		return d.syntaxError("expected %q, found %q", c, next)
+	}
+	_, err = d.readByte()
+	return err
+}
+
+// readUntil consumes bytes up to and including terminator and returns them without it.
+// At most 20 bytes are accepted, which is enough for any 64-bit integer.
+func (d *Decoder) readUntil(terminator byte, what string) (string, error) {
+	var text []byte
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			return "", err
+		}
+		if c == terminator {
+			return string(text), nil
+		}
+		if len(text) == 20 {
+			return "", d.syntaxError("%s too long", what)
+		}
+		text = append(text, c)
+	}
+}
+
+// readInteger consumes an integer value and returns the digits between 'i' and 'e'.
+func (d *Decoder) readInteger() (string, error) {
+	start := d.off
+	if err := d.expect('i'); err != nil {
+		return "", err
+	}
+	text, err := d.readUntil('e', "integer")
+	if err != nil {
+		return "", err
+	}
+	if d.strict && !canonicalInteger(text) {
+		return "", d.syntaxErrorAt(start, "non-canonical integer %q", text)
+	}
+	if _, err := strconv.ParseInt(text, 10, 64); err != nil {
+		if _, uerr := strconv.ParseUint(text, 10, 64); uerr != nil {
+			return "", d.syntaxError("invalid integer %q", text)
+		}
+	}
+	return text, nil
+}
+
+// readStringLength consumes the length prefix of a byte string including its colon.
+func (d *Decoder) readStringLength() (int64, error) {
+	start := d.off
+	text, err := d.readUntil(':', "string length")
+	if err != nil {
+		return 0, err
+	}
+	length, err := strconv.ParseInt(text, 10, 64)
+	if err != nil || length < 0 || !allDigits(text) {
+		return 0, d.syntaxErrorAt(start, "invalid string length %q", text)
+	}
+	if d.strict && !canonicalLength(text) {
+		return 0, d.syntaxErrorAt(start, "non-canonical string length %q", text)
+	}
+	return length, nil
+}
+
+// readString consumes a byte string and returns its contents. The buffer grows
+// as data arrives, so a bogus length prefix cannot force a huge allocation.
+func (d *Decoder) readString() ([]byte, error) {
+	length, err := d.readStringLength()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(int(min(length, 64*1024)))
+	if err := d.copyN(&buf, length); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// skipString consumes a byte string without retaining its contents.
+func (d *Decoder) skipString() error {
+	length, err := d.readStringLength()
+	if err != nil {
+		return err
+	}
+	return d.copyN(io.Discard, length)
+}
+
+func (d *Decoder) copyN(w io.Writer, n int64) error {
+	if d.capture != nil {
+		w = io.MultiWriter(w, d.capture)
+	}
+	copied, err := io.CopyN(w, d.r, n)
+	d.off += copied
+	if err != nil {
+		return d.syntaxError("string of length %d exceeds input", n)
+	}
+	return nil
+}
+
+// skip consumes the next value without decoding it.
+func (d *Decoder) skip() error {
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case c == 'i':
+		_, err := d.readInteger()
+		return err
+	case isDigit(c):
+		return d.skipString()
+	case c == 'l' || c == 'd':
+		if err := d.enter(); err != nil {
+			return err
+		}
+		defer d.leave()
+
+		d.readByte()
+		var keys keyOrder
+		for i := 0; ; i++ {
+			next, err := d.peek()
+			if err != nil {
+				return err
+			}
+			if next == 'e' {
+				d.readByte()
+				return nil
+			}
+
+			if c == 'd' {
+				key, err := d.readKey(&keys)
+				if err != nil {
+					return err
+				}
+				d.pushKey(key)
+			} else {
+				d.pushIndex(i)
+			}
+			err = d.skip()
+			d.popPath()
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return d.syntaxError("invalid character %q looking for beginning of value", c)
+	}
+}
+
+// readKey consumes a dictionary key and checks it against the previous key of the dictionary.
+func (d *Decoder) readKey(keys *keyOrder) ([]byte, error) {
+	c, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+	if !isDigit(c) {
+		return nil, d.syntaxError("dictionary key must be a string, found %q", c)
+	}
+
+	start := d.off
+	key, err := d.readString()
+	if err != nil {
+		return nil, err
+	}
+	if err := d.checkKey(keys, key, start); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// Encoder writes bencoded values to an output stream.
+type Encoder struct {
+	w *bufio.Writer
+}
+
+// NewEncoder returns a new encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: bufio.NewWriter(w)}
+}
+
+// Encode writes the bencode encoding of v to the stream, following the rules of Marshal.
+// Values are streamed to the underlying writer rather than built up in memory first,
+// so a failed Encode may leave a partial value behind.
+func (e *Encoder) Encode(v any) error {
+	if err := marshalValue(e.w, reflect.ValueOf(v)); err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
@@ -0,0 +1,243 @@
+package bencode
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecoderToken(t *testing.T) {
+	tests := []struct {
+		input   string
+		tokens  []Token
+		offsets []int64 // InputOffset after each token
+	}{
+		{"i42e", []Token{int64(42)}, []int64{4}},
+		{"i-42e", []Token{int64(-42)}, []int64{5}},
+		{"0:", []Token{""}, []int64{2}},
+		{"4:spam", []Token{"spam"}, []int64{6}},
+		{"le", []Token{Delim('l'), Delim('e')}, []int64{1, 2}},
+		{
+			"d1:ali1ei-2ee1:b0:e",
+			[]Token{Delim('d'), "a", Delim('l'), int64(1), int64(-2), Delim('e'), "b", "", Delim('e')},
+			[]int64{1, 4, 5, 8, 12, 13, 16, 18, 19},
+		},
+		// Several top-level values follow each other.
+		{"i1e1:x", []Token{int64(1), "x"}, []int64{3, 6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			d := NewDecoder(strings.NewReader(tt.input))
+			for i, want := range tt.tokens {
+				tok, err := d.Token()
+				if err != nil {
+					t.Fatalf("token %d: %v", i, err)
+				}
+				if tok != want {
+					t.Errorf("token %d = %#v, want %#v", i, tok, want)
+				}
+				if d.InputOffset() != tt.offsets[i] {
+					t.Errorf("offset after token %d = %d, want %d", i, d.InputOffset(), tt.offsets[i])
+				}
+			}
+			if tok, err := d.Token(); err != io.EOF {
+				t.Errorf("Token at end of input = %v, %v, want io.EOF", tok, err)
+			}
+		})
+	}
+}
+
+func TestDecoderTokenErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		tokens int   // tokens read successfully before the error
+		offset int64 // offset the error reports
+	}{
+		{"unterminated list", "l", 1, 1},
+		{"unterminated dictionary", "d1:ai1e", 3, 7},
+		{"truncated integer", "li12", 1, 4},
+		{"truncated string", "5:ab", 0, 4},
+		{"truncated length", "12", 0, 2},
+		{"length beyond input", "99999999999999999:x", 0, 19},
+		{"length overflows", "99999999999999999999:x", 0, 0},
+		{"negative length", "-1:a", 0, 0},
+		{"integer too long", "i123456789012345678901e", 0, 22},
+		{"integer overflows int64", "i9223372036854775808e", 0, 21},
+		{"empty integer", "ie", 0, 2},
+		{"stray end", "e", 0, 0},
+		{"integer key", "di1ei2ee", 1, 1},
+		{"key without value", "d1:ae", 2, 4},
+		{"invalid character", "x", 0, 0},
+		{"too deep", strings.Repeat("l", maxDepth+1), maxDepth, maxDepth},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDecoder(strings.NewReader(tt.input))
+			for i := range tt.tokens {
+				if _, err := d.Token(); err != nil {
+					t.Fatalf("token %d: %v", i, err)
+				}
+			}
+			tok, err := d.Token()
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("Token = %#v, %v, want a SyntaxError", tok, err)
+			}
+			if syntaxErr.Offset != tt.offset {
+				t.Errorf("error %q at offset %d, want %d", err, syntaxErr.Offset, tt.offset)
+			}
+		})
+	}
+}
+
+func TestDecoderDecodeStream(t *testing.T) {
+	d := NewDecoder(strings.NewReader("i1e4:spamli2ei3ee"))
+	values := []struct {
+		into   any
+		want   any
+		offset int64
+	}{
+		{new(int), 1, 3},
+		{new(string), "spam", 9},
+		{new([]int), []int{2, 3}, 17},
+	}
+	for i, v := range values {
+		if !d.More() {
+			t.Fatalf("More = false before value %d", i)
+		}
+		if err := d.Decode(v.into); err != nil {
+			t.Fatalf("Decode %d: %v", i, err)
+		}
+		if got := reflect.ValueOf(v.into).Elem().Interface(); !reflect.DeepEqual(got, v.want) {
+			t.Errorf("value %d = %#v, want %#v", i, got, v.want)
+		}
+		if d.InputOffset() != v.offset {
+			t.Errorf("offset after value %d = %d, want %d", i, d.InputOffset(), v.offset)
+		}
+	}
+	if d.More() {
+		t.Error("More = true at end of input")
+	}
+	var extra int
+	if err := d.Decode(&extra); err == nil {
+		t.Error("Decode succeeded at end of input")
+	}
+}
+
+func TestDecoderMixTokenAndDecode(t *testing.T) {
+	d := NewDecoder(strings.NewReader("d4:infod1:ai1ee4:listli1ei2ee4:spam3:egge"))
+	expectToken := func(want Token) {
+		t.Helper()
+		tok, err := d.Token()
+		if err != nil || tok != want {
+			t.Fatalf("Token = %#v, %v, want %#v", tok, err, want)
+		}
+	}
+
+	expectToken(Delim('d'))
+	expectToken("info")
+	var info map[string]int
+	if err := d.Decode(&info); err != nil {
+		t.Fatalf("Decode info: %v", err)
+	}
+	if info["a"] != 1 || d.InputOffset() != 15 {
+		t.Errorf("info = %v at offset %d", info, d.InputOffset())
+	}
+
+	// A value is expected after a key, not another key.
+	expectToken("list")
+	expectToken(Delim('l'))
+	var first int
+	if err := d.Decode(&first); err != nil || first != 1 {
+		t.Fatalf("Decode list element = %d, %v", first, err)
+	}
+	expectToken(int64(2))
+	expectToken(Delim('e'))
+
+	var key string
+	if err := d.Decode(&key); err == nil {
+		t.Fatal("Decode succeeded where a dictionary key is expected")
+	}
+	expectToken("spam")
+	var spam string
+	if err := d.Decode(&spam); err != nil || spam != "egg" {
+		t.Fatalf("Decode spam = %q, %v", spam, err)
+	}
+	expectToken(Delim('e'))
+	if _, err := d.Token(); err != io.EOF {
+		t.Errorf("Token after the dictionary = %v, want io.EOF", err)
+	}
+}
+
+func TestDecoderDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		into  any
+	}{
+		{"truncated dictionary", "d1:ai1e", new(map[string]int)},
+		{"truncated list", "li1ei2e", new([]int)},
+		{"truncated nested", "d1:ald1:b", new(any)},
+		{"truncated string", "10:abc", new([]byte)},
+		{"huge string", "9999999999:abc", new(string)},
+		{"too deep", strings.Repeat("l", maxDepth+1) + strings.Repeat("e", maxDepth+1), new(any)},
+		{"too deep skipped", "d1:a" + strings.Repeat("l", maxDepth) + strings.Repeat("e", maxDepth) + "e", new(struct{})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDecoder(strings.NewReader(tt.input))
+			err := d.Decode(tt.into)
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("Decode returned %v, want a SyntaxError", err)
+			}
+			if syntaxErr.Offset > int64(len(tt.input)) || d.InputOffset() > int64(len(tt.input)) {
+				t.Errorf("error offset %d and input offset %d beyond %d bytes of input", syntaxErr.Offset, d.InputOffset(), len(tt.input))
+			}
+		})
+	}
+
+	d := NewDecoder(strings.NewReader("i1e"))
+	if err := d.Decode(nil); err == nil {
+		t.Error("Decode(nil) succeeded")
+	}
+	var n int
+	if err := d.Decode(n); err == nil {
+		t.Error("Decode into a non-pointer succeeded")
+	}
+}
+
+// limitedReader fails the test if more than n bytes are read from it.
+type limitedReader struct {
+	t *testing.T
+	r io.Reader
+	n int
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n -= n
+	if l.n < 0 {
+		l.t.Errorf("read %d bytes past the limit", -l.n)
+	}
+	return n, err
+}
+
+func TestDecoderReadsLazily(t *testing.T) {
+	// Token reads what the current token needs, not the input as a whole.
+	long := strings.Repeat("x", 1<<20)
+	input := "l1:a" + "1048576:" + long + "e"
+	r := &limitedReader{t: t, r: strings.NewReader(input), n: 64 * 1024}
+	d := NewDecoder(r)
+	for _, want := range []Token{Delim('l'), "a"} {
+		if tok, err := d.Token(); err != nil || tok != want {
+			t.Fatalf("Token = %#v, %v, want %#v", tok, err, want)
+		}
+	}
+	if d.InputOffset() != 4 {
+		t.Errorf("offset = %d, want 4", d.InputOffset())
+	}
+}
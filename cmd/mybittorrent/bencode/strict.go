@@ -0,0 +1,151 @@
+package bencode
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// maxDepth bounds how deeply lists and dictionaries may nest, so hostile input
+// cannot exhaust the stack of the recursive decoder.
+const maxDepth = 512
+
+// Strict makes the decoder reject any encoding that is not canonical per BEP 3:
+// integers with leading zeros or a negative zero, string lengths with leading zeros,
+// and dictionaries whose keys are duplicated or not sorted as raw byte strings.
+//
+// Malformed input such as negative string lengths or truncated values is rejected
+// in either mode.
+func (d *Decoder) Strict() {
+	d.strict = true
+}
+
+// Validate reports whether data is a single, canonically encoded bencode value.
+// The returned error is a *SyntaxError carrying the offset and path of the problem.
+func Validate(data []byte) error {
+	d := NewDecoder(bytes.NewReader(data))
+	d.Strict()
+	if err := d.skip(); err != nil {
+		return err
+	}
+	if d.off != int64(len(data)) {
+		return d.syntaxError("unexpected data after top-level value")
+	}
+	return nil
+}
+
+// pathElem is one step from the top-level value to the value being decoded:
+// either a dictionary key or a list index.
+type pathElem struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+func (d *Decoder) pushKey(key []byte) {
+	d.path = append(d.path, pathElem{key: string(key)})
+}
+
+func (d *Decoder) pushIndex(index int) {
+	d.path = append(d.path, pathElem{index: index, isIndex: true})
+}
+
+func (d *Decoder) popPath() {
+	d.path = d.path[:len(d.path)-1]
+}
+
+// pathString renders the location currently being decoded, such as info.files[3].path.
+// Containers opened through Token contribute their current key or index first.
+func (d *Decoder) pathString() string {
+	var sb strings.Builder
+	writeKey := func(key string) {
+		if sb.Len() > 0 {
+			sb.WriteByte('.')
+		}
+		sb.WriteString(key)
+	}
+	writeIndex := func(index int) {
+		sb.WriteByte('[')
+		sb.WriteString(strconv.Itoa(index))
+		sb.WriteByte(']')
+	}
+
+	for _, c := range d.stack {
+		switch {
+		case c.kind == 'd' && !c.keyNext:
+			writeKey(c.key)
+		case c.kind == 'l':
+			writeIndex(c.index)
+		}
+	}
+	for _, elem := range d.path {
+		if elem.isIndex {
+			writeIndex(elem.index)
+		} else {
+			writeKey(elem.key)
+		}
+	}
+	return sb.String()
+}
+
+// enter records that a list or dictionary was opened and enforces maxDepth.
+func (d *Decoder) enter() error {
+	if len(d.stack)+d.depth >= maxDepth {
+		return d.syntaxError("exceeded maximum nesting depth of %d", maxDepth)
+	}
+	d.depth++
+	return nil
+}
+
+func (d *Decoder) leave() {
+	d.depth--
+}
+
+// keyOrder remembers the previous key of a dictionary being decoded.
+type keyOrder struct {
+	last []byte
+	seen bool
+}
+
+// checkKey enforces that dictionary keys are unique and sorted in strict mode.
+// offset is where the key started, so the error points at the offending key.
+func (d *Decoder) checkKey(order *keyOrder, key []byte, offset int64) error {
+	if d.strict && order.seen {
+		switch cmp := bytes.Compare(key, order.last); {
+		case cmp == 0:
+			return d.syntaxErrorAt(offset, "duplicate dictionary key %q", key)
+		case cmp < 0:
+			return d.syntaxErrorAt(offset, "dictionary key %q not sorted after %q", key, order.last)
+		}
+	}
+	order.last = append(order.last[:0], key...)
+	order.seen = true
+	return nil
+}
+
+// canonicalInteger reports whether text is the canonical form of an integer:
+// no sign other than a leading minus, no leading zeros and no negative zero.
+func canonicalInteger(text string) bool {
+	digits := strings.TrimPrefix(text, "-")
+	if digits == "" || !allDigits(digits) {
+		return false
+	}
+	if digits[0] == '0' {
+		return text == "0"
+	}
+	return true
+}
+
+// canonicalLength reports whether text is the canonical form of a string length.
+func canonicalLength(text string) bool {
+	return text != "" && allDigits(text) && (text == "0" || text[0] != '0')
+}
+
+func allDigits(s string) bool {
+	for i := range len(s) {
+		if !isDigit(s[i]) {
+			return false
+		}
+	}
+	return true
+}
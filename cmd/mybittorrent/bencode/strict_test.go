@@ -0,0 +1,137 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestStrictRejections(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		offset int64  // where the error points
+		path   string // the location it names
+	}{
+		{"unsorted keys", "d1:bi1e1:ai2ee", 7, ""},
+		{"keys sorted by byte value", "d1:ai1e1:Bi2ee", 7, ""},
+		{"duplicate keys", "d1:ai1e1:ai2ee", 7, ""},
+		{"nested unsorted keys", "d4:infod4:name1:x6:lengthi1eee", 17, "info"},
+		{"leading zero", "i01e", 0, ""},
+		{"zero with leading zero", "i00e", 0, ""},
+		{"negative zero", "i-0e", 0, ""},
+		{"negative leading zero", "i-01e", 0, ""},
+		{"plus sign", "i+1e", 0, ""},
+		{"string length leading zero", "02:ab", 0, ""},
+		{"list element leading zero", "li1ei02ee", 4, "[1]"},
+		{"trailing data", "i1ei2e", 3, ""},
+		{"trailing end marker", "lee", 2, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate([]byte(tt.input))
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("Validate returned %v, want a SyntaxError", err)
+			}
+			if syntaxErr.Offset != tt.offset || syntaxErr.Path != tt.path {
+				t.Errorf("error %q at offset %d (%s), want offset %d (%s)", err, syntaxErr.Offset, syntaxErr.Path, tt.offset, tt.path)
+			}
+
+			// The same input decodes without Strict, up to any trailing data.
+			d := NewDecoder(strings.NewReader(tt.input))
+			var v any
+			if err := d.Decode(&v); err != nil {
+				t.Errorf("non-strict Decode: %v", err)
+			}
+
+			d = NewDecoder(strings.NewReader(tt.input))
+			d.Strict()
+			if err := d.Decode(&v); err == nil && d.InputOffset() == int64(len(tt.input)) {
+				t.Error("strict Decode accepted the input")
+			}
+		})
+	}
+}
+
+func TestStrictAccepts(t *testing.T) {
+	inputs := []string{
+		"i0e",
+		"i-1e",
+		"i10e",
+		"0:",
+		"10:0123456789",
+		"le",
+		"de",
+		"d1:Bi2e1:ai1e2:abi3e1:\xffi4ee",
+		"d4:infod6:lengthi1e4:name1:xee",
+		"ld1:ai0eed1:ai0eee", // equal keys in different dictionaries
+	}
+	for _, input := range inputs {
+		if err := Validate([]byte(input)); err != nil {
+			t.Errorf("Validate(%q): %v", input, err)
+		}
+	}
+}
+
+func TestStrictToken(t *testing.T) {
+	// Token enforces key order too, pointing at the offending key.
+	d := NewDecoder(strings.NewReader("d1:bi1e1:ai2ee"))
+	d.Strict()
+	for range 3 {
+		if _, err := d.Token(); err != nil {
+			t.Fatalf("Token: %v", err)
+		}
+	}
+	_, err := d.Token()
+	var syntaxErr *SyntaxError
+	if !errors.As(err, &syntaxErr) || syntaxErr.Offset != 7 {
+		t.Fatalf("Token returned %v, want a SyntaxError at offset 7", err)
+	}
+}
+
+func TestReadInfoStrict(t *testing.T) {
+	info := "d6:lengthi1e4:name1:x12:piece lengthi1e6:pieces20:" + strings.Repeat("h", 20) + "e"
+	valid := "d8:announce3:url4:info" + info + "e"
+	if _, err := ReadInfoStrict(strings.NewReader(valid)); err != nil {
+		t.Fatalf("ReadInfoStrict rejected canonical metainfo: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"unsorted top-level keys", "d4:info" + info + "8:announce3:urle"},
+		{"leading zero in info", strings.Replace(valid, "lengthi1e", "lengthi01e", 1)},
+		{"trailing data", valid + "de"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ReadInfo(strings.NewReader(tt.input)); err != nil {
+				t.Fatalf("ReadInfo rejected the input: %v", err)
+			}
+			if _, err := ReadInfoStrict(strings.NewReader(tt.input)); err == nil {
+				t.Error("ReadInfoStrict accepted the input")
+			}
+		})
+	}
+}
+
+func TestValidateMarshalOutput(t *testing.T) {
+	// Marshal only produces canonical encodings.
+	values := []any{
+		map[string]any{"z": 1, "a": []any{"x", map[string]int{"b": 0, "a": -1}}},
+		optional{Name: "n", Count: 3, Tags: []string{"a", "b"}},
+		InnerInfo{Name: "x", Length: 1, PieceLength: 1, Pieces: bytes.Repeat([]byte{1}, 20)},
+	}
+	for _, v := range values {
+		encoded, err := Marshal(v)
+		if err != nil {
+			t.Fatalf("Marshal(%#v): %v", v, err)
+		}
+		if err := Validate(encoded); err != nil {
+			t.Errorf("Validate(%q): %v", encoded, err)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package bencode
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// SyntaxError describes malformed bencode input and where it was found.
+type SyntaxError struct {
+	Offset int64  // byte offset in the input where the problem was found
+	Path   string // location of the offending value, such as info.files[3].path
+	msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("bencode: %s at offset %d", e.msg, e.Offset)
+	}
+	return fmt.Sprintf("bencode: %s at offset %d (%s)", e.msg, e.Offset, e.Path)
+}
+
+// UnmarshalTypeError describes a bencode value that cannot be stored in a Go type.
+type UnmarshalTypeError struct {
+	Value  string
+	Type   reflect.Type
+	Offset int64
+	Path   string
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("bencode: cannot unmarshal %s into Go value of type %s at offset %d", e.Value, e.Type, e.Offset)
+	}
+	return fmt.Sprintf("bencode: cannot unmarshal %s into Go value of type %s at offset %d (%s)", e.Value, e.Type, e.Offset, e.Path)
+}
+
+// Unmarshal parses the bencoded data and stores the result in the value pointed to by v.
+//
+// It is the inverse of Marshal: integers decode into any signed or unsigned integer
+// type or bool, byte strings into strings, byte slices and byte arrays, lists into
+// slices and arrays, and dictionaries into maps with string keys or structs. Dictionary
+// keys without a matching struct field are skipped. RawMessage receives the exact
+// encoding of its value. Decoding into an empty interface produces the same values
+// as Decode: int, string, []any and map[string]any.
+func Unmarshal(data []byte, v any) error {
+	d := NewDecoder(bytes.NewReader(data))
+	if err := d.Decode(v); err != nil {
+		return err
+	}
+	if d.off != int64(len(data)) {
+		return d.syntaxError("unexpected data after top-level value")
+	}
+	return nil
+}
+
+func (d *Decoder) value(v reflect.Value) error {
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+
+	if v.Type() == rawMessageType {
+		raw, err := d.captureValue(d.skip)
+		if err != nil {
+			return err
+		}
+		v.SetBytes(raw)
+		return nil
+	}
+
+	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		value, err := d.any()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(value))
+		return nil
+	}
+
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case c == 'i':
+		return d.integer(v)
+	case isDigit(c):
+		return d.string(v)
+	case c == 'l':
+		return d.list(v)
+	case c == 'd':
+		return d.dict(v)
+	default:
+		return d.syntaxError("invalid character %q looking for beginning of value", c)
+	}
+}
+
+func (d *Decoder) integer(v reflect.Value) error {
+	start := d.off
+	text, err := d.readInteger()
+	if err != nil {
+		return err
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(text, 10, v.Type().Bits())
+		if err != nil {
+			return d.typeError("integer "+text, v.Type(), start)
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(text, 10, v.Type().Bits())
+		if err != nil {
+			return d.typeError("integer "+text, v.Type(), start)
+		}
+		v.SetUint(n)
+	case reflect.Bool:
+		switch text {
+		case "0":
+			v.SetBool(false)
+		case "1":
+			v.SetBool(true)
+		default:
+			return d.typeError("integer "+text, v.Type(), start)
+		}
+	default:
+		return d.typeError("integer", v.Type(), start)
+	}
+	return nil
+}
+
+func (d *Decoder) string(v reflect.Value) error {
+	start := d.off
+	b, err := d.readString()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(string(b))
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		v.SetBytes(b)
+	case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8:
+		if len(b) != v.Len() {
+			return d.typeError(fmt.Sprintf("string of length %d", len(b)), v.Type(), start)
+		}
+		reflect.Copy(v, reflect.ValueOf(b))
+	default:
+		return d.typeError("string", v.Type(), start)
+	}
+	return nil
+}
+
+func (d *Decoder) list(v reflect.Value) error {
+	start := d.off
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return d.typeError("list", v.Type(), start)
+	}
+	if err := d.expect('l'); err != nil {
+		return err
+	}
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+
+	if v.Kind() == reflect.Slice {
+		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+	}
+
+	for i := 0; ; i++ {
+		c, err := d.peek()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			d.readByte()
+			if v.Kind() == reflect.Array && i != v.Len() {
+				return d.typeError(fmt.Sprintf("list of length %d", i), v.Type(), start)
+			}
+			return nil
+		}
+
+		if v.Kind() == reflect.Array {
+			if i >= v.Len() {
+				return d.typeError(fmt.Sprintf("list longer than %d", v.Len()), v.Type(), start)
+			}
+			if err := d.element(i, v.Index(i)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if err := d.element(i, elem); err != nil {
+			return err
+		}
+		v.Set(reflect.Append(v, elem))
+	}
+}
+
+func (d *Decoder) dict(v reflect.Value) error {
+	start := d.off
+	var fields []field
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return d.typeError("dictionary", v.Type(), start)
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+	case reflect.Struct:
+		fields = cachedFields(v.Type())
+	default:
+		return d.typeError("dictionary", v.Type(), start)
+	}
+
+	if err := d.expect('d'); err != nil {
+		return err
+	}
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+
+	var keys keyOrder
+	for {
+		c, err := d.peek()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			d.readByte()
+			return nil
+		}
+
+		key, err := d.readKey(&keys)
+		if err != nil {
+			return err
+		}
+
+		d.pushKey(key)
+		switch target, ok := lookupField(fields, string(key)); {
+		case v.Kind() == reflect.Map:
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err = d.value(elem); err == nil {
+				v.SetMapIndex(reflect.ValueOf(string(key)).Convert(v.Type().Key()), elem)
+			}
+		case ok:
+			err = d.value(v.FieldByIndex(target.index))
+		default:
+			err = d.skip()
+		}
+		d.popPath()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// element decodes the list element at index i into v.
+func (d *Decoder) element(i int, v reflect.Value) error {
+	d.pushIndex(i)
+	defer d.popPath()
+	return d.value(v)
+}
+
+// captureValue runs decode while recording the raw bytes it consumes.
+// Captures nest, so the bytes are also passed on to any enclosing capture.
+func (d *Decoder) captureValue(decode func() error) ([]byte, error) {
+	outer := d.capture
+	var raw bytes.Buffer
+	d.capture = &raw
+	err := decode()
+	d.capture = outer
+	if outer != nil {
+		outer.Write(raw.Bytes())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return raw.Bytes(), nil
+}
+
+func lookupField(fields []field, name string) (field, bool) {
+	for _, f := range fields {
+		if f.name == name {
+			return f, true
+		}
+	}
+	return field{}, false
+}
+
+// any decodes the next value into its generic representation.
+func (d *Decoder) any() (any, error) {
+	c, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c == 'i':
+		text, err := d.readInteger()
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(text)
+		if err != nil {
+			return nil, d.syntaxError("integer %s overflows int", text)
+		}
+		return n, nil
+
+	case isDigit(c):
+		b, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+
+	case c == 'l':
+		if err := d.enter(); err != nil {
+			return nil, err
+		}
+		defer d.leave()
+
+		d.readByte()
+		list := make([]any, 0)
+		for i := 0; ; i++ {
+			c, err := d.peek()
+			if err != nil {
+				return nil, err
+			}
+			if c == 'e' {
+				d.readByte()
+				return list, nil
+			}
+			d.pushIndex(i)
+			item, err := d.any()
+			d.popPath()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+
+	case c == 'd':
+		if err := d.enter(); err != nil {
+			return nil, err
+		}
+		defer d.leave()
+
+		d.readByte()
+		dict := make(map[string]any)
+		var keys keyOrder
+		for {
+			c, err := d.peek()
+			if err != nil {
+				return nil, err
+			}
+			if c == 'e' {
+				d.readByte()
+				return dict, nil
+			}
+			key, err := d.readKey(&keys)
+			if err != nil {
+				return nil, err
+			}
+			d.pushKey(key)
+			value, err := d.any()
+			d.popPath()
+			if err != nil {
+				return nil, err
+			}
+			dict[string(key)] = value
+		}
+
+	default:
+		return nil, d.syntaxError("invalid character %q looking for beginning of value", c)
+	}
+}
@@ -1,18 +1,23 @@
 package main
 
 import (
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"net"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
 	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/magnet"
 	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/peering"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/storage"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -39,9 +44,22 @@ func main() {
 	downloadCmd := flag.NewFlagSet("download", flag.ExitOnError)
 	magnetParseCmd := flag.NewFlagSet("magnet_parse", flag.ExitOnError)
 	magnetHandshakeCmd := flag.NewFlagSet("magnet_handshake", flag.ExitOnError)
+	magnetInfoCmd := flag.NewFlagSet("magnet_info", flag.ExitOnError)
+	magnetDownloadCmd := flag.NewFlagSet("magnet_download", flag.ExitOnError)
+	scrapeCmd := flag.NewFlagSet("scrape", flag.ExitOnError)
+	verifyCmd := flag.NewFlagSet("verify", flag.ExitOnError)
+	seedCmd := flag.NewFlagSet("seed", flag.ExitOnError)
 
 	downloadPieceOutput := downloadPieceCmd.String("o", "", "output file path")
-	downloadOutput := downloadCmd.String("o", "", "output file path")
+	downloadOutput := downloadCmd.String("o", "", "output file path (parent directory of the torrent's directory for multi-file torrents)")
+	downloadSparse := downloadCmd.Bool("sparse", false, "create sparse files instead of allocating them up front")
+	downloadStorage := downloadCmd.String("storage", "file", "storage backend: file or mmap")
+	magnetDownloadOutput := magnetDownloadCmd.String("o", "", "output file path (parent directory of the torrent's directory for multi-file torrents)")
+	magnetDownloadSparse := magnetDownloadCmd.Bool("sparse", false, "create sparse files instead of allocating them up front")
+	magnetDownloadStorage := magnetDownloadCmd.String("storage", "file", "storage backend: file or mmap")
+	magnetDownloadTorrent := magnetDownloadCmd.String("torrent", "", "metainfo file caching the torrent's metadata, written if it does not exist")
+	seedPort := seedCmd.Int("port", 6881, "port to accept peer connections on")
+	verifyResume := verifyCmd.Bool("resume", true, "save the verified pieces as resume data for download")
 
 	if len(os.Args) < 2 {
 		logger.Error("Expected subcommand")
@@ -96,7 +114,7 @@ func main() {
 			logger.Error("Failed to parse download command", zap.Error(err))
 			os.Exit(1)
 		}
-		err = handleDownload(*downloadOutput, downloadCmd.Args())
+		err = handleDownload(*downloadOutput, *downloadStorage, *downloadSparse, downloadCmd.Args())
 
 	case "magnet_parse":
 		err = magnetParseCmd.Parse(os.Args[2:])
@@ -114,6 +132,46 @@ func main() {
 		}
 		err = handleMagnetHandshake(magnetHandshakeCmd.Args())
 
+	case "magnet_info":
+		err = magnetInfoCmd.Parse(os.Args[2:])
+		if err != nil {
+			logger.Error("Failed to parse magnet_info command", zap.Error(err))
+			os.Exit(1)
+		}
+		err = handleMagnetInfo(magnetInfoCmd.Args())
+
+	case "magnet_download":
+		err = magnetDownloadCmd.Parse(os.Args[2:])
+		if err != nil {
+			logger.Error("Failed to parse magnet_download command", zap.Error(err))
+			os.Exit(1)
+		}
+		err = handleMagnetDownload(*magnetDownloadOutput, *magnetDownloadStorage, *magnetDownloadSparse, *magnetDownloadTorrent, magnetDownloadCmd.Args())
+
+	case "scrape":
+		err = scrapeCmd.Parse(os.Args[2:])
+		if err != nil {
+			logger.Error("Failed to parse scrape command", zap.Error(err))
+			os.Exit(1)
+		}
+		err = handleScrape(scrapeCmd.Args())
+
+	case "verify":
+		err = verifyCmd.Parse(os.Args[2:])
+		if err != nil {
+			logger.Error("Failed to parse verify command", zap.Error(err))
+			os.Exit(1)
+		}
+		err = handleVerify(*verifyResume, verifyCmd.Args())
+
+	case "seed":
+		err = seedCmd.Parse(os.Args[2:])
+		if err != nil {
+			logger.Error("Failed to parse seed command", zap.Error(err))
+			os.Exit(1)
+		}
+		err = handleSeed(*seedPort, seedCmd.Args())
+
 	default:
 		logger.Error("Unknown command", zap.String("command", os.Args[1]))
 		os.Exit(1)
@@ -128,6 +186,21 @@ func main() {
 	}
 }
 
+// loadTorrent streams and parses the metainfo file at path.
+func loadTorrent(path string) (*bencode.TorrentInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read torrent file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := bencode.ReadInfo(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse torrent file: %w", err)
+	}
+	return info, nil
+}
+
 func handleDecode(args []string) error {
 	bencodedValue := args[0]
 	decoded, _, err := bencode.Decode[any](bencodedValue)
@@ -145,23 +218,22 @@ func handleInfo(args []string) error {
 	}
 	filePath := args[0]
 
-	fileContent, err := os.ReadFile(filePath)
-	if err != nil {
-		return fmt.Errorf("failed to read file: %w", err)
-	}
-
-	info, err := bencode.Info(string(fileContent))
+	info, err := loadTorrent(filePath)
 	if err != nil {
-		return fmt.Errorf("failed to decode file content: %w", err)
+		return err
 	}
+	return printInfo(info)
+}
 
+// printInfo prints the tracker, length, info hash and piece hashes of a torrent.
+func printInfo(info *bencode.TorrentInfo) error {
 	hash, _, err := bencode.HashInfo(info)
 	if err != nil {
 		return fmt.Errorf("failed to encode info: %w", err)
 	}
 
 	fmt.Printf("Tracker URL: %s\n", info.Announce)
-	fmt.Printf("Length: %d\n", info.Info.Length)
+	fmt.Printf("Length: %d\n", info.Info.TotalLength())
 	fmt.Printf("Info Hash: %s\n", hash)
 	fmt.Printf("Piece Length: %d\n", info.Info.PieceLength)
 	fmt.Println("Piece Hashes:")
@@ -180,14 +252,9 @@ func handlePeers(args []string) error {
 	}
 	filePath := args[0]
 
-	fileContent, err := os.ReadFile(filePath)
-	if err != nil {
-		return fmt.Errorf("failed to read file: %w", err)
-	}
-
-	info, err := bencode.Info(string(fileContent))
+	info, err := loadTorrent(filePath)
 	if err != nil {
-		return fmt.Errorf("failed to decode file content: %w", err)
+		return err
 	}
 
 	peers, err := peering.GetPeers(info)
@@ -196,7 +263,7 @@ func handlePeers(args []string) error {
 	}
 
 	for _, peer := range peers {
-		fmt.Printf("%s:%d\n", peer.IP, peer.Port)
+		fmt.Println(peer.Addr())
 	}
 	return nil
 }
@@ -212,20 +279,16 @@ func handleDownloadPiece(outputPath string, args []string) error {
 		return fmt.Errorf("invalid piece index: %v", err)
 	}
 
-	torrentData, err := os.ReadFile(torrentPath)
-	if err != nil {
-		return fmt.Errorf("failed to read torrent file: %v", err)
-	}
-
-	info, err := bencode.Info(string(torrentData))
+	info, err := loadTorrent(torrentPath)
 	if err != nil {
-		return fmt.Errorf("failed to parse torrent file: %v", err)
+		return err
 	}
 
 	client, err := peering.NewClient(info)
 	if err != nil {
 		return err
 	}
+	defer client.Close()
 
 	pieceData, err := client.DownloadPiece(pieceIndex)
 	if err != nil {
@@ -235,34 +298,54 @@ func handleDownloadPiece(outputPath string, args []string) error {
 	return os.WriteFile(outputPath, pieceData, 0644)
 }
 
-func handleDownload(outputPath string, args []string) error {
+func handleDownload(outputPath, backend string, sparse bool, args []string) error {
 	if outputPath == "" || len(args) < 1 {
 		return fmt.Errorf("usage: download -o <output-path> <torrent-file>")
 	}
 
 	torrentPath := args[0]
 
-	torrentData, err := os.ReadFile(torrentPath)
-	if err != nil {
-		return fmt.Errorf("failed to read torrent file: %v", err)
-	}
-
-	info, err := bencode.Info(string(torrentData))
+	info, err := loadTorrent(torrentPath)
 	if err != nil {
-		return fmt.Errorf("failed to parse torrent file: %v", err)
+		return err
 	}
 
 	client, err := peering.NewClient(info)
 	if err != nil {
 		return err
 	}
+	return downloadWith(client, outputPath, backend, sparse)
+}
 
-	fileData, err := client.DownloadAll()
-	if err != nil {
-		return err
+// downloadWith downloads the client's torrent to outputPath with the given storage backend,
+// resuming from earlier runs, and closes the client.
+func downloadWith(client *peering.Client, outputPath, backend string, sparse bool) error {
+	defer client.Close()
+
+	// Closing the client on an interrupt stops the download cleanly, saving its resume data.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		client.Close()
+	}()
+
+	var err error
+	opts := storage.Options{Sparse: sparse}
+	var store storage.Storage
+	switch backend {
+	case "file":
+		store = storage.NewFileStorage(outputPath, opts)
+	case "mmap":
+		store, err = storage.NewMmapStorage(outputPath, opts)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown storage backend %q", backend)
 	}
 
-	return os.WriteFile(outputPath, fileData, 0644)
+	return client.DownloadResumable(store, outputPath)
 }
 
 func handleHandshake(args []string) error {
@@ -273,14 +356,9 @@ func handleHandshake(args []string) error {
 	torrentPath := args[0]
 	peerAddr := args[1]
 
-	torrentData, err := os.ReadFile(torrentPath)
-	if err != nil {
-		return fmt.Errorf("failed to read torrent file: %w", err)
-	}
-
-	info, err := bencode.Info(string(torrentData))
+	info, err := loadTorrent(torrentPath)
 	if err != nil {
-		return fmt.Errorf("failed to parse torrent file: %w", err)
+		return err
 	}
 
 	conn, err := net.DialTimeout("tcp", peerAddr, 3*time.Second)
@@ -356,8 +434,7 @@ func handleMagnetHandshake(args []string) error {
 
 	// Connect to first peer
 	peer := peers[0]
-	peerAddr := fmt.Sprintf("%s:%d", peer.IP, peer.Port)
-	conn, err := net.DialTimeout("tcp", peerAddr, 3*time.Second)
+	conn, err := net.DialTimeout("tcp", peer.Addr(), 3*time.Second)
 	if err != nil {
 		return fmt.Errorf("failed to connect to peer: %w", err)
 	}
@@ -373,5 +450,280 @@ func handleMagnetHandshake(args []string) error {
 	peerID := response[48:68]
 	fmt.Printf("Peer ID: %x\n", peerID)
 
+	if !peering.SupportsExtensions(response) {
+		return nil
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	ext := peering.NewExtensions(func(m peering.PeerMessage) error {
+		return peering.SendPeerMessage(conn, m)
+	})
+	// Announced so that the peer tells us its ID for it; nothing is fetched here.
+	ext.Register("ut_metadata", func([]byte) error { return nil })
+	if _, err := peering.ExchangeExtendedHandshake(conn, ext); err != nil {
+		return fmt.Errorf("extended handshake failed: %w", err)
+	}
+	if id, ok := ext.PeerID("ut_metadata"); ok {
+		fmt.Printf("Peer Metadata Extension ID: %d\n", id)
+	}
+
+	return nil
+}
+
+func handleMagnetInfo(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: magnet_info <magnet-link>")
+	}
+
+	link, err := magnet.Parse(args[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse magnet link: %w", err)
+	}
+
+	info, err := peering.ResolveMagnet(link)
+	if err != nil {
+		return err
+	}
+	return printInfo(info)
+}
+
+func handleMagnetDownload(outputPath, backend string, sparse bool, torrentPath string, args []string) error {
+	if outputPath == "" || len(args) < 1 {
+		return fmt.Errorf("usage: magnet_download -o <output-path> [-torrent <torrent-file>] <magnet-link>")
+	}
+
+	link, err := magnet.Parse(args[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse magnet link: %w", err)
+	}
+
+	// A metainfo file left by an earlier run saves fetching the metadata again.
+	var cached *bencode.TorrentInfo
+	if torrentPath != "" {
+		if _, err := os.Stat(torrentPath); err == nil {
+			if cached, err = loadTorrent(torrentPath); err != nil {
+				return err
+			}
+		}
+	}
+
+	client, err := peering.NewMagnetClient(link, cached)
+	if err != nil {
+		return err
+	}
+	if torrentPath != "" && cached == nil {
+		if err := saveTorrent(torrentPath, client.Info()); err != nil {
+			client.Close()
+			return fmt.Errorf("failed to write torrent file: %w", err)
+		}
+	}
+	return downloadWith(client, outputPath, backend, sparse)
+}
+
+// saveTorrent writes info to path as a metainfo file, replacing it atomically.
+func saveTorrent(path string, info *bencode.TorrentInfo) error {
+	data, err := bencode.MarshalMetainfo(info)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func handleScrape(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: scrape <torrent-file|magnet-link>")
+	}
+
+	var trackers []string
+	var infoHash []byte
+	if strings.HasPrefix(args[0], "magnet:") {
+		link, err := magnet.Parse(args[0])
+		if err != nil {
+			return fmt.Errorf("failed to parse magnet link: %w", err)
+		}
+		trackers = link.Trackers
+		infoHash, err = hex.DecodeString(link.InfoHash)
+		if err != nil {
+			return fmt.Errorf("failed to decode info hash: %w", err)
+		}
+	} else {
+		info, err := loadTorrent(args[0])
+		if err != nil {
+			return err
+		}
+		for _, tier := range info.Trackers() {
+			trackers = append(trackers, tier...)
+		}
+		_, infoHash, err = bencode.HashInfo(info)
+		if err != nil {
+			return fmt.Errorf("failed to calculate info hash: %w", err)
+		}
+	}
+
+	if len(trackers) == 0 {
+		return fmt.Errorf("no trackers found")
+	}
+
+	var lastErr error
+	scraped := 0
+	for _, trackerURL := range trackers {
+		results, err := peering.Scrape(trackerURL, [][]byte{infoHash})
+		if err != nil {
+			zap.L().Warn("Scrape failed", zap.String("tracker", trackerURL), zap.Error(err))
+			lastErr = err
+			continue
+		}
+		if len(results) == 0 {
+			zap.L().Warn("Tracker does not know the torrent", zap.String("tracker", trackerURL))
+			continue
+		}
+
+		scraped++
+		fmt.Printf("Tracker URL: %s\n", trackerURL)
+		fmt.Printf("Seeders: %d\n", results[0].Seeders)
+		fmt.Printf("Leechers: %d\n", results[0].Leechers)
+		fmt.Printf("Completed: %d\n", results[0].Completed)
+	}
+
+	if scraped == 0 && lastErr != nil {
+		return fmt.Errorf("failed to scrape any tracker: %w", lastErr)
+	}
 	return nil
 }
+
+// handleVerify hashes the data at the output path of a torrent and reports which pieces
+// and files are complete. Unless disabled, the result is saved as resume data so that a
+// later download only fetches the missing pieces.
+func handleVerify(saveResume bool, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: verify [-resume=false] <torrent-file> <path>")
+	}
+
+	torrentPath := args[0]
+	outputPath := args[1]
+
+	info, err := loadTorrent(torrentPath)
+	if err != nil {
+		return err
+	}
+	_, infoHash, err := bencode.HashInfo(info)
+	if err != nil {
+		return fmt.Errorf("failed to encode info: %w", err)
+	}
+
+	files, err := storage.OpenFiles(&info.Info, outputPath, storage.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer files.Close()
+
+	result, err := storage.Verify(&info.Info, files, 0)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range result.Files {
+		status := "incomplete"
+		if file.Complete() {
+			status = "complete"
+		}
+		fmt.Printf("%s: %d/%d pieces, %s\n", file.Path, file.Verified, file.Pieces, status)
+	}
+
+	var missing []string
+	for i, ok := range result.Pieces {
+		if !ok {
+			missing = append(missing, strconv.Itoa(i))
+		}
+	}
+	fmt.Printf("Verified: %d/%d pieces\n", result.Verified(), len(result.Pieces))
+	if len(missing) > 0 {
+		fmt.Printf("Missing pieces: %s\n", strings.Join(missing, " "))
+	}
+	fmt.Printf("Bitfield: %x\n", result.Bitfield())
+
+	if !saveResume {
+		return nil
+	}
+	resume, err := peering.NewResumeData(&info.Info, infoHash, outputPath, result.Bitfield())
+	if err != nil {
+		return err
+	}
+	resumePath := peering.ResumePath(outputPath)
+	if err := peering.SaveResumeData(resumePath, resume); err != nil {
+		return fmt.Errorf("failed to save resume data: %w", err)
+	}
+	fmt.Printf("Resume data: %s\n", resumePath)
+	return nil
+}
+
+// handleSeed serves the verified pieces of the data at path to peers until interrupted,
+// announcing to the torrent's trackers so that downloaders can find us.
+func handleSeed(port int, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: seed [-port <port>] <torrent-file> <path>")
+	}
+
+	torrentPath := args[0]
+	dataPath := args[1]
+
+	info, err := loadTorrent(torrentPath)
+	if err != nil {
+		return err
+	}
+	_, infoHash, err := bencode.HashInfo(info)
+	if err != nil {
+		return fmt.Errorf("failed to encode info: %w", err)
+	}
+
+	files, err := storage.OpenFiles(&info.Info, dataPath, storage.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer files.Close()
+
+	result, err := storage.Verify(&info.Info, files, 0)
+	if err != nil {
+		return err
+	}
+	if result.Verified() == 0 {
+		return fmt.Errorf("no piece of %s matches the torrent", dataPath)
+	}
+	left := 0
+	for i, ok := range result.Pieces {
+		if ok {
+			files.MarkComplete(i)
+		} else {
+			left += min(info.Info.PieceLength, info.Info.TotalLength()-i*info.Info.PieceLength)
+		}
+	}
+
+	seeder, err := peering.Listen(fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+	defer seeder.Close()
+	seeder.Add(info, infoHash, files)
+
+	announcer := peering.NewAnnouncer(peering.NewTrackerManager(info.Trackers()), infoHash,
+		func() (int, int, int) { return int(seeder.Uploaded()), 0, left }, nil)
+	announcer.SetPort(seeder.Addr().(*net.TCPAddr).Port)
+	if _, err := announcer.Start(); err != nil {
+		zap.L().Warn("Failed to announce to trackers, retrying in the background", zap.Error(err))
+	}
+	defer announcer.Stop()
+
+	fmt.Printf("Seeding %s on %s, %d/%d pieces\n", info.Info.Name, seeder.Addr(), result.Verified(), len(result.Pieces))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		seeder.Close()
+	}()
+
+	return seeder.Serve()
+}
@@ -0,0 +1,219 @@
+package peering
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultPort is the port announced to trackers unless another is set.
+	DefaultPort = 6881
+	// defaultAnnounceInterval is used when a tracker does not specify an interval.
+	defaultAnnounceInterval = 30 * time.Minute
+	// announceRetryInterval is how long to wait after every tracker failed to answer.
+	announceRetryInterval = time.Minute
+	// stopAnnounceTimeout bounds how long Stop waits for the stopped event to be delivered.
+	stopAnnounceTimeout = 5 * time.Second
+)
+
+// TransferStats reports the totals sent to trackers with every announce.
+type TransferStats func() (uploaded, downloaded, left int)
+
+// Announcer keeps a torrent registered with its trackers for the lifetime of a download.
+// It sends the started event, re-announces on the interval the tracker asks for
+// (never more often than its min interval), sends completed once the download finishes
+// and stopped on shutdown, echoing any tracker id the tracker handed out.
+type Announcer struct {
+	trackers *TrackerManager
+	infoHash []byte
+	port     int
+	stats    TransferStats
+	onPeers  func([]Peer)
+
+	mu        sync.Mutex
+	trackerID string
+	started   bool
+
+	completeOnce sync.Once
+	stopOnce     sync.Once
+	completed    chan struct{}
+	stop         chan struct{}
+	done         chan struct{}
+}
+
+// NewAnnouncer creates an announcer for infoHash. stats is consulted for the
+// transfer totals of every announce, and onPeers receives the peers returned by
+// announces made after Start.
+func NewAnnouncer(trackers *TrackerManager, infoHash []byte, stats TransferStats, onPeers func([]Peer)) *Announcer {
+	return &Announcer{
+		trackers:  trackers,
+		infoHash:  infoHash,
+		port:      DefaultPort,
+		stats:     stats,
+		onPeers:   onPeers,
+		completed: make(chan struct{}),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// SetPort sets the port peers are told to connect to, DefaultPort unless changed.
+// It must be called before Start.
+func (a *Announcer) SetPort(port int) {
+	a.port = port
+}
+
+// Start sends the started event and returns the peers from the tracker's response.
+// Announces continue in the background until Stop is called: periodic ones on success,
+// and on failure the started event is retried every announceRetryInterval, with the
+// peers of the eventual response going to onPeers.
+func (a *Announcer) Start() ([]Peer, error) {
+	resp, err := a.announce(EventStarted)
+	a.mu.Lock()
+	a.started = true
+	a.mu.Unlock()
+	if err != nil {
+		go a.run(announceRetryInterval, false)
+		return nil, err
+	}
+
+	go a.run(nextAnnounce(resp), true)
+	return resp.Peers, nil
+}
+
+// Completed sends the completed event. Only the first call has any effect.
+func (a *Announcer) Completed() {
+	a.completeOnce.Do(func() {
+		close(a.completed)
+	})
+}
+
+// Stop ends periodic announces and sends the stopped event, waiting a bounded
+// amount of time for it to be delivered.
+func (a *Announcer) Stop() {
+	a.mu.Lock()
+	started := a.started
+	a.mu.Unlock()
+	if !started {
+		return
+	}
+	a.stopOnce.Do(func() {
+		close(a.stop)
+	})
+
+	select {
+	case <-a.done:
+	case <-time.After(stopAnnounceTimeout):
+		zap.L().Debug("Timed out sending stopped event to tracker")
+	}
+}
+
+// run sends the announces that follow Start, the first after wait. Until registered,
+// that is until a started event got through, it keeps retrying the started event, and
+// there is nothing to send completed or stopped about.
+func (a *Announcer) run(wait time.Duration, registered bool) {
+	defer close(a.done)
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	completed := a.completed
+	for {
+		select {
+		case <-timer.C:
+			event := EventNone
+			if !registered {
+				event = EventStarted
+			}
+			resp, err := a.announce(event)
+			if err != nil {
+				timer.Reset(announceRetryInterval)
+				continue
+			}
+			registered = true
+			a.deliverPeers(resp)
+			timer.Reset(nextAnnounce(resp))
+
+		case <-completed:
+			completed = nil
+			if !registered {
+				// The started event, once it gets through, reports nothing left.
+				continue
+			}
+			if resp, err := a.announce(EventCompleted); err == nil {
+				a.deliverPeers(resp)
+			}
+
+		case <-a.stop:
+			if !registered {
+				return
+			}
+			// A download that finished just before shutdown still reports completion.
+			select {
+			case <-completed:
+				a.announce(EventCompleted)
+			default:
+			}
+			a.announce(EventStopped)
+			return
+		}
+	}
+}
+
+// announce sends one announce carrying event and the current transfer totals.
+func (a *Announcer) announce(event string) (*TrackerResponse, error) {
+	uploaded, downloaded, left := a.stats()
+	a.mu.Lock()
+	trackerID := a.trackerID
+	a.mu.Unlock()
+	req := &TrackerRequest{
+		InfoHash:   a.infoHash,
+		PeerID:     peerID,
+		Port:       a.port,
+		Uploaded:   uploaded,
+		Downloaded: downloaded,
+		Left:       left,
+		Compact:    1,
+		Event:      event,
+		TrackerID:  trackerID,
+	}
+
+	resp, trackerURL, err := a.trackers.Announce(req)
+	if err != nil {
+		zap.L().Warn("Tracker announce failed", zap.String("event", event), zap.Error(err))
+		return nil, err
+	}
+
+	if resp.TrackerID != "" {
+		a.mu.Lock()
+		a.trackerID = resp.TrackerID
+		a.mu.Unlock()
+	}
+
+	zap.L().Debug("Announced to tracker",
+		zap.String("tracker", trackerURL),
+		zap.String("event", event),
+		zap.Int("interval", resp.Interval))
+	return resp, nil
+}
+
+func (a *Announcer) deliverPeers(resp *TrackerResponse) {
+	if a.onPeers == nil || len(resp.Peers) == 0 {
+		return
+	}
+	a.onPeers(resp.Peers)
+}
+
+// nextAnnounce returns how long to wait before the next regular announce.
+func nextAnnounce(resp *TrackerResponse) time.Duration {
+	interval := defaultAnnounceInterval
+	if resp.Interval > 0 {
+		interval = time.Duration(resp.Interval) * time.Second
+	}
+	if minInterval := time.Duration(resp.MinInterval) * time.Second; interval < minInterval {
+		interval = minInterval
+	}
+	return interval
+}
@@ -0,0 +1,176 @@
+package peering
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
+)
+
+// fakeHTTPTracker is a stand-in HTTP tracker that records the query of every announce
+// and answers with what respond returns for it.
+type fakeHTTPTracker struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []url.Values
+	respond  func(n int, query url.Values) map[string]any
+}
+
+func newFakeHTTPTracker(t *testing.T, respond func(n int, query url.Values) map[string]any) *fakeHTTPTracker {
+	t.Helper()
+	f := &fakeHTTPTracker{respond: respond}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		n := len(f.requests)
+		f.requests = append(f.requests, r.URL.Query())
+		f.mu.Unlock()
+
+		body, err := bencode.Marshal(f.respond(n, r.URL.Query()))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(body)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeHTTPTracker) announceURL() string {
+	return f.URL + "/announce"
+}
+
+func (f *fakeHTTPTracker) queries() []url.Values {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]url.Values(nil), f.requests...)
+}
+
+func (f *fakeHTTPTracker) events() []string {
+	var events []string
+	for _, q := range f.queries() {
+		events = append(events, q.Get("event"))
+	}
+	return events
+}
+
+func testAnnouncer(trackers ...string) *Announcer {
+	stats := func() (int, int, int) { return 10, 20, 30 }
+	return NewAnnouncer(NewTrackerManager([][]string{trackers}), []byte("01234567890123456789"), stats, nil)
+}
+
+func TestAnnouncerLifecycle(t *testing.T) {
+	tracker := newFakeHTTPTracker(t, func(n int, _ url.Values) map[string]any {
+		resp := map[string]any{"interval": 1800, "peers": "\x0a\x00\x00\x01\x1a\xe1"}
+		if n == 0 {
+			resp["tracker id"] = "abc"
+		}
+		return resp
+	})
+	a := testAnnouncer(tracker.announceURL())
+	a.SetPort(51413)
+
+	peers, err := a.Start()
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if len(peers) != 1 || peers[0].Addr() != "10.0.0.1:6881" {
+		t.Errorf("Start returned peers %v", peers)
+	}
+	a.Completed()
+	a.Completed()
+	a.Stop()
+	a.Stop()
+
+	queries := tracker.queries()
+	if events := tracker.events(); len(events) != 3 || events[0] != EventStarted || events[1] != EventCompleted || events[2] != EventStopped {
+		t.Fatalf("tracker got events %q, want started, completed, stopped", events)
+	}
+	first := queries[0]
+	if first.Get("port") != "51413" || first.Get("uploaded") != "10" || first.Get("downloaded") != "20" || first.Get("left") != "30" {
+		t.Errorf("started announce has query %v", first)
+	}
+	if first.Has("trackerid") {
+		t.Error("started announce sent a tracker id before the tracker gave one")
+	}
+	// The tracker id of the first response is echoed from then on.
+	for _, q := range queries[1:] {
+		if q.Get("trackerid") != "abc" {
+			t.Errorf("%s announce sent trackerid %q, want abc", q.Get("event"), q.Get("trackerid"))
+		}
+	}
+}
+
+func TestAnnouncerStopWithoutCompleted(t *testing.T) {
+	tracker := newFakeHTTPTracker(t, func(int, url.Values) map[string]any {
+		return map[string]any{"interval": 1800, "peers": ""}
+	})
+	a := testAnnouncer(tracker.announceURL())
+	if _, err := a.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	a.Stop()
+	if events := tracker.events(); len(events) != 2 || events[1] != EventStopped {
+		t.Errorf("tracker got events %q, want started, stopped", events)
+	}
+}
+
+func TestAnnouncerFailedStart(t *testing.T) {
+	tracker := newFakeHTTPTracker(t, func(int, url.Values) map[string]any {
+		return map[string]any{"failure reason": "unregistered torrent"}
+	})
+	a := testAnnouncer(tracker.announceURL())
+	if _, err := a.Start(); err == nil {
+		t.Fatal("Start succeeded against a tracker that refused the announce")
+	}
+	// Nothing was registered, so there is no completed or stopped to report.
+	a.Completed()
+	a.Stop()
+	if events := tracker.events(); len(events) != 1 || events[0] != EventStarted {
+		t.Errorf("tracker got events %q, want only started", events)
+	}
+}
+
+func TestAnnouncerStopBeforeStart(t *testing.T) {
+	tracker := newFakeHTTPTracker(t, func(int, url.Values) map[string]any {
+		return map[string]any{}
+	})
+	a := testAnnouncer(tracker.announceURL())
+	done := make(chan struct{})
+	go func() {
+		a.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Stop blocked on an announcer that was never started")
+	}
+	if len(tracker.queries()) != 0 {
+		t.Error("Stop announced without Start")
+	}
+}
+
+func TestNextAnnounce(t *testing.T) {
+	tests := []struct {
+		interval, minInterval int
+		want                  time.Duration
+	}{
+		{1800, 0, 30 * time.Minute},
+		{0, 0, defaultAnnounceInterval},
+		{60, 300, 5 * time.Minute},   // never more often than min interval
+		{600, 300, 10 * time.Minute}, // min interval only bounds from below
+		{0, 3600, time.Hour},
+	}
+	for _, tt := range tests {
+		resp := &TrackerResponse{Interval: tt.interval, MinInterval: tt.minInterval}
+		if got := nextAnnounce(resp); got != tt.want {
+			t.Errorf("nextAnnounce(interval %d, min interval %d) = %v, want %v", tt.interval, tt.minInterval, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package peering
+
+import (
+	"cmp"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// rechokeInterval is how often upload slots are reassigned by measured rate.
+	rechokeInterval = 10 * time.Second
+	// optimisticInterval is how often the optimistic unchoke moves to another peer.
+	optimisticInterval = 30 * time.Second
+	// snubTimeout is how long a peer that has unchoked us may leave our requests
+	// unanswered before it loses its upload slot.
+	snubTimeout = time.Minute
+	// newPeerWeight is how much likelier a newly connected peer is to be picked for
+	// the optimistic unchoke, so that it gets a chance to show what it can send.
+	newPeerWeight = 3
+
+	// DefaultUploadSlots is the number of peers unchoked at a time, one of them optimistically.
+	DefaultUploadSlots = 4
+)
+
+// ChokePeer is what a Choker knows about a connected peer when it reassigns upload slots.
+type ChokePeer struct {
+	// Addr identifies the peer from one round to the next.
+	Addr        string
+	Interested  bool
+	ConnectedAt time.Time
+	// DownloadRate and UploadRate are the bytes per second received from and sent to
+	// the peer over the last round.
+	DownloadRate float64
+	UploadRate   float64
+	// Snubbed reports that the peer has unchoked us but stopped answering our requests.
+	Snubbed bool
+}
+
+// Choker decides which peers we upload to. It is asked every rechokeInterval, and
+// whenever a peer's interest changes, and is never called concurrently.
+type Choker interface {
+	// Rechoke returns whether to unchoke each of peers. seeding reports that we
+	// only upload, so peers cannot be ranked by what they send us.
+	Rechoke(peers []ChokePeer, seeding bool, now time.Time) []bool
+}
+
+// TitForTatChoker is the choking algorithm of BEP 3 and the mainline client. All but
+// one of its slots go to the interested peers that upload to us fastest, or that we
+// upload to fastest when seeding, and peers that snub us are left out. The last slot
+// is an optimistic unchoke that moves to a random other interested peer every
+// optimisticInterval, favouring newly connected peers, so that peers we have no rate
+// for yet can earn a regular slot.
+type TitForTatChoker struct {
+	Slots int
+
+	optimistic   string
+	optimisticAt time.Time
+}
+
+// NewTitForTatChoker returns a choker that unchokes slots peers at a time.
+func NewTitForTatChoker(slots int) *TitForTatChoker {
+	return &TitForTatChoker{Slots: slots}
+}
+
+func (c *TitForTatChoker) Rechoke(peers []ChokePeer, seeding bool, now time.Time) []bool {
+	unchoke := make([]bool, len(peers))
+	rate := func(p ChokePeer) float64 {
+		if seeding {
+			return p.UploadRate
+		}
+		return p.DownloadRate
+	}
+
+	var candidates []int
+	for i, p := range peers {
+		if p.Interested && !p.Snubbed {
+			candidates = append(candidates, i)
+		}
+	}
+	slices.SortStableFunc(candidates, func(a, b int) int {
+		return cmp.Compare(rate(peers[b]), rate(peers[a]))
+	})
+	for _, i := range candidates[:min(len(candidates), max(c.Slots-1, 0))] {
+		unchoke[i] = true
+	}
+	if c.Slots <= 0 {
+		return unchoke
+	}
+
+	current := -1
+	for i, p := range peers {
+		if p.Addr == c.optimistic {
+			current = i
+		}
+	}
+	if current < 0 || unchoke[current] || !peers[current].Interested || now.Sub(c.optimisticAt) >= optimisticInterval {
+		current = pickOptimistic(peers, unchoke, now)
+		c.optimistic = ""
+		if current >= 0 {
+			c.optimistic = peers[current].Addr
+		}
+		c.optimisticAt = now
+	}
+	if current >= 0 {
+		unchoke[current] = true
+	}
+	return unchoke
+}
+
+// pickOptimistic picks a random interested peer without a regular slot, snubbed or not,
+// weighting peers connected within the last optimisticInterval by newPeerWeight.
+// Returns -1 if there is none.
+func pickOptimistic(peers []ChokePeer, unchoke []bool, now time.Time) int {
+	picked, total := -1, 0
+	for i, p := range peers {
+		if !p.Interested || unchoke[i] {
+			continue
+		}
+		weight := 1
+		if now.Sub(p.ConnectedAt) < optimisticInterval {
+			weight = newPeerWeight
+		}
+		total += weight
+		if rand.IntN(total) < weight {
+			picked = i
+		}
+	}
+	return picked
+}
+
+// chokeGroup shares upload slots among the uploaders of a set of connections, asking
+// its choker to reassign them every rechokeInterval.
+type chokeGroup struct {
+	choker  Choker
+	seeding bool
+
+	mu        sync.Mutex
+	members   map[*uploader]*chokeRates
+	lastRound time.Time
+}
+
+// chokeRates are the counters of an uploader at the last round and the rates since the one before.
+type chokeRates struct {
+	uploaded     int64
+	downloaded   int64
+	uploadRate   float64
+	downloadRate float64
+}
+
+func newChokeGroup(choker Choker, seeding bool) *chokeGroup {
+	return &chokeGroup{
+		choker:    choker,
+		seeding:   seeding,
+		members:   make(map[*uploader]*chokeRates),
+		lastRound: time.Now(),
+	}
+}
+
+// add puts u under the group's control. It starts out choked.
+func (g *chokeGroup) add(u *uploader) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	u.group = g
+	g.members[u] = &chokeRates{}
+}
+
+// remove releases u's upload slot, if it had one, to the other members.
+func (g *chokeGroup) remove(u *uploader) {
+	g.mu.Lock()
+	delete(g.members, u)
+	g.mu.Unlock()
+	g.rechoke(false)
+}
+
+// run rechokes every rechokeInterval until stop is closed.
+func (g *chokeGroup) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(rechokeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			g.rechoke(true)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// rechoke asks the choker for new choking decisions and passes them to the members.
+// With measure set it starts a new round, updating the rates from the members' counters;
+// otherwise the rates of the last round are reused.
+func (g *chokeGroup) rechoke(measure bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(g.lastRound).Seconds()
+	if measure {
+		g.lastRound = now
+	}
+
+	members := make([]*uploader, 0, len(g.members))
+	peers := make([]ChokePeer, 0, len(g.members))
+	for u, rates := range g.members {
+		if measure && elapsed > 0 {
+			uploaded, downloaded := u.uploaded.Load(), u.downloaded.Load()
+			rates.uploadRate = float64(uploaded-rates.uploaded) / elapsed
+			rates.downloadRate = float64(downloaded-rates.downloaded) / elapsed
+			rates.uploaded, rates.downloaded = uploaded, downloaded
+		}
+		members = append(members, u)
+		peers = append(peers, ChokePeer{
+			Addr:         u.addr,
+			Interested:   u.interested.Load(),
+			ConnectedAt:  u.connectedAt,
+			DownloadRate: rates.downloadRate,
+			UploadRate:   rates.uploadRate,
+			Snubbed:      u.snubbed.Load(),
+		})
+	}
+
+	unchoke := g.choker.Rechoke(peers, g.seeding, now)
+	for i, u := range members {
+		u.setChoking(!unchoke[i])
+	}
+}
@@ -0,0 +1,186 @@
+package peering
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTitForTatChokerRechoke(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	old := now.Add(-time.Hour)
+	peer := func(addr string, down, up float64) ChokePeer {
+		return ChokePeer{Addr: addr, Interested: true, ConnectedAt: old, DownloadRate: down, UploadRate: up}
+	}
+	uninterested := peer("idle", 900, 900)
+	uninterested.Interested = false
+	snubbed := peer("snub", 1000, 1000)
+	snubbed.Snubbed = true
+
+	// a to f send to us ever slower, while we send to them ever faster.
+	six := []ChokePeer{peer("a", 60, 1), peer("b", 50, 2), peer("c", 40, 3), peer("d", 30, 4), peer("e", 20, 5), peer("f", 10, 6)}
+
+	tests := []struct {
+		name       string
+		slots      int
+		seeding    bool
+		peers      []ChokePeer
+		regular    []string // peers that must be unchoked
+		optimistic []string // peers one of which gets the optimistic unchoke
+	}{
+		{
+			name:       "fastest uploaders to us while leeching",
+			slots:      4,
+			peers:      six,
+			regular:    []string{"a", "b", "c"},
+			optimistic: []string{"d", "e", "f"},
+		},
+		{
+			name:       "fastest downloaders from us while seeding",
+			slots:      4,
+			seeding:    true,
+			peers:      six,
+			regular:    []string{"f", "e", "d"},
+			optimistic: []string{"a", "b", "c"},
+		},
+		{
+			name:       "slot count",
+			slots:      2,
+			peers:      six,
+			regular:    []string{"a"},
+			optimistic: []string{"b", "c", "d", "e", "f"},
+		},
+		{
+			name:    "fewer peers than slots",
+			slots:   4,
+			peers:   six[:2],
+			regular: []string{"a", "b"},
+		},
+		{
+			name:       "snubbed peers get no regular slot",
+			slots:      3,
+			peers:      []ChokePeer{snubbed, six[3], six[4], six[5]},
+			regular:    []string{"d", "e"},
+			optimistic: []string{"snub", "f"},
+		},
+		{
+			name:    "uninterested peers stay choked",
+			slots:   4,
+			peers:   []ChokePeer{uninterested, six[0]},
+			regular: []string{"a"},
+		},
+		{
+			name:       "only the optimistic slot",
+			slots:      1,
+			peers:      six[:3],
+			optimistic: []string{"a", "b", "c"},
+		},
+		{
+			name:  "no slots",
+			slots: 0,
+			peers: six,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unchoke := NewTitForTatChoker(tt.slots).Rechoke(tt.peers, tt.seeding, now)
+			if len(unchoke) != len(tt.peers) {
+				t.Fatalf("Rechoke returned %d decisions for %d peers", len(unchoke), len(tt.peers))
+			}
+			var unchoked, optimistic []string
+			for i, p := range tt.peers {
+				if !unchoke[i] {
+					continue
+				}
+				unchoked = append(unchoked, p.Addr)
+				if !slices.Contains(tt.regular, p.Addr) {
+					optimistic = append(optimistic, p.Addr)
+				}
+			}
+			for _, addr := range tt.regular {
+				if !slices.Contains(unchoked, addr) {
+					t.Errorf("%s is choked, unchoked %v", addr, unchoked)
+				}
+			}
+			switch {
+			case len(tt.optimistic) == 0 && len(optimistic) > 0:
+				t.Errorf("unchoked %v besides %v", optimistic, tt.regular)
+			case len(tt.optimistic) > 0 && (len(optimistic) != 1 || !slices.Contains(tt.optimistic, optimistic[0])):
+				t.Errorf("optimistically unchoked %v, want one of %v", optimistic, tt.optimistic)
+			}
+		})
+	}
+}
+
+// optimisticPeer returns the one peer unchoked by a choker with a single slot.
+func optimisticPeer(t *testing.T, c *TitForTatChoker, peers []ChokePeer, now time.Time) string {
+	t.Helper()
+	var unchoked []string
+	for i, ok := range c.Rechoke(peers, false, now) {
+		if ok {
+			unchoked = append(unchoked, peers[i].Addr)
+		}
+	}
+	if len(unchoked) != 1 {
+		t.Fatalf("unchoked %v, want one peer", unchoked)
+	}
+	return unchoked[0]
+}
+
+func TestTitForTatChokerOptimisticRotation(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	var peers []ChokePeer
+	for _, addr := range []string{"a", "b", "c", "d"} {
+		peers = append(peers, ChokePeer{Addr: addr, Interested: true, ConnectedAt: start.Add(-time.Hour)})
+	}
+
+	c := NewTitForTatChoker(1)
+	current := optimisticPeer(t, c, peers, start)
+	// Rechokes within optimisticInterval keep the optimistic unchoke where it is.
+	for _, after := range []time.Duration{rechokeInterval, 2 * rechokeInterval, optimisticInterval - time.Second} {
+		if got := optimisticPeer(t, c, peers, start.Add(after)); got != current {
+			t.Fatalf("optimistic unchoke moved from %s to %s after %v", current, got, after)
+		}
+	}
+
+	// It may land on the same peer again when it moves, but not every time.
+	now, moved := start, false
+	for range 20 {
+		now = now.Add(optimisticInterval)
+		got := optimisticPeer(t, c, peers, now)
+		moved = moved || got != current
+		current = got
+	}
+	if !moved {
+		t.Error("optimistic unchoke never moved")
+	}
+
+	// A peer that loses interest loses the optimistic unchoke at once.
+	for i := range peers {
+		if peers[i].Addr == current {
+			peers[i].Interested = false
+		}
+	}
+	if got := optimisticPeer(t, c, peers, now.Add(time.Second)); got == current {
+		t.Errorf("optimistic unchoke stayed with uninterested %s", current)
+	}
+}
+
+func TestTitForTatChokerOptimisticFavorsNewPeers(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	peers := []ChokePeer{
+		{Addr: "old1", Interested: true, ConnectedAt: now.Add(-time.Hour)},
+		{Addr: "old2", Interested: true, ConnectedAt: now.Add(-optimisticInterval)},
+		{Addr: "new", Interested: true, ConnectedAt: now.Add(-time.Second)},
+	}
+
+	// With weights 1, 1 and newPeerWeight, the new peer is picked 3 times in 5.
+	const rounds = 3000
+	counts := map[string]int{}
+	for range rounds {
+		counts[optimisticPeer(t, NewTitForTatChoker(1), peers, now)]++
+	}
+	if counts["new"] < rounds/2 || counts["old1"] < rounds/10 || counts["old2"] < rounds/10 {
+		t.Errorf("optimistic unchokes over %d rounds: %v", rounds, counts)
+	}
+}
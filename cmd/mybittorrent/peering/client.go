@@ -3,49 +3,211 @@ package peering
 import (
 	"bytes"
 	"crypto/sha1"
-	"encoding/binary"
+	"errors"
 	"fmt"
-	"io"
 	"net"
-	"net/http"
-	"net/url"
-	"strconv"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/storage"
+	"go.uber.org/zap"
+)
+
+const (
+	// minPeerBackoff is how long to wait before reconnecting to a peer after its first failure.
+	minPeerBackoff = 5 * time.Second
+	// maxPeerBackoff caps the wait before reconnecting to a peer that keeps failing.
+	maxPeerBackoff = 5 * time.Minute
 )
 
 // Client represents a BitTorrent client that manages peer connections and downloads.
 type Client struct {
-	info     *bencode.TorrentInfo
-	peers    []Peer
-	infoHash []byte
+	// MinRequests and MaxRequests bound the number of block requests kept in flight
+	// to each peer. Within those bounds the number follows the peer's measured rate.
+	MinRequests int
+	MaxRequests int
+	// RequestQueueTime is how much transfer time at a peer's measured rate to keep requested.
+	RequestQueueTime time.Duration
+	// RequestTimeout is how long a block request may go unanswered before it is cancelled.
+	RequestTimeout time.Duration
+	// StallTimeout is how long a download may go without a verified piece before it fails.
+	StallTimeout time.Duration
+	// Choker assigns upload slots among the peers of a download, ranking them by how
+	// fast they upload to us.
+	Choker Choker
+
+	info      *bencode.TorrentInfo
+	infoHash  []byte
+	metadata  []byte // the info dictionary served to peers with ut_metadata, or nil
+	announcer *Announcer
+	seeder    *Seeder // accepts the peers the trackers send our way, nil if we could not listen
+
+	peersMu sync.Mutex
+	peers   []Peer
+
+	closing   chan struct{}
+	closeOnce sync.Once
+
+	uploaded   atomic.Int64 // bytes sent to peers
+	downloaded atomic.Int64 // bytes received from peers, including discarded data
+	verified   atomic.Int64 // bytes of pieces that passed their hash check
+	wasted     atomic.Int64 // bytes received that were not needed, such as endgame duplicates
+}
+
+// Stats is a snapshot of a client's transfer counters, in bytes.
+type Stats struct {
+	Uploaded   int64
+	Downloaded int64
+	Verified   int64
+	// Wasted counts received blocks that were discarded, mostly duplicates
+	// from requesting the same block from several peers in endgame.
+	Wasted int64
 }
 
 // NewClient creates a new BitTorrent client with the given torrent info.
-// It initializes the client by fetching peers and calculating the info hash.
+// It calculates the info hash and announces the started event to the torrent's
+// trackers, which keep being re-announced to until Close is called.
 // Returns an error if peer discovery or info hash calculation fails.
 func NewClient(info *bencode.TorrentInfo) (*Client, error) {
-	peers, err := GetPeers(info)
+	return newClient(info, nil)
+}
+
+// newClient creates a client that starts out knowing peers in addition to the ones
+// the trackers return, so that it can do without the trackers when peers is not empty.
+func newClient(info *bencode.TorrentInfo, peers []Peer) (*Client, error) {
+	_, infoHash, err := bencode.HashInfo(info)
 	if err != nil {
 		return nil, err
 	}
 
-	_, infoHash, err := bencode.HashInfo(info)
+	c := &Client{
+		MinRequests:      4,
+		MaxRequests:      256,
+		RequestQueueTime: 3 * time.Second,
+		RequestTimeout:   20 * time.Second,
+		StallTimeout:     2 * time.Minute,
+		Choker:           NewTitForTatChoker(DefaultUploadSlots),
+		info:             info,
+		infoHash:         infoHash,
+		metadata:         infoMetadata(info, infoHash),
+		closing:          make(chan struct{}),
+	}
+	c.announcer = NewAnnouncer(NewTrackerManager(info.Trackers()), infoHash, c.transferStats, c.addPeers)
+	c.seeder = listenForPeers()
+	if c.seeder != nil {
+		// The port stays open for as long as it is announced, until Close.
+		c.announcer.SetPort(c.listenPort())
+		go c.seeder.Serve()
+	}
+
+	announced, err := c.announcer.Start()
 	if err != nil {
-		return nil, err
+		if len(peers) == 0 {
+			c.Close()
+			return nil, err
+		}
+		zap.L().Warn("Failed to announce to trackers", zap.Error(err))
+	}
+	c.addPeers(peers)
+	c.addPeers(announced)
+	if len(c.knownPeers()) == 0 {
+		c.Close()
+		return nil, fmt.Errorf("no peers available")
 	}
 
-	return &Client{
-		info:     info,
-		peers:    peers,
-		infoHash: infoHash,
-	}, nil
+	return c, nil
 }
 
-// GetPeers fetches a list of peers from the tracker for the given torrent info.
-// It sends a tracker request with the required parameters and parses the response.
+// ErrClosed is returned by a download that was interrupted because the client was closed.
+var ErrClosed = errors.New("client closed")
+
+// Close interrupts any download in progress, sends the stopped event to the trackers
+// and ends periodic announces. It is safe to call more than once.
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() { close(c.closing) })
+	c.announcer.Stop()
+	if c.seeder != nil {
+		c.seeder.Close()
+	}
+	return nil
+}
+
+// listenForPeers listens for incoming peers on DefaultPort, or on any free port if it
+// is taken. Returns nil if neither works, in which case we can only connect out.
+// Peers that connect join the download in progress, and are turned away between downloads.
+func listenForPeers() *Seeder {
+	seeder, err := Listen(fmt.Sprintf(":%d", DefaultPort))
+	if err != nil {
+		seeder, err = Listen(":0")
+	}
+	if err != nil {
+		zap.L().Warn("Failed to listen for incoming peers", zap.Error(err))
+		return nil
+	}
+	return seeder
+}
+
+// listenPort returns the port peers can connect to us on, or 0 if we do not listen.
+func (c *Client) listenPort() int {
+	if c.seeder == nil {
+		return 0
+	}
+	return c.seeder.Addr().(*net.TCPAddr).Port
+}
+
+// Info returns the torrent the client downloads.
+func (c *Client) Info() *bencode.TorrentInfo {
+	return c.info
+}
+
+// Stats returns the client's transfer counters.
+func (c *Client) Stats() Stats {
+	return Stats{
+		Uploaded:   c.uploaded.Load(),
+		Downloaded: c.downloaded.Load(),
+		Verified:   c.verified.Load(),
+		Wasted:     c.wasted.Load(),
+	}
+}
+
+// transferStats reports the totals announced to trackers.
+func (c *Client) transferStats() (uploaded, downloaded, left int) {
+	left = c.info.Info.TotalLength() - int(c.verified.Load())
+	uploaded = int(c.uploaded.Load())
+	if c.seeder != nil {
+		uploaded += int(c.seeder.Uploaded())
+	}
+	return uploaded, int(c.downloaded.Load()), left
+}
+
+// addPeers records peers learned from later announces, skipping ones already known.
+func (c *Client) addPeers(peers []Peer) {
+	c.peersMu.Lock()
+	defer c.peersMu.Unlock()
+
+	for _, peer := range peers {
+		known := slices.ContainsFunc(c.peers, func(p Peer) bool {
+			return p.IP.Equal(peer.IP) && p.Port == peer.Port
+		})
+		if !known {
+			c.peers = append(c.peers, peer)
+		}
+	}
+}
+
+// knownPeers returns a snapshot of the peers discovered so far.
+func (c *Client) knownPeers() []Peer {
+	c.peersMu.Lock()
+	defer c.peersMu.Unlock()
+	return slices.Clone(c.peers)
+}
+
+// GetPeers fetches a list of peers from the torrent's trackers.
+// It announces to the tiers of announce-list in BEP 12 order, falling back to
+// the announce URL, and parses the first successful response.
 // Returns a list of peers or an error if the tracker request fails.
 func GetPeers(info *bencode.TorrentInfo) ([]Peer, error) {
 	_, infoHash, err := bencode.HashInfo(info)
@@ -59,244 +221,290 @@ func GetPeers(info *bencode.TorrentInfo) ([]Peer, error) {
 		Port:       6881,
 		Uploaded:   0,
 		Downloaded: 0,
-		Left:       info.Info.Length,
+		Left:       info.Info.TotalLength(),
 		Compact:    1,
 	}
 
-	trackerURL := fmt.Sprintf("%s?%s",
-		info.Announce,
-		url.Values{
-			"info_hash":  []string{string(trackerReq.InfoHash)},
-			"peer_id":    []string{trackerReq.PeerID},
-			"port":       []string{strconv.Itoa(trackerReq.Port)},
-			"uploaded":   []string{strconv.Itoa(trackerReq.Uploaded)},
-			"downloaded": []string{strconv.Itoa(trackerReq.Downloaded)},
-			"left":       []string{strconv.Itoa(trackerReq.Left)},
-			"compact":    []string{strconv.Itoa(trackerReq.Compact)},
-		}.Encode())
-
-	resp, err := http.Get(trackerURL)
+	trackerResp, _, err := NewTrackerManager(info.Trackers()).Announce(trackerReq)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get tracker response: %v", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %v", err)
+	if len(trackerResp.Peers) == 0 {
+		return nil, fmt.Errorf("no peers available")
 	}
 
-	decoded, _, err := bencode.Decode[map[string]any](string(body))
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode tracker response: %v", err)
+	return trackerResp.Peers, nil
+}
+
+// DownloadPiece downloads a specific piece from available peers.
+// It opens a session to every peer and takes the piece from whichever peer that has it
+// delivers it first, retrying with the others if one fails.
+// Returns the piece data or an error if no peer delivers it within StallTimeout.
+func (c *Client) DownloadPiece(pieceIndex int) ([]byte, error) {
+	totalPieces := len(c.info.Info.Pieces) / 20
+	if pieceIndex < 0 || pieceIndex >= totalPieces {
+		return nil, fmt.Errorf("piece index %d out of range, torrent has %d pieces", pieceIndex, totalPieces)
 	}
 
-	peersData, ok := decoded["peers"].(string)
-	if !ok {
-		return nil, fmt.Errorf("invalid peers data type in tracker response: got %T, want string", decoded["peers"])
+	picker := NewRarestFirstPicker(totalPieces)
+	for i := range totalPieces {
+		if i != pieceIndex {
+			picker.Done(i)
+		}
 	}
 
-	peers, err := ParsePeers(peersData)
+	var data []byte
+	err := c.download(picker, nil, 1, func(_ int, piece []byte) error {
+		data = piece
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse peers: %v", err)
-	}
-	if len(peers) == 0 {
-		return nil, fmt.Errorf("no peers available")
+		return nil, fmt.Errorf("failed to download piece %d: %w", pieceIndex, err)
 	}
+	return data, nil
+}
 
-	return peers, nil
+// DownloadAll downloads all pieces of the torrent and stores them under outputPath in
+// fully allocated files. See DownloadTo for how the download proceeds.
+//
+// Single-file torrents are written to outputPath; multi-file torrents are laid out in
+// a directory named after the torrent under outputPath.
+func (c *Client) DownloadAll(outputPath string) error {
+	return c.DownloadWith(storage.NewFileStorage(outputPath, storage.Options{}))
 }
 
-// DownloadPiece downloads a specific piece from available peers.
-// It attempts to download from each peer until successful, using a round-robin approach.
-// If a peer fails, it continues with the next peer until either success or all peers fail.
-// Returns the piece data or an error if all download attempts fail.
-func (c *Client) DownloadPiece(pieceIndex int) ([]byte, error) {
-	var lastErr error
-	for _, peer := range c.peers {
-		data, err := c.downloadPieceFromPeer(peer, pieceIndex)
-		if err != nil {
-			lastErr = err
-			continue
-		}
-		return data, nil
+// DownloadWith opens the torrent in store, downloads it there and closes it.
+func (c *Client) DownloadWith(store storage.Storage) error {
+	t, err := store.OpenTorrent(&c.info.Info, c.infoHash)
+	if err != nil {
+		return err
+	}
+	if err := c.DownloadTo(t); err != nil {
+		t.Close()
+		return err
 	}
-	return nil, fmt.Errorf("failed to download piece from any peer: %v", lastErr)
+	return t.Close()
 }
 
-// DownloadAll downloads all pieces of the torrent file concurrently.
-// It implements a worker pool pattern where:
-//   - Work is distributed among peers in a round-robin fashion
-//   - Multiple workers download pieces concurrently
-//   - Results are assembled in order and verified against piece hashes
-//
-// Returns the complete file data or an error if the download fails.
-func (c *Client) DownloadAll() ([]byte, error) {
+// DownloadTo downloads all pieces of the torrent concurrently into t, skipping the
+// pieces t already reports complete.
+// One session per peer stays connected, downloading the rarest pieces its peer has
+// until the download is done, and each piece is written out and marked complete as
+// soon as it passes its hash check. Pieces in t are uploaded to the peers the Choker
+// picks while the download runs, including the peers that connect to us.
+// Returns an error if the download stalls, a piece cannot be stored or the client is closed.
+func (c *Client) DownloadTo(t storage.Torrent) error {
 	totalPieces := len(c.info.Info.Pieces) / 20
-	results := make(chan pieceResult, totalPieces)
-
-	workChan := c.distributePieceWork(totalPieces)
-	c.startWorkers(workChan, results)
+	picker := NewRarestFirstPicker(totalPieces)
+	want := totalPieces
+	for i := range totalPieces {
+		if t.Completed(i) {
+			picker.Done(i)
+			c.verified.Add(int64(c.getPieceLength(i)))
+			want--
+		}
+	}
 
-	return c.assembleFile(results, totalPieces)
-}
+	if want > 0 {
+		err := c.download(picker, t, want, func(index int, data []byte) error {
+			if _, err := t.WriteAt(index, data, 0); err != nil {
+				return err
+			}
+			return t.MarkComplete(index)
+		})
+		if err != nil {
+			return err
+		}
+		// Only a download that finished in this session is reported as completed.
+		c.announcer.Completed()
+	}
 
-type pieceWork struct {
-	index int
-	peer  Peer
+	stats := c.Stats()
+	zap.L().Debug("Download complete",
+		zap.Int64("downloaded", stats.Downloaded),
+		zap.Int64("wasted", stats.Wasted))
+	return nil
 }
 
 type pieceResult struct {
 	index int
 	data  []byte
-	err   error
 }
 
-func (c *Client) downloadPieceFromPeer(peer Peer, pieceIndex int) ([]byte, error) {
-	peerAddr := fmt.Sprintf("%s:%d", peer.IP, peer.Port)
-
-	conn, err := net.DialTimeout("tcp", peerAddr, 3*time.Second)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to peer: %v", err)
-	}
-	defer conn.Close()
-
-	if _, err := PerformHandshake(conn, c.infoHash); err != nil {
-		return nil, err
-	}
-
-	var buffer bytes.Buffer
-	if err := c.exchangeMessages(conn, pieceIndex, &buffer); err != nil {
-		return nil, err
-	}
+// peerState is what the client remembers about a peer between sessions.
+type peerState struct {
+	connected bool
+	failures  int
+	retryAt   time.Time
+}
 
-	return buffer.Bytes(), nil
+// inboundPeer is a connection the seeder hands to a download. The seeder closes the
+// connection once the session reports on ended.
+type inboundPeer struct {
+	conn     net.Conn
+	extended bool
+	ended    chan<- error
 }
 
-func (c *Client) distributePieceWork(totalPieces int) <-chan pieceWork {
-	workChan := make(chan pieceWork, totalPieces)
-	for i := range totalPieces {
-		peerIndex := i % len(c.peers) // round-robin
-		workChan <- pieceWork{index: i, peer: c.peers[peerIndex]}
-	}
-	close(workChan)
-	return workChan
+type sessionEnd struct {
+	addr      string
+	delivered int
+	err       error
 }
 
-func (c *Client) startWorkers(workChan <-chan pieceWork, results chan<- pieceResult) {
-	var workers sync.WaitGroup
-	for range len(c.peers) {
-		workers.Add(1)
-		go func() {
-			defer workers.Done()
-			for work := range workChan {
-				data, err := c.downloadPieceFromPeer(work.peer, work.index)
-				results <- pieceResult{
-					index: work.index,
-					data:  data,
-					err:   err,
-				}
+// download runs a session per peer until want verified pieces have been passed to deliver.
+// A session that fails returns its unfinished pieces to the picker for other peers to take,
+// and its peer is retried after a backoff that doubles with each failure in a row,
+// counting from the last session that delivered a piece.
+// Peers learned from later announces are connected as they come in, and peers that
+// connect to us join the download the same way, except that they are not reconnected to.
+// When store is set, delivered pieces are announced to the peers and served from it.
+// Every session has ended by the time download returns.
+// Returns an error once StallTimeout passes without a verified piece, as soon as deliver
+// fails, or ErrClosed when the client is closed.
+func (c *Client) download(picker PiecePicker, store storage.Torrent, want int, deliver func(index int, data []byte) error) error {
+	results := make(chan pieceResult)
+	ended := make(chan sessionEnd)
+	done := make(chan struct{})
+	// Sessions read from store to upload, so they must be gone before the caller closes it.
+	var sessions sync.WaitGroup
+	defer sessions.Wait()
+	defer close(done)
+	t := newTransfer(c, picker, store, results, done)
+	go t.group.run(done)
+
+	inbound := make(chan inboundPeer)
+	if c.seeder != nil {
+		c.seeder.handOff(c.infoHash, func(conn net.Conn, extended bool) error {
+			ended := make(chan error, 1)
+			select {
+			case inbound <- inboundPeer{conn: conn, extended: extended, ended: ended}:
+				return <-ended
+			case <-done:
+				return ErrClosed
 			}
-		}()
+		})
+		defer c.seeder.Remove(c.infoHash)
 	}
 
-	go func() {
-		workers.Wait()
-		close(results)
-	}()
-}
-
-func (c *Client) assembleFile(results <-chan pieceResult, totalPieces int) ([]byte, error) {
-	totalLength := c.info.Info.Length
-	fileData := make([]byte, totalLength)
+	peers := make(map[string]*peerState)
+	connect := func() {
+		now := time.Now()
+		for _, peer := range c.knownPeers() {
+			addr := peer.Addr()
+			state, ok := peers[addr]
+			if !ok {
+				state = &peerState{}
+				peers[addr] = state
+			}
+			if state.connected || now.Before(state.retryAt) {
+				continue
+			}
 
-	for result := range results {
-		if result.err != nil {
-			return nil, fmt.Errorf("failed to download piece %d: %v", result.index, result.err)
+			state.connected = true
+			sessions.Add(1)
+			go func() {
+				defer sessions.Done()
+				delivered, err := c.runSession(t, peer)
+				select {
+				case ended <- sessionEnd{addr: addr, delivered: delivered, err: err}:
+				case <-done:
+				}
+			}()
 		}
-		copy(fileData[result.index*c.info.Info.PieceLength:], result.data)
 	}
-
-	// verify pieces
-	for pieceIndex := range totalPieces {
-		pieceHash := c.info.Info.Pieces[pieceIndex*20 : (pieceIndex+1)*20]
-		start := pieceIndex * c.info.Info.PieceLength
-		end := min(start+c.info.Info.PieceLength, totalLength)
-		actualHash := sha1.Sum(fileData[start:end])
-		if !bytes.Equal(actualHash[:], pieceHash) {
-			return nil, fmt.Errorf("hash mismatch for piece %d", pieceIndex)
+	connect()
+
+	retry := time.NewTicker(time.Second)
+	defer retry.Stop()
+	stall := time.NewTimer(c.StallTimeout)
+	defer stall.Stop()
+
+	for received := 0; received < want; {
+		select {
+		case result := <-results:
+			if err := deliver(result.index, result.data); err != nil {
+				return fmt.Errorf("failed to store piece %d: %w", result.index, err)
+			}
+			if store != nil {
+				t.stored(result.index)
+			}
+			received++
+			resetTimer(stall, c.StallTimeout)
+
+		case end := <-ended:
+			state := peers[end.addr]
+			state.connected = false
+			if end.delivered > 0 {
+				state.failures = 0
+			}
+			state.failures++
+			state.retryAt = time.Now().Add(peerBackoff(state.failures))
+			zap.L().Debug("Peer session ended",
+				zap.String("peer", end.addr),
+				zap.Int("failures", state.failures),
+				zap.Time("retry_at", state.retryAt),
+				zap.Error(end.err))
+
+		case in := <-inbound:
+			sessions.Add(1)
+			go func() {
+				defer sessions.Done()
+				session := acceptPeerSession(c, in.conn, in.extended, done)
+				defer session.Close()
+				err := session.run(t)
+				zap.L().Debug("Inbound peer session ended",
+					zap.String("peer", in.conn.RemoteAddr().String()),
+					zap.Int("delivered", session.delivered),
+					zap.Error(err))
+				in.ended <- err
+			}()
+
+		case <-retry.C:
+			connect()
+
+		case <-c.closing:
+			return ErrClosed
+
+		case <-stall.C:
+			return fmt.Errorf("no peer delivered a piece for %v, %d of %d pieces missing", c.StallTimeout, want-received, want)
 		}
 	}
-
-	return fileData, nil
+	return nil
 }
 
-func (c *Client) exchangeMessages(conn net.Conn, pieceIndex int, output io.Writer) error {
-	actualLength := c.getPieceLength(pieceIndex)
-	blocks := dividePiece(actualLength, 16384)
-
-	msg, err := readMessage(conn)
+// runSession connects to peer and downloads from it until the transfer is done or the session fails.
+// Returns the number of pieces the session delivered along with the reason it ended.
+func (c *Client) runSession(t *transfer, peer Peer) (int, error) {
+	session, err := newPeerSession(c, peer, t.done)
 	if err != nil {
-		return fmt.Errorf("failed to read bitfield: %v", err)
-	}
-	if msg.ID != 5 {
-		return fmt.Errorf("expected bitfield message, got %d", msg.ID)
+		return 0, err
 	}
+	defer session.Close()
+	err = session.run(t)
+	return session.delivered, err
+}
 
-	if err := sendMessage(conn, 2, nil); err != nil {
-		return fmt.Errorf("failed to send interested message: %v", err)
-	}
-
-	msg, err = readMessage(conn)
-	if err != nil {
-		return fmt.Errorf("failed to read unchoke message: %v", err)
-	}
-	if msg.ID != 1 {
-		return fmt.Errorf("expected unchoke message, got %d", msg.ID)
-	}
-
-	pieceData := make([]byte, actualLength)
-
-	for _, blk := range blocks {
-		err := sendMessage(conn, 6, encodeRequest(pieceIndex, blk.Begin, blk.Length))
-		if err != nil {
-			return fmt.Errorf("failed to send request message: %v", err)
-		}
-
-		msg, err := readMessage(conn)
-		if err != nil {
-			return fmt.Errorf("failed to read piece message: %v", err)
-		}
-		if msg.ID != 7 {
-			return fmt.Errorf("expected piece message, got %d", msg.ID)
-		}
-
-		if len(msg.Payload) < 8 {
-			return fmt.Errorf("invalid piece message payload size")
-		}
-		receivedIndex := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
-		begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
-		block := msg.Payload[8:]
-
-		if receivedIndex != pieceIndex {
-			return fmt.Errorf("received piece index %d does not match requested index %d", receivedIndex, pieceIndex)
-		}
-
-		copy(pieceData[begin:], block)
-	}
+// peerBackoff returns how long to wait before reconnecting to a peer after its nth consecutive failure.
+func peerBackoff(failures int) time.Duration {
+	backoff := minPeerBackoff << min(failures-1, 16)
+	return min(backoff, maxPeerBackoff)
+}
 
+// checkPiece reports whether data matches the piece's hash, counting it as verified if so.
+func (c *Client) checkPiece(pieceIndex int, data []byte) bool {
 	expectedHash := c.info.Info.Pieces[pieceIndex*20 : (pieceIndex+1)*20]
-	actualHash := sha1.Sum(pieceData)
+	actualHash := sha1.Sum(data)
 	if !bytes.Equal(actualHash[:], expectedHash) {
-		return fmt.Errorf("piece hash mismatch")
+		return false
 	}
-
-	_, err = output.Write(pieceData)
-	return err
+	c.verified.Add(int64(len(data)))
+	return true
 }
 
 func (c *Client) getPieceLength(pieceIndex int) int {
-	totalLength := c.info.Info.Length
+	totalLength := c.info.Info.TotalLength()
 	pieceLength := c.info.Info.PieceLength
 	numPieces := (totalLength + pieceLength - 1) / pieceLength
 
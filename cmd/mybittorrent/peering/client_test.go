@@ -0,0 +1,421 @@
+package peering
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/storage"
+)
+
+// testTorrent returns a single-file torrent of length random bytes, without trackers.
+func testTorrent(length, pieceLength int) (*bencode.TorrentInfo, []byte) {
+	data := make([]byte, length)
+	rand.New(rand.NewSource(1)).Read(data)
+	info := &bencode.TorrentInfo{Info: bencode.InnerInfo{Name: "data.bin", Length: length, PieceLength: pieceLength}}
+	for start := 0; start < length; start += pieceLength {
+		hash := sha1.Sum(data[start:min(start+pieceLength, length)])
+		info.Info.Pieces = append(info.Info.Pieces, hash[:]...)
+	}
+	return info, data
+}
+
+// startSeeder serves the pieces of data that have accepts from memory on a local port.
+func startSeeder(t *testing.T, info *bencode.TorrentInfo, data []byte, have func(index int) bool) (*Seeder, Peer) {
+	t.Helper()
+	_, infoHash, err := bencode.HashInfo(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent, err := storage.NewMemoryStorage().OpenTorrent(&info.Info, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pieceLength := info.Info.PieceLength
+	for start := 0; start < len(data); start += pieceLength {
+		index := start / pieceLength
+		if !have(index) {
+			continue
+		}
+		if _, err := torrent.WriteAt(index, data[start:min(start+pieceLength, len(data))], 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := torrent.MarkComplete(index); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seeder, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	seeder.Add(info, infoHash, torrent)
+	go seeder.Serve()
+	t.Cleanup(func() { seeder.Close() })
+	addr := seeder.Addr().(*net.TCPAddr)
+	return seeder, Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func TestDownloadToFromSeeders(t *testing.T) {
+	// Three pieces of two blocks each and a short fourth piece, split over two seeders
+	// that each lack some, so that every piece must come from the seeder that has it.
+	info, data := testTorrent(3*2*blockSize+1000, 2*blockSize)
+	first, firstPeer := startSeeder(t, info, data, func(i int) bool { return i != 1 })
+	second, secondPeer := startSeeder(t, info, data, func(i int) bool { return i != 0 })
+
+	c, err := newClient(info, []Peer{firstPeer, secondPeer})
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	defer c.Close()
+	c.StallTimeout = 10 * time.Second
+
+	_, infoHash, _ := bencode.HashInfo(info)
+	torrent, err := storage.NewMemoryStorage().OpenTorrent(&info.Info, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DownloadTo(torrent); err != nil {
+		t.Fatalf("DownloadTo: %v", err)
+	}
+
+	if !bytes.Equal(torrent.(*storage.MemoryTorrent).Bytes(), data) {
+		t.Error("downloaded data differs from the seeded data")
+	}
+	result, err := storage.Verify(&info.Info, torrent, 0)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	for i, ok := range result.Pieces {
+		if !ok || !torrent.Completed(i) {
+			t.Errorf("piece %d: verified %v, marked complete %v", i, ok, torrent.Completed(i))
+		}
+	}
+	// Blocks requested from both seeders in endgame may arrive twice, or still be on
+	// their way when the download ends.
+	stats := c.Stats()
+	if uploaded := first.Uploaded() + second.Uploaded(); uploaded < stats.Downloaded {
+		t.Errorf("seeders uploaded %d bytes, client downloaded %d", uploaded, stats.Downloaded)
+	}
+	if stats.Verified != int64(len(data)) || stats.Downloaded-stats.Wasted != int64(len(data)) {
+		t.Errorf("client counted %d bytes verified and %d downloaded of which %d wasted, want %d verified",
+			stats.Verified, stats.Downloaded, stats.Wasted, len(data))
+	}
+}
+
+func TestDownloadToSkipsCompletePieces(t *testing.T) {
+	info, data := testTorrent(4*blockSize, blockSize)
+	seeder, peer := startSeeder(t, info, data, func(int) bool { return true })
+
+	c, err := newClient(info, []Peer{peer})
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	defer c.Close()
+
+	_, infoHash, _ := bencode.HashInfo(info)
+	torrent, err := storage.NewMemoryStorage().OpenTorrent(&info.Info, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Pieces 0 and 3 are already stored, as when resuming.
+	for _, i := range []int{0, 3} {
+		torrent.WriteAt(i, data[i*blockSize:(i+1)*blockSize], 0)
+		torrent.MarkComplete(i)
+	}
+	if err := c.DownloadTo(torrent); err != nil {
+		t.Fatalf("DownloadTo: %v", err)
+	}
+
+	if !bytes.Equal(torrent.(*storage.MemoryTorrent).Bytes(), data) {
+		t.Error("downloaded data differs from the seeded data")
+	}
+	if uploaded := seeder.Uploaded(); uploaded != 2*blockSize {
+		t.Errorf("seeder uploaded %d bytes, want only the two missing pieces", uploaded)
+	}
+}
+
+// connectInbound connects to the client's listening port, retrying until the client takes
+// the connection, and then serves every block of data the client requests. It returns
+// the port the client's extended handshake announced once the client disconnects, or
+// nothing if the client never took the connection.
+func connectInbound(c *Client, data []byte) <-chan int {
+	announced := make(chan int, 1)
+	go func() {
+		defer close(announced)
+		addr := net.JoinHostPort("127.0.0.1", fmt.Sprint(c.listenPort()))
+		var conn net.Conn
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			var err error
+			if conn, err = net.Dial("tcp", addr); err != nil {
+				continue
+			}
+			// The client turns peers away until the download starts.
+			if _, err := PerformHandshake(conn, c.infoHash); err == nil {
+				break
+			}
+			conn.Close()
+			conn = nil
+		}
+		if conn == nil {
+			return
+		}
+		defer conn.Close()
+
+		numPieces := len(c.info.Info.Pieces) / 20
+		bitfield := make([]byte, (numPieces+7)/8)
+		for i := range numPieces {
+			setBit(bitfield, i)
+		}
+		SendPeerMessage(conn, Bitfield{Bits: bitfield})
+		SendPeerMessage(conn, Unchoke{})
+		port := 0
+		for {
+			msg, err := ReadPeerMessage(conn)
+			if err != nil {
+				announced <- port
+				return
+			}
+			switch m := msg.(type) {
+			case Extended:
+				var hs ExtendedHandshake
+				if m.ID == 0 && bencode.Unmarshal(m.Payload, &hs) == nil {
+					port = hs.P
+				}
+			case Request:
+				start := m.Index*c.info.Info.PieceLength + m.Begin
+				SendPeerMessage(conn, Piece{Index: m.Index, Begin: m.Begin, Block: data[start : start+m.Length]})
+			}
+		}
+	}()
+	return announced
+}
+
+func TestDownloadFromInboundPeer(t *testing.T) {
+	info, data := testTorrent(4*blockSize, blockSize)
+	_, infoHash, _ := bencode.HashInfo(info)
+
+	tests := []struct {
+		name     string
+		download func(c *Client) ([]byte, error)
+		want     []byte
+	}{
+		{"DownloadTo", func(c *Client) ([]byte, error) {
+			torrent, err := storage.NewMemoryStorage().OpenTorrent(&info.Info, infoHash)
+			if err != nil {
+				return nil, err
+			}
+			err = c.DownloadTo(torrent)
+			return torrent.(*storage.MemoryTorrent).Bytes(), err
+		}, data},
+		{"DownloadPiece", func(c *Client) ([]byte, error) {
+			return c.DownloadPiece(2)
+		}, data[2*blockSize : 3*blockSize]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The only peer the client knows of has nothing, so every piece must come
+			// from the peer that connects to it.
+			_, empty := startSeeder(t, info, data, func(int) bool { return false })
+			c, err := newClient(info, []Peer{empty})
+			if err != nil {
+				t.Fatalf("newClient: %v", err)
+			}
+			defer c.Close()
+			if c.seeder == nil {
+				t.Skip("the client could not listen for peers")
+			}
+
+			announced := connectInbound(c, data)
+			got, err := tt.download(c)
+			if err != nil {
+				t.Fatalf("download: %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Error("downloaded data differs from what the inbound peer sent")
+			}
+			// The session ends with the download, and announced our listening port.
+			if port := <-announced; port != c.listenPort() {
+				t.Errorf("extended handshake announced port %d, want %d", port, c.listenPort())
+			}
+
+			// Between downloads the port stays open but turns the torrent's peers away.
+			addr := net.JoinHostPort("127.0.0.1", fmt.Sprint(c.listenPort()))
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("the client stopped listening after the download: %v", err)
+			}
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := PerformHandshake(conn, infoHash); err == nil {
+				t.Error("the client took a peer with no download running")
+			}
+			conn.Close()
+
+			c.Close()
+			if conn, err := net.Dial("tcp", addr); err == nil {
+				conn.Close()
+				t.Error("the client still listens after Close")
+			}
+		})
+	}
+}
+
+// flakyPeer has every piece of data and answers requests after delay, but drops each
+// connection once it has sent blocks blocks, or never if blocks is negative. It returns
+// the number of blocks it sent.
+func flakyPeer(t *testing.T, info *bencode.TorrentInfo, data []byte, blocks int, delay time.Duration) (Peer, *atomic.Int32) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	var served atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := AcceptHandshake(conn, func([]byte) bool { return true }); err != nil {
+					return
+				}
+				numPieces := len(info.Info.Pieces) / 20
+				bitfield := make([]byte, (numPieces+7)/8)
+				for i := range numPieces {
+					setBit(bitfield, i)
+				}
+				SendPeerMessage(conn, Bitfield{Bits: bitfield})
+				SendPeerMessage(conn, Unchoke{})
+				for sent := 0; blocks < 0 || sent < blocks; {
+					msg, err := ReadPeerMessage(conn)
+					if err != nil {
+						return
+					}
+					if m, ok := msg.(Request); ok {
+						time.Sleep(delay)
+						start := m.Index*info.Info.PieceLength + m.Begin
+						SendPeerMessage(conn, Piece{Index: m.Index, Begin: m.Begin, Block: data[start : start+m.Length]})
+						sent++
+						served.Add(1)
+					}
+				}
+			}()
+		}
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+	return Peer{IP: addr.IP, Port: uint16(addr.Port)}, &served
+}
+
+func TestPeerBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, minPeerBackoff},
+		{2, 2 * minPeerBackoff},
+		{3, 4 * minPeerBackoff},
+		{6, 32 * minPeerBackoff},
+		{7, maxPeerBackoff},
+		{1000, maxPeerBackoff},
+	}
+	for _, tt := range tests {
+		if got := peerBackoff(tt.failures); got != tt.want {
+			t.Errorf("peerBackoff(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadRequeuesPiecesOfDroppedPeer(t *testing.T) {
+	// Pieces of two blocks, so the peer that drops after one block leaves a piece half
+	// done. The seeder connects late so the dropping peer is asked first.
+	info, data := testTorrent(4*2*blockSize, 2*blockSize)
+	dropping, served := flakyPeer(t, info, data, 1, 0)
+	_, seeder := startSeeder(t, info, data, func(int) bool { return true })
+
+	c, err := newClient(info, []Peer{dropping, delayedPeer(t, seeder, 200*time.Millisecond)})
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	defer c.Close()
+	c.StallTimeout = 10 * time.Second
+
+	_, infoHash, _ := bencode.HashInfo(info)
+	torrent, err := storage.NewMemoryStorage().OpenTorrent(&info.Info, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DownloadTo(torrent); err != nil {
+		t.Fatalf("DownloadTo: %v", err)
+	}
+	if !bytes.Equal(torrent.(*storage.MemoryTorrent).Bytes(), data) {
+		t.Error("downloaded data differs from the seeded data")
+	}
+	// The dropping peer sent one block and was not reconnected to within its backoff.
+	if n := served.Load(); n != 1 {
+		t.Errorf("dropping peer sent %d blocks, want 1", n)
+	}
+}
+
+func TestDownloadStall(t *testing.T) {
+	const stallTimeout = 500 * time.Millisecond
+
+	t.Run("peer drops mid-piece", func(t *testing.T) {
+		// One block of a two-block piece is no verified piece, so the download fails.
+		info, data := testTorrent(4*2*blockSize, 2*blockSize)
+		dropping, _ := flakyPeer(t, info, data, 1, 0)
+		c, err := newClient(info, []Peer{dropping})
+		if err != nil {
+			t.Fatalf("newClient: %v", err)
+		}
+		defer c.Close()
+		c.StallTimeout = stallTimeout
+
+		start := time.Now()
+		_, err = c.DownloadPiece(0)
+		if err == nil || !strings.Contains(err.Error(), "no peer delivered a piece") {
+			t.Fatalf("DownloadPiece returned %v, want a stall", err)
+		}
+		if elapsed := time.Since(start); elapsed < stallTimeout {
+			t.Errorf("download failed after %v, before the stall timeout of %v", elapsed, stallTimeout)
+		}
+	})
+
+	t.Run("slow peer", func(t *testing.T) {
+		// Each piece arrives within the stall timeout even though the whole download
+		// takes longer.
+		info, data := testTorrent(4*blockSize, blockSize)
+		slow, _ := flakyPeer(t, info, data, -1, 200*time.Millisecond)
+		c, err := newClient(info, []Peer{slow})
+		if err != nil {
+			t.Fatalf("newClient: %v", err)
+		}
+		defer c.Close()
+		c.StallTimeout = stallTimeout
+
+		_, infoHash, _ := bencode.HashInfo(info)
+		torrent, err := storage.NewMemoryStorage().OpenTorrent(&info.Info, infoHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		if err := c.DownloadTo(torrent); err != nil {
+			t.Fatalf("DownloadTo: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < stallTimeout {
+			t.Errorf("download took %v, want longer than the stall timeout for the test to mean anything", elapsed)
+		}
+		if !bytes.Equal(torrent.(*storage.MemoryTorrent).Bytes(), data) {
+			t.Error("downloaded data differs from the seeded data")
+		}
+	})
+}
@@ -0,0 +1,210 @@
+package peering
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
+	"go.uber.org/zap"
+)
+
+// clientVersion is the client name and version sent in the extended handshake.
+const clientVersion = "mybittorrent 0.1"
+
+// ExtendedHandshake is the payload of the BEP 10 extended handshake.
+type ExtendedHandshake struct {
+	// M maps the names of the extensions the sender supports to the message IDs it
+	// assigned them. An ID of 0 means the extension is disabled.
+	M map[string]int `bencode:"m"`
+	// V is the sender's client name and version.
+	V string `bencode:"v,omitempty"`
+	// P is the port the sender accepts connections on.
+	P int `bencode:"p,omitempty"`
+	// Reqq is how many outstanding requests the sender accepts without dropping any.
+	Reqq int `bencode:"reqq,omitempty"`
+	// YourIP is the receiver's address as the sender sees it, in 4 or 16 bytes.
+	YourIP []byte `bencode:"yourip,omitempty"`
+	// MetadataSize is the length of the torrent's info dictionary, for ut_metadata.
+	MetadataSize int `bencode:"metadata_size,omitempty"`
+}
+
+// ExtensionHandler handles the payload of an extended message the peer sent for an extension.
+type ExtensionHandler func(payload []byte) error
+
+// Extensions is the extension protocol state of one connection: the extensions we
+// support, under the message IDs we assigned them in order of registration, and the
+// extended handshake the peer sent.
+type Extensions struct {
+	// Port, MaxRequests and MetadataSize are announced in our extended handshake when set.
+	Port         int
+	MaxRequests  int
+	MetadataSize int
+
+	send     func(PeerMessage) error
+	names    []string // indexed by our message ID minus one
+	handlers []ExtensionHandler
+	peer     *ExtendedHandshake
+}
+
+// NewExtensions returns the extension state of a connection whose messages are sent with send.
+func NewExtensions(send func(PeerMessage) error) *Extensions {
+	return &Extensions{send: send}
+}
+
+// SupportsExtensions reports whether a peer's handshake announces the extension protocol.
+func SupportsExtensions(handshake []byte) bool {
+	return len(handshake) >= 28 && handshake[25]&0x10 != 0
+}
+
+// Register adds an extension, whose messages from the peer are passed to handler.
+// Extensions must be registered before our handshake is sent.
+func (e *Extensions) Register(name string, handler ExtensionHandler) {
+	for i, registered := range e.names {
+		if registered == name {
+			e.handlers[i] = handler
+			return
+		}
+	}
+	e.names = append(e.names, name)
+	e.handlers = append(e.handlers, handler)
+}
+
+// SendHandshake sends our extended handshake. yourIP is the peer's address, or nil
+// to leave it out.
+func (e *Extensions) SendHandshake(yourIP net.IP) error {
+	hs := ExtendedHandshake{
+		M:            make(map[string]int, len(e.names)),
+		V:            clientVersion,
+		P:            e.Port,
+		Reqq:         e.MaxRequests,
+		MetadataSize: e.MetadataSize,
+	}
+	for i, name := range e.names {
+		hs.M[name] = i + 1
+	}
+	if ip4 := yourIP.To4(); ip4 != nil {
+		hs.YourIP = ip4
+	} else if yourIP != nil {
+		hs.YourIP = yourIP.To16()
+	}
+
+	payload, err := bencode.Marshal(hs)
+	if err != nil {
+		return err
+	}
+	if err := e.send(Extended{ID: 0, Payload: payload}); err != nil {
+		return fmt.Errorf("failed to send extended handshake: %v", err)
+	}
+	return nil
+}
+
+// Handle processes an extended message from the peer. A handshake is recorded, with
+// later ones updating the earlier, and other messages are passed to the handler of the
+// extension we assigned their ID to. Messages for IDs we never assigned are dropped.
+func (e *Extensions) Handle(m Extended) error {
+	if m.ID == 0 {
+		var hs ExtendedHandshake
+		if err := bencode.Unmarshal(m.Payload, &hs); err != nil {
+			return fmt.Errorf("invalid extended handshake: %w", err)
+		}
+		if e.peer == nil {
+			e.peer = &hs
+		} else {
+			e.peer.update(hs)
+		}
+		return nil
+	}
+
+	i := int(m.ID) - 1
+	if i >= len(e.handlers) {
+		zap.L().Debug("Dropping extended message with unassigned ID", zap.Uint8("id", m.ID))
+		return nil
+	}
+	if err := e.handlers[i](m.Payload); err != nil {
+		return fmt.Errorf("%s: %w", e.names[i], err)
+	}
+	return nil
+}
+
+// update applies a later handshake, which only needs to carry what changed.
+// A zero ID in its m dictionary disables an extension.
+func (h *ExtendedHandshake) update(later ExtendedHandshake) {
+	if h.M == nil {
+		h.M = make(map[string]int)
+	}
+	for name, id := range later.M {
+		h.M[name] = id
+	}
+	if later.V != "" {
+		h.V = later.V
+	}
+	if later.P != 0 {
+		h.P = later.P
+	}
+	if later.Reqq != 0 {
+		h.Reqq = later.Reqq
+	}
+	if later.YourIP != nil {
+		h.YourIP = later.YourIP
+	}
+	if later.MetadataSize != 0 {
+		h.MetadataSize = later.MetadataSize
+	}
+}
+
+// PeerHandshake returns the extended handshake the peer sent, or nil if none arrived yet.
+func (e *Extensions) PeerHandshake() *ExtendedHandshake {
+	return e.peer
+}
+
+// PeerID returns the message ID the peer assigned to an extension, and whether the peer
+// supports it.
+func (e *Extensions) PeerID(name string) (byte, bool) {
+	if e.peer == nil {
+		return 0, false
+	}
+	id := e.peer.M[name]
+	if id <= 0 || id > 255 {
+		return 0, false
+	}
+	return byte(id), true
+}
+
+// Send sends a message for an extension, under the ID the peer assigned it.
+func (e *Extensions) Send(name string, payload []byte) error {
+	id, ok := e.PeerID(name)
+	if !ok {
+		return fmt.Errorf("peer does not support %s", name)
+	}
+	return e.send(Extended{ID: id, Payload: payload})
+}
+
+// ExchangeExtendedHandshake sends our extended handshake on conn and reads messages
+// until the peer's arrives, skipping the ones it sends before, such as its bitfield.
+func ExchangeExtendedHandshake(conn net.Conn, e *Extensions) (*ExtendedHandshake, error) {
+	if err := e.SendHandshake(remoteIP(conn)); err != nil {
+		return nil, err
+	}
+	for {
+		msg, err := ReadPeerMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		if m, ok := msg.(Extended); ok {
+			if err := e.Handle(m); err != nil {
+				return nil, err
+			}
+			if hs := e.PeerHandshake(); hs != nil {
+				return hs, nil
+			}
+		}
+	}
+}
+
+// remoteIP returns the address of the other end of conn, or nil if it has none.
+func remoteIP(conn net.Conn) net.IP {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package peering
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
+)
+
+// scriptedPeer runs script against the far end of a pipe whose near end is returned,
+// and reports what it returns once the test reads it from the returned channel.
+func scriptedPeer(t *testing.T, script func(conn net.Conn) error) (net.Conn, <-chan error) {
+	t.Helper()
+	near, far := net.Pipe()
+	t.Cleanup(func() { near.Close() })
+	done := make(chan error, 1)
+	go func() {
+		defer far.Close()
+		done <- script(far)
+	}()
+	return near, done
+}
+
+// readExtended reads messages from conn until an extended one arrives.
+func readExtended(conn net.Conn) (Extended, error) {
+	for {
+		msg, err := ReadPeerMessage(conn)
+		if err != nil {
+			return Extended{}, err
+		}
+		if m, ok := msg.(Extended); ok {
+			return m, nil
+		}
+	}
+}
+
+func sendHandshake(conn net.Conn, hs any) error {
+	payload, err := bencode.Marshal(hs)
+	if err != nil {
+		return err
+	}
+	return SendPeerMessage(conn, Extended{ID: 0, Payload: payload})
+}
+
+func TestExchangeExtendedHandshake(t *testing.T) {
+	var ours ExtendedHandshake
+	conn, done := scriptedPeer(t, func(conn net.Conn) error {
+		m, err := readExtended(conn)
+		if err != nil {
+			return err
+		}
+		if m.ID != 0 {
+			return errors.New("first extended message is not a handshake")
+		}
+		if err := bencode.Unmarshal(m.Payload, &ours); err != nil {
+			return err
+		}
+		// Messages sent before the handshake are skipped.
+		if err := SendPeerMessage(conn, Bitfield{Bits: []byte{0xff}}); err != nil {
+			return err
+		}
+		return sendHandshake(conn, ExtendedHandshake{
+			M:            map[string]int{utMetadata: 3, "ut_pex": 1},
+			V:            "scripted 1.0",
+			P:            51413,
+			Reqq:         250,
+			YourIP:       []byte{10, 0, 0, 7},
+			MetadataSize: 31235,
+		})
+	})
+
+	ext := NewExtensions(func(m PeerMessage) error { return SendPeerMessage(conn, m) })
+	ext.Port = 6881
+	ext.MaxRequests = 500
+	ext.MetadataSize = 1234
+	ext.Register(utMetadata, func([]byte) error { return nil })
+	ext.Register("ut_pex", func([]byte) error { return nil })
+
+	hs, err := ExchangeExtendedHandshake(conn, ext)
+	if err != nil {
+		t.Fatalf("ExchangeExtendedHandshake: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("peer: %v", err)
+	}
+
+	if ours.M[utMetadata] != 1 || ours.M["ut_pex"] != 2 || len(ours.M) != 2 {
+		t.Errorf("sent m = %v, want IDs in order of registration", ours.M)
+	}
+	if ours.V != clientVersion || ours.P != 6881 || ours.Reqq != 500 || ours.MetadataSize != 1234 {
+		t.Errorf("sent v=%q p=%d reqq=%d metadata_size=%d", ours.V, ours.P, ours.Reqq, ours.MetadataSize)
+	}
+	if ours.YourIP != nil {
+		t.Errorf("sent yourip %v over a connection without an IP", ours.YourIP)
+	}
+
+	if hs.V != "scripted 1.0" || hs.P != 51413 || hs.Reqq != 250 || hs.MetadataSize != 31235 {
+		t.Errorf("received v=%q p=%d reqq=%d metadata_size=%d", hs.V, hs.P, hs.Reqq, hs.MetadataSize)
+	}
+	if !bytes.Equal(hs.YourIP, []byte{10, 0, 0, 7}) {
+		t.Errorf("received yourip %v", hs.YourIP)
+	}
+	if id, ok := ext.PeerID(utMetadata); !ok || id != 3 {
+		t.Errorf("PeerID(%s) = %d, %v, want 3, true", utMetadata, id, ok)
+	}
+}
+
+func TestSendHandshakeYourIP(t *testing.T) {
+	tests := []struct {
+		ip   net.IP
+		want []byte
+	}{
+		{net.ParseIP("192.0.2.1"), []byte{192, 0, 2, 1}},
+		{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::1").To16()},
+		{nil, nil},
+	}
+	for _, tt := range tests {
+		var sent Extended
+		ext := NewExtensions(func(m PeerMessage) error {
+			sent = m.(Extended)
+			return nil
+		})
+		if err := ext.SendHandshake(tt.ip); err != nil {
+			t.Fatalf("SendHandshake(%v): %v", tt.ip, err)
+		}
+		var hs ExtendedHandshake
+		if err := bencode.Unmarshal(sent.Payload, &hs); err != nil {
+			t.Fatalf("SendHandshake(%v) sent an invalid handshake: %v", tt.ip, err)
+		}
+		if !bytes.Equal(hs.YourIP, tt.want) {
+			t.Errorf("SendHandshake(%v) sent yourip %v, want %v", tt.ip, hs.YourIP, tt.want)
+		}
+	}
+}
+
+func TestExtensionsDispatch(t *testing.T) {
+	conn, done := scriptedPeer(t, func(conn net.Conn) error {
+		if _, err := readExtended(conn); err != nil {
+			return err
+		}
+		if err := sendHandshake(conn, ExtendedHandshake{M: map[string]int{"b": 7}}); err != nil {
+			return err
+		}
+		// Messages are addressed with the IDs we assigned: 2 is b, 3 was never assigned.
+		for _, m := range []Extended{{ID: 2, Payload: []byte("to b")}, {ID: 3, Payload: []byte("lost")}, {ID: 1, Payload: []byte("to a")}} {
+			if err := SendPeerMessage(conn, m); err != nil {
+				return err
+			}
+		}
+		// Our messages come addressed with the ID the peer assigned.
+		m, err := readExtended(conn)
+		if err != nil {
+			return err
+		}
+		if m.ID != 7 || string(m.Payload) != "reply" {
+			return errors.New("reply not sent under the peer's ID")
+		}
+		return nil
+	})
+
+	var got []string
+	ext := NewExtensions(func(m PeerMessage) error { return SendPeerMessage(conn, m) })
+	ext.Register("a", func(payload []byte) error {
+		got = append(got, "a: "+string(payload))
+		return nil
+	})
+	ext.Register("b", func(payload []byte) error {
+		got = append(got, "b: "+string(payload))
+		return nil
+	})
+	if _, err := ExchangeExtendedHandshake(conn, ext); err != nil {
+		t.Fatalf("ExchangeExtendedHandshake: %v", err)
+	}
+	for range 3 {
+		m, err := readExtended(conn)
+		if err != nil {
+			t.Fatalf("reading from peer: %v", err)
+		}
+		if err := ext.Handle(m); err != nil {
+			t.Fatalf("Handle(%d): %v", m.ID, err)
+		}
+	}
+	if want := []string{"b: to b", "a: to a"}; len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("handlers got %q, want %q", got, want)
+	}
+
+	if err := ext.Send("a", []byte("unsupported")); err == nil {
+		t.Error("Send succeeded for an extension the peer does not support")
+	}
+	if err := ext.Send("b", []byte("reply")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("peer: %v", err)
+	}
+}
+
+func TestExtensionsHandlerError(t *testing.T) {
+	ext := NewExtensions(func(PeerMessage) error { return nil })
+	ext.Register("a", func([]byte) error { return errors.New("bad payload") })
+	err := ext.Handle(Extended{ID: 1})
+	if err == nil || err.Error() != "a: bad payload" {
+		t.Errorf("Handle returned %v, want the handler's error prefixed with the extension", err)
+	}
+}
+
+func TestLaterExtendedHandshake(t *testing.T) {
+	ext := NewExtensions(func(PeerMessage) error { return nil })
+	handshakes := []ExtendedHandshake{
+		{M: map[string]int{utMetadata: 2, "ut_pex": 1}, V: "peer 1", Reqq: 100, MetadataSize: 500},
+		// Only what changed: ut_metadata is disabled and reqq raised.
+		{M: map[string]int{utMetadata: 0}, Reqq: 400},
+	}
+	for _, hs := range handshakes {
+		payload, err := bencode.Marshal(hs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ext.Handle(Extended{ID: 0, Payload: payload}); err != nil {
+			t.Fatalf("Handle: %v", err)
+		}
+	}
+
+	if _, ok := ext.PeerID(utMetadata); ok {
+		t.Errorf("%s still enabled after the peer assigned it ID 0", utMetadata)
+	}
+	if err := ext.Send(utMetadata, nil); err == nil {
+		t.Errorf("Send succeeded for disabled %s", utMetadata)
+	}
+	if id, ok := ext.PeerID("ut_pex"); !ok || id != 1 {
+		t.Errorf("PeerID(ut_pex) = %d, %v, want 1, true", id, ok)
+	}
+	hs := ext.PeerHandshake()
+	if hs.V != "peer 1" || hs.Reqq != 400 || hs.MetadataSize != 500 {
+		t.Errorf("merged handshake has v=%q reqq=%d metadata_size=%d, want peer 1, 400, 500", hs.V, hs.Reqq, hs.MetadataSize)
+	}
+}
+
+func TestInvalidExtendedHandshake(t *testing.T) {
+	ext := NewExtensions(func(PeerMessage) error { return nil })
+	if err := ext.Handle(Extended{ID: 0, Payload: []byte("d1:mi1e")}); err == nil {
+		t.Error("Handle accepted a truncated handshake")
+	}
+	if ext.PeerHandshake() != nil {
+		t.Error("a rejected handshake was recorded")
+	}
+}
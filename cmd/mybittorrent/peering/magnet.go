@@ -0,0 +1,144 @@
+package peering
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/magnet"
+)
+
+// trackerGracePeriod is how long GetPeersFromTrackers waits for the other trackers
+// once one has returned peers.
+const trackerGracePeriod = 3 * time.Second
+
+// GetPeersFromTrackers announces infoHash to all of trackers at once, as for the tr
+// parameters of a magnet link, and returns every peer they know about once. It returns
+// trackerGracePeriod after the first tracker returned peers, without waiting for slower
+// ones, and fails only if no tracker returned a peer.
+func GetPeersFromTrackers(trackers []string, infoHash []byte) ([]Peer, error) {
+	if len(trackers) == 0 {
+		return nil, fmt.Errorf("no trackers available")
+	}
+
+	type result struct {
+		peers []Peer
+		err   error
+	}
+	// Buffered so that trackers answering after we return do not block.
+	results := make(chan result, len(trackers))
+	for _, trackerURL := range trackers {
+		go func() {
+			peers, err := GetPeersFromTracker(trackerURL, infoHash)
+			if err != nil {
+				err = fmt.Errorf("%s: %w", trackerURL, err)
+			}
+			results <- result{peers: peers, err: err}
+		}()
+	}
+
+	var peers []Peer
+	var errs []error
+	var grace <-chan time.Time
+	seen := make(map[string]bool)
+collect:
+	for range trackers {
+		var r result
+		select {
+		case r = <-results:
+		case <-grace:
+			break collect
+		}
+		if r.err != nil {
+			errs = append(errs, r.err)
+			continue
+		}
+		for _, peer := range r.peers {
+			if !seen[peer.Addr()] {
+				seen[peer.Addr()] = true
+				peers = append(peers, peer)
+			}
+		}
+		if grace == nil && len(peers) > 0 {
+			grace = time.After(trackerGracePeriod)
+		}
+	}
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("no tracker returned peers: %w", errors.Join(errs...))
+	}
+	return peers, nil
+}
+
+// ResolveMagnet fetches the info dictionary of the torrent a magnet link points to from
+// the peers of all its trackers. The returned torrent announces to the link's trackers,
+// each in a tier of its own so that they are tried in the link's order.
+func ResolveMagnet(link *magnet.Link) (*bencode.TorrentInfo, error) {
+	infoHash, peers, err := magnetPeers(link)
+	if err != nil {
+		return nil, err
+	}
+	return fetchMagnetInfo(link, infoHash, peers)
+}
+
+// NewMagnetClient returns a client for the torrent a magnet link points to, ready to
+// download like one created from a metainfo file, with the peers of all the link's
+// trackers. Its metadata is fetched from those peers unless info holds it already, as
+// when it was resolved before and cached; info must then match the link's info hash.
+func NewMagnetClient(link *magnet.Link, info *bencode.TorrentInfo) (*Client, error) {
+	infoHash, peers, err := magnetPeers(link)
+	if err != nil {
+		return nil, err
+	}
+
+	if info == nil {
+		if info, err = fetchMagnetInfo(link, infoHash, peers); err != nil {
+			return nil, err
+		}
+	} else {
+		_, hash, err := bencode.HashInfo(info)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(hash, infoHash) {
+			return nil, fmt.Errorf("torrent has info hash %x, magnet link has %s", hash, link.InfoHash)
+		}
+	}
+	return newClient(info, peers)
+}
+
+// magnetPeers returns the info hash of a magnet link along with the peers of its trackers.
+func magnetPeers(link *magnet.Link) ([]byte, []Peer, error) {
+	infoHash, err := hex.DecodeString(link.InfoHash)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode info hash: %w", err)
+	}
+	if len(link.Trackers) == 0 {
+		return nil, nil, fmt.Errorf("magnet link has no trackers")
+	}
+
+	peers, err := GetPeersFromTrackers(link.Trackers, infoHash)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get peers: %w", err)
+	}
+	return infoHash, peers, nil
+}
+
+// fetchMagnetInfo fetches the metadata of a magnet link's torrent from peers and sets
+// its trackers to the link's.
+func fetchMagnetInfo(link *magnet.Link, infoHash []byte, peers []Peer) (*bencode.TorrentInfo, error) {
+	info, err := FetchMetadata(infoHash, peers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch metadata: %w", err)
+	}
+
+	info.Announce = link.Trackers[0]
+	if len(link.Trackers) > 1 {
+		for _, tracker := range link.Trackers {
+			info.AnnounceList = append(info.AnnounceList, []string{tracker})
+		}
+	}
+	return info, nil
+}
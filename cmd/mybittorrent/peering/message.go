@@ -0,0 +1,243 @@
+package peering
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// Peer wire message IDs from BEP 3, plus the DHT port message of BEP 5 and the
+// extended message of BEP 10.
+const (
+	MsgChoke         byte = 0
+	MsgUnchoke       byte = 1
+	MsgInterested    byte = 2
+	MsgNotInterested byte = 3
+	MsgHave          byte = 4
+	MsgBitfield      byte = 5
+	MsgRequest       byte = 6
+	MsgPiece         byte = 7
+	MsgCancel        byte = 8
+	MsgPort          byte = 9
+	MsgExtended      byte = 20
+)
+
+// PeerMessage is a decoded peer wire message.
+type PeerMessage interface {
+	// frame returns the message as it is framed on the wire.
+	frame() Message
+}
+
+// KeepAlive is the empty message peers send to keep an idle connection open.
+type KeepAlive struct{}
+
+// Choke tells the receiver its requests will not be answered.
+type Choke struct{}
+
+// Unchoke tells the receiver it may request blocks.
+type Unchoke struct{}
+
+// Interested tells the receiver the sender wants some of its pieces.
+type Interested struct{}
+
+// NotInterested tells the receiver the sender wants none of its pieces.
+type NotInterested struct{}
+
+// Have announces that the sender completed a piece.
+type Have struct {
+	Index int
+}
+
+// Bitfield lists the pieces the sender has, most significant bit first.
+// It may only be sent directly after the handshake.
+type Bitfield struct {
+	Bits []byte
+}
+
+// Request asks for a block of a piece.
+type Request struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+// Piece carries a block of a piece.
+type Piece struct {
+	Index int
+	Begin int
+	Block []byte
+}
+
+// Cancel withdraws an earlier request.
+type Cancel struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+// Port announces the port of the sender's DHT node.
+type Port struct {
+	Port uint16
+}
+
+// Extended carries a message of the extension protocol. ID 0 is the extended
+// handshake; other IDs are the ones the receiver assigned to its extensions.
+type Extended struct {
+	ID      byte
+	Payload []byte
+}
+
+// UnknownMessage is a message with an ID this client does not understand.
+type UnknownMessage struct {
+	ID      byte
+	Payload []byte
+}
+
+func (KeepAlive) frame() Message     { return Message{} }
+func (Choke) frame() Message         { return idFrame(MsgChoke, nil) }
+func (Unchoke) frame() Message       { return idFrame(MsgUnchoke, nil) }
+func (Interested) frame() Message    { return idFrame(MsgInterested, nil) }
+func (NotInterested) frame() Message { return idFrame(MsgNotInterested, nil) }
+
+func (m Have) frame() Message {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(m.Index))
+	return idFrame(MsgHave, payload)
+}
+
+func (m Bitfield) frame() Message { return idFrame(MsgBitfield, m.Bits) }
+
+func (m Request) frame() Message {
+	return idFrame(MsgRequest, encodeRequest(m.Index, m.Begin, m.Length))
+}
+
+func (m Piece) frame() Message {
+	payload := make([]byte, 8+len(m.Block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(m.Index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(m.Begin))
+	copy(payload[8:], m.Block)
+	return idFrame(MsgPiece, payload)
+}
+
+func (m Cancel) frame() Message {
+	return idFrame(MsgCancel, encodeRequest(m.Index, m.Begin, m.Length))
+}
+
+func (m Port) frame() Message {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, m.Port)
+	return idFrame(MsgPort, payload)
+}
+
+func (m Extended) frame() Message {
+	return idFrame(MsgExtended, append([]byte{m.ID}, m.Payload...))
+}
+
+func (m UnknownMessage) frame() Message { return idFrame(m.ID, m.Payload) }
+
+func idFrame(id byte, payload []byte) Message {
+	return Message{Length: uint32(1 + len(payload)), ID: id, Payload: payload}
+}
+
+// parseMessage decodes a raw message, checking the payload length each type requires.
+func parseMessage(msg *Message) (PeerMessage, error) {
+	if msg.Length == 0 {
+		return KeepAlive{}, nil
+	}
+
+	payload := msg.Payload
+	wantLength := func(n int) error {
+		if len(payload) != n {
+			return fmt.Errorf("message %d has %d byte payload, want %d", msg.ID, len(payload), n)
+		}
+		return nil
+	}
+
+	switch msg.ID {
+	case MsgChoke:
+		return Choke{}, wantLength(0)
+	case MsgUnchoke:
+		return Unchoke{}, wantLength(0)
+	case MsgInterested:
+		return Interested{}, wantLength(0)
+	case MsgNotInterested:
+		return NotInterested{}, wantLength(0)
+	case MsgHave:
+		if err := wantLength(4); err != nil {
+			return nil, err
+		}
+		return Have{Index: int(binary.BigEndian.Uint32(payload))}, nil
+	case MsgBitfield:
+		return Bitfield{Bits: payload}, nil
+	case MsgRequest, MsgCancel:
+		if err := wantLength(12); err != nil {
+			return nil, err
+		}
+		index := int(binary.BigEndian.Uint32(payload[0:4]))
+		begin := int(binary.BigEndian.Uint32(payload[4:8]))
+		length := int(binary.BigEndian.Uint32(payload[8:12]))
+		if msg.ID == MsgRequest {
+			return Request{Index: index, Begin: begin, Length: length}, nil
+		}
+		return Cancel{Index: index, Begin: begin, Length: length}, nil
+	case MsgPiece:
+		if len(payload) < 8 {
+			return nil, fmt.Errorf("invalid piece message payload size")
+		}
+		return Piece{
+			Index: int(binary.BigEndian.Uint32(payload[0:4])),
+			Begin: int(binary.BigEndian.Uint32(payload[4:8])),
+			Block: payload[8:],
+		}, nil
+	case MsgPort:
+		if err := wantLength(2); err != nil {
+			return nil, err
+		}
+		return Port{Port: binary.BigEndian.Uint16(payload)}, nil
+	case MsgExtended:
+		if len(payload) < 1 {
+			return nil, fmt.Errorf("invalid extended message payload size")
+		}
+		return Extended{ID: payload[0], Payload: payload[1:]}, nil
+	default:
+		return UnknownMessage{ID: msg.ID, Payload: payload}, nil
+	}
+}
+
+// maxExtendedLength bounds an extended message, which is at most a metadata piece and its header.
+const maxExtendedLength = 64 * 1024
+
+// maxMessageLength returns the longest message a peer may send for a torrent of
+// numPieces pieces: the largest of its bitfield, a block of maxRequestLength and an
+// extended message.
+func maxMessageLength(numPieces int) int {
+	return max(1+(numPieces+7)/8, 9+maxRequestLength, maxExtendedLength)
+}
+
+// ReadPeerMessage reads and decodes the next message from conn. It accepts messages
+// as long as those of the largest torrent whose metadata we would fetch.
+func ReadPeerMessage(conn net.Conn) (PeerMessage, error) {
+	return readPeerMessage(conn, maxMessageLength(maxMetadataSize/20))
+}
+
+// readPeerMessage reads and decodes the next message from conn, which must not be
+// longer than maxLength bytes.
+func readPeerMessage(conn net.Conn, maxLength int) (PeerMessage, error) {
+	msg, err := readMessage(conn, maxLength)
+	if err != nil {
+		return nil, err
+	}
+	return parseMessage(msg)
+}
+
+// SendPeerMessage writes m to conn.
+func SendPeerMessage(conn net.Conn, m PeerMessage) error {
+	f := m.frame()
+	if f.Length == 0 {
+		if _, err := conn.Write(make([]byte, 4)); err != nil {
+			return fmt.Errorf("failed to send keep-alive: %v", err)
+		}
+		return nil
+	}
+	return sendMessage(conn, f.ID, f.Payload)
+}
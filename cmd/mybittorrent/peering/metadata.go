@@ -0,0 +1,372 @@
+package peering
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
+	"go.uber.org/zap"
+)
+
+const (
+	// utMetadata is the name of the BEP 9 extension for exchanging a torrent's info dictionary.
+	utMetadata = "ut_metadata"
+	// metadataPieceSize is the size of every metadata piece but the last.
+	metadataPieceSize = 16 * 1024
+	// maxMetadataSize bounds the info dictionary a peer may announce, since we hold
+	// all of it in memory before it can be checked.
+	maxMetadataSize = 16 * 1024 * 1024
+	// metadataPeers is how many peers metadata is fetched from at a time.
+	metadataPeers = 8
+	// metadataTimeout is how long a peer has to answer a metadata request.
+	metadataTimeout = 20 * time.Second
+)
+
+// Message types of ut_metadata.
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+// metadataMessage is the bencoded header of a ut_metadata message. Data messages are
+// followed by the piece itself.
+type metadataMessage struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// parseMetadataMessage splits a ut_metadata payload into its header and the data after it.
+func parseMetadataMessage(payload []byte) (metadataMessage, []byte, error) {
+	var m metadataMessage
+	d := bencode.NewDecoder(bytes.NewReader(payload))
+	if err := d.Decode(&m); err != nil {
+		return m, nil, fmt.Errorf("invalid message: %w", err)
+	}
+	return m, payload[d.InputOffset():], nil
+}
+
+// sendMetadataMessage sends a ut_metadata message with data appended to its header.
+func sendMetadataMessage(e *Extensions, m metadataMessage, data []byte) error {
+	payload, err := bencode.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return e.Send(utMetadata, append(payload, data...))
+}
+
+// serveMetadata registers ut_metadata on e, answering the peer's requests for pieces of
+// metadata, and announces its size in our extended handshake.
+func serveMetadata(e *Extensions, metadata []byte) {
+	e.MetadataSize = len(metadata)
+	e.Register(utMetadata, func(payload []byte) error {
+		m, _, err := parseMetadataMessage(payload)
+		if err != nil {
+			return err
+		}
+		if m.MsgType != metadataRequest {
+			return nil
+		}
+		if _, ok := e.PeerID(utMetadata); !ok {
+			// The peer gave us no ID to answer under.
+			return nil
+		}
+		begin := m.Piece * metadataPieceSize
+		if m.Piece < 0 || begin >= len(metadata) {
+			return sendMetadataMessage(e, metadataMessage{MsgType: metadataReject, Piece: m.Piece}, nil)
+		}
+		end := min(begin+metadataPieceSize, len(metadata))
+		return sendMetadataMessage(e, metadataMessage{
+			MsgType:   metadataData,
+			Piece:     m.Piece,
+			TotalSize: len(metadata),
+		}, metadata[begin:end])
+	})
+}
+
+// infoMetadata returns the info dictionary of a torrent as peers fetch it with ut_metadata:
+// RawInfo as read from the metainfo file, or else info re-encoded. Returns nil if that
+// does not hash to infoHash, as when re-encoding drops keys InnerInfo does not model.
+func infoMetadata(info *bencode.TorrentInfo, infoHash []byte) []byte {
+	metadata := info.RawInfo
+	if metadata == nil {
+		encoded, err := bencode.Marshal(info.Info)
+		if err != nil {
+			return nil
+		}
+		metadata = encoded
+	}
+	if hash := sha1.Sum(metadata); !bytes.Equal(hash[:], infoHash) {
+		return nil
+	}
+	return metadata
+}
+
+// FetchMetadata downloads the info dictionary of the torrent with infoHash from peers
+// that support ut_metadata, requesting its pieces from up to metadataPeers of them at
+// a time, and checks it against infoHash. The returned torrent has no trackers set.
+func FetchMetadata(infoHash []byte, peers []Peer) (*bencode.TorrentInfo, error) {
+	f := &metadataFetch{
+		infoHash:   infoHash,
+		candidates: make(map[int]*metadataCandidate),
+		conns:      make(map[net.Conn]struct{}),
+		done:       make(chan struct{}),
+	}
+	defer f.stop()
+
+	errs := make(chan error, len(peers))
+	next, running := 0, 0
+	var lastErr error
+	for {
+		for running < metadataPeers && next < len(peers) {
+			peer := peers[next]
+			go func() {
+				err := f.fetchFrom(peer)
+				zap.L().Debug("Metadata peer done", zap.String("peer", peer.Addr()), zap.Error(err))
+				errs <- err
+			}()
+			next++
+			running++
+		}
+		if running == 0 {
+			if lastErr == nil {
+				return nil, fmt.Errorf("no peers available")
+			}
+			return nil, fmt.Errorf("no peer sent the metadata, last error: %v", lastErr)
+		}
+
+		select {
+		case <-f.done:
+			return f.torrentInfo()
+		case err := <-errs:
+			running--
+			if err != nil {
+				lastErr = err
+			}
+		}
+	}
+}
+
+// metadataFetch is the metadata being assembled from the pieces peers send.
+// Peers that announce different sizes cannot all be right, so pieces are only put
+// together with pieces from peers that announced the same size.
+type metadataFetch struct {
+	infoHash []byte
+
+	mu         sync.Mutex
+	candidates map[int]*metadataCandidate // by announced size
+	metadata   []byte                     // set once the pieces of a candidate hash to infoHash
+	conns      map[net.Conn]struct{}
+	stopped    bool
+	done       chan struct{}
+}
+
+// metadataCandidate is the metadata being assembled from the peers that announced one size.
+type metadataCandidate struct {
+	size      int
+	pieces    [][]byte // nil until received
+	requested []bool
+}
+
+// fetchFrom requests metadata pieces from peer, one at a time, until the metadata is
+// complete or the peer fails.
+func (f *metadataFetch) fetchFrom(peer Peer) error {
+	conn, err := net.DialTimeout("tcp", peer.Addr(), 3*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to connect to peer: %v", err)
+	}
+	defer conn.Close()
+	if !f.track(conn) {
+		return nil
+	}
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	resp, err := PerformHandshake(conn, f.infoHash)
+	if err != nil {
+		return err
+	}
+	if !SupportsExtensions(resp) {
+		return fmt.Errorf("peer does not support the extension protocol")
+	}
+
+	var received *metadataMessage
+	var data []byte
+	ext := NewExtensions(func(m PeerMessage) error {
+		return SendPeerMessage(conn, m)
+	})
+	ext.Register(utMetadata, func(payload []byte) error {
+		m, rest, err := parseMetadataMessage(payload)
+		if err != nil {
+			return err
+		}
+		if m.MsgType == metadataRequest {
+			// We have nothing to serve yet.
+			return sendMetadataMessage(ext, metadataMessage{MsgType: metadataReject, Piece: m.Piece}, nil)
+		}
+		received, data = &m, rest
+		return nil
+	})
+	hs, err := ExchangeExtendedHandshake(conn, ext)
+	if err != nil {
+		return err
+	}
+	if _, ok := ext.PeerID(utMetadata); !ok {
+		return fmt.Errorf("peer does not support %s", utMetadata)
+	}
+	c, err := f.candidate(hs.MetadataSize)
+	if err != nil {
+		return err
+	}
+
+	for {
+		piece, ok := f.nextPiece(c)
+		if !ok {
+			return nil
+		}
+		if err := sendMetadataMessage(ext, metadataMessage{MsgType: metadataRequest, Piece: piece}, nil); err != nil {
+			return fmt.Errorf("failed to send metadata request: %v", err)
+		}
+
+		conn.SetDeadline(time.Now().Add(metadataTimeout))
+		for received = nil; received == nil || received.Piece != piece; {
+			msg, err := ReadPeerMessage(conn)
+			if err != nil {
+				f.abort(c, piece)
+				return err
+			}
+			if m, ok := msg.(Extended); ok {
+				if err := ext.Handle(m); err != nil {
+					f.abort(c, piece)
+					return err
+				}
+			}
+		}
+		if received.MsgType != metadataData {
+			f.abort(c, piece)
+			return fmt.Errorf("peer rejected request for metadata piece %d", piece)
+		}
+		if err := f.receive(c, piece, data); err != nil {
+			return err
+		}
+	}
+}
+
+// track registers conn to be closed when the fetch stops. Returns false if it already has.
+func (f *metadataFetch) track(conn net.Conn) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.stopped {
+		return false
+	}
+	f.conns[conn] = struct{}{}
+	return true
+}
+
+// stop closes the connections of the peers still fetching.
+func (f *metadataFetch) stop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stopped = true
+	for conn := range f.conns {
+		conn.Close()
+	}
+}
+
+// candidate returns the metadata being assembled for the size a peer announced.
+func (f *metadataFetch) candidate(size int) (*metadataCandidate, error) {
+	if size <= 0 || size > maxMetadataSize {
+		return nil, fmt.Errorf("peer announced invalid metadata size %d", size)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := f.candidates[size]
+	if c == nil {
+		n := (size + metadataPieceSize - 1) / metadataPieceSize
+		c = &metadataCandidate{size: size, pieces: make([][]byte, n), requested: make([]bool, n)}
+		f.candidates[size] = c
+	}
+	return c, nil
+}
+
+// nextPiece returns a piece of c to request, preferring pieces no other peer has been
+// asked for. Returns false once the metadata is complete.
+func (f *metadataFetch) nextPiece(c *metadataCandidate) (int, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.metadata != nil || f.stopped {
+		return 0, false
+	}
+	missing := -1
+	for i, data := range c.pieces {
+		if data != nil {
+			continue
+		}
+		if !c.requested[i] {
+			c.requested[i] = true
+			return i, true
+		}
+		if missing < 0 {
+			missing = i
+		}
+	}
+	// Every missing piece is being fetched from another peer; ask this one as well.
+	return missing, missing >= 0
+}
+
+// abort makes a piece of c a peer did not deliver available to the others again.
+func (f *metadataFetch) abort(c *metadataCandidate, piece int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if piece < len(c.requested) && c.pieces[piece] == nil {
+		c.requested[piece] = false
+	}
+}
+
+// receive stores a piece of c and, once every piece is in, checks the metadata against
+// the info hash. A mismatch discards all pieces of c, since there is no telling which
+// peer sent a bad one, and fails the peer that sent the last.
+func (f *metadataFetch) receive(c *metadataCandidate, piece int, data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.metadata != nil || c.pieces[piece] != nil {
+		return nil
+	}
+	want := min(metadataPieceSize, c.size-piece*metadataPieceSize)
+	if len(data) != want {
+		c.requested[piece] = false
+		return fmt.Errorf("metadata piece %d has %d bytes, expected %d", piece, len(data), want)
+	}
+	c.pieces[piece] = bytes.Clone(data)
+
+	for _, data := range c.pieces {
+		if data == nil {
+			return nil
+		}
+	}
+	metadata := bytes.Join(c.pieces, nil)
+	if hash := sha1.Sum(metadata); !bytes.Equal(hash[:], f.infoHash) {
+		clear(c.pieces)
+		clear(c.requested)
+		return fmt.Errorf("metadata does not match the info hash")
+	}
+	f.metadata = metadata
+	close(f.done)
+	return nil
+}
+
+// torrentInfo parses the verified metadata.
+func (f *metadataFetch) torrentInfo() (*bencode.TorrentInfo, error) {
+	info := &bencode.TorrentInfo{RawInfo: f.metadata}
+	if err := bencode.Unmarshal(f.metadata, &info.Info); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata: %w", err)
+	}
+	if err := info.Info.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid metadata: %w", err)
+	}
+	return info, nil
+}
@@ -0,0 +1,174 @@
+package peering
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
+)
+
+func TestFetchMetadataFromSeeder(t *testing.T) {
+	generated, data := testTorrent(3*blockSize, blockSize)
+	// The seeder serves the info dictionary as read, keys InnerInfo drops included,
+	// in pieces: padding pushes it past one metadata piece.
+	padding := bytes.Repeat([]byte{'x'}, metadataPieceSize)
+	raw := fmt.Sprintf("d6:lengthi%de4:name%d:%s12:piece lengthi%de6:pieces%d:%s7:privatei1e6:source%d:%se",
+		generated.Info.Length, len(generated.Info.Name), generated.Info.Name, generated.Info.PieceLength,
+		len(generated.Info.Pieces), generated.Info.Pieces, len(padding), padding)
+	info, err := bencode.Info("d4:info" + raw + "e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, infoHash, err := bencode.HashInfo(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, peer := startSeeder(t, info, data, func(int) bool { return true })
+
+	fetched, err := FetchMetadata(infoHash, []Peer{peer})
+	if err != nil {
+		t.Fatalf("FetchMetadata: %v", err)
+	}
+	if !bytes.Equal(fetched.RawInfo, info.RawInfo) {
+		t.Error("fetched metadata differs from the info dictionary the seeder read")
+	}
+	if fetched.Info.Name != info.Info.Name || fetched.Info.Length != info.Info.Length {
+		t.Errorf("fetched info has name %q and length %d", fetched.Info.Name, fetched.Info.Length)
+	}
+}
+
+func TestInfoMetadata(t *testing.T) {
+	info, _ := testTorrent(3*blockSize, blockSize)
+	encoded, err := bencode.Marshal(info.Info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, infoHash, err := bencode.HashInfo(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := infoMetadata(info, infoHash); !bytes.Equal(got, encoded) {
+		t.Error("metadata of a torrent without RawInfo is not its encoded info")
+	}
+	// RawInfo that re-encoding would not reproduce is served as is.
+	withKeys := append(bytes.Clone(encoded[:len(encoded)-1]), "7:privatei1ee"...)
+	raw := &bencode.TorrentInfo{Info: info.Info, RawInfo: withKeys}
+	_, rawHash, _ := bencode.HashInfo(raw)
+	if got := infoMetadata(raw, rawHash); !bytes.Equal(got, withKeys) {
+		t.Error("metadata is not RawInfo")
+	}
+	// Without RawInfo the dropped keys cannot be served.
+	if got := infoMetadata(&bencode.TorrentInfo{Info: info.Info}, rawHash); got != nil {
+		t.Error("served metadata that does not match the info hash")
+	}
+}
+
+// metadataPeer listens on a local port and serves metadata with ut_metadata to every
+// peer that connects, whatever info hash it asks for.
+func metadataPeer(t *testing.T, metadata []byte) Peer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := AcceptHandshake(conn, func([]byte) bool { return true }); err != nil {
+					return
+				}
+				ext := NewExtensions(func(m PeerMessage) error { return SendPeerMessage(conn, m) })
+				serveMetadata(ext, metadata)
+				if _, err := ExchangeExtendedHandshake(conn, ext); err != nil {
+					return
+				}
+				for {
+					msg, err := ReadPeerMessage(conn)
+					if err != nil {
+						return
+					}
+					if m, ok := msg.(Extended); ok && ext.Handle(m) != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+	return Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+// delayedPeer forwards connections to peer after delay, so that another peer gets to
+// answer first.
+func delayedPeer(t *testing.T, peer Peer, delay time.Duration) Peer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				time.Sleep(delay)
+				target, err := net.Dial("tcp", peer.Addr())
+				if err != nil {
+					return
+				}
+				defer target.Close()
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+	return Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func TestFetchMetadataLyingPeer(t *testing.T) {
+	info, data := testTorrent(3*blockSize, blockSize)
+	_, infoHash, err := bencode.HashInfo(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := infoMetadata(info, infoHash)
+	_, honest := startSeeder(t, info, data, func(int) bool { return true })
+
+	tests := []struct {
+		name string
+		lie  []byte
+	}{
+		{"larger size", bytes.Repeat([]byte{'x'}, len(metadata)+metadataPieceSize)},
+		{"smaller size", metadata[:len(metadata)-1]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The lying peer announces its size first. The honest peer, announcing
+			// another size, must still be fetched from.
+			liar := metadataPeer(t, tt.lie)
+			fetched, err := FetchMetadata(infoHash, []Peer{liar, delayedPeer(t, honest, 200*time.Millisecond)})
+			if err != nil {
+				t.Fatalf("FetchMetadata: %v", err)
+			}
+			if !bytes.Equal(fetched.RawInfo, metadata) {
+				t.Error("fetched metadata differs from the torrent's")
+			}
+		})
+	}
+}
@@ -36,3 +36,23 @@ func ParsePeers(peersData string) ([]Peer, error) {
 
 	return peers, nil
 }
+
+// ParsePeers6 parses compact IPv6 peer information, where each peer is represented
+// by 18 consecutive bytes - 16 bytes for the IPv6 address followed by 2 bytes for the port.
+func ParsePeers6(peersData string) ([]Peer, error) {
+	if len(peersData)%18 != 0 {
+		return nil, fmt.Errorf("invalid peers6 data length: %d (must be multiple of 18)", len(peersData))
+	}
+
+	peers := make([]Peer, 0, len(peersData)/18)
+
+	for i := 0; i < len(peersData); i += 18 {
+		peer := Peer{
+			IP:   net.IP([]byte(peersData[i : i+16])),
+			Port: binary.BigEndian.Uint16([]byte(peersData[i+16 : i+18])),
+		}
+		peers = append(peers, peer)
+	}
+
+	return peers, nil
+}
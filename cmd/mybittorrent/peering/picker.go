@@ -0,0 +1,145 @@
+package peering
+
+import (
+	"math/rand/v2"
+	"sync"
+)
+
+// PiecePicker decides which piece each peer downloads next. It is shared by all
+// peer sessions of a download, so implementations must be safe for concurrent use.
+// Bitfields are in the format of the bitfield message: one bit per piece, high bit first.
+type PiecePicker interface {
+	// PeerHas records that a connected peer has the piece.
+	PeerHas(index int)
+	// PeerHasBitfield records every piece in a connected peer's bitfield.
+	PeerHasBitfield(bitfield []byte)
+	// PeerGone forgets the pieces a disconnected peer had.
+	PeerGone(bitfield []byte)
+	// Pick chooses a piece the peer has that is still missing and nobody is
+	// downloading, and marks it as being downloaded.
+	Pick(bitfield []byte) (index int, ok bool)
+	// Remaining returns how many pieces are neither done nor being downloaded.
+	Remaining() int
+	// Interesting reports whether the peer has a piece that is not done yet.
+	Interesting(bitfield []byte) bool
+	// Done marks a piece as downloaded and verified.
+	Done(index int)
+	// Abort returns a picked piece that was not downloaded so it can be picked again.
+	Abort(index int)
+}
+
+type pieceState uint8
+
+const (
+	pieceMissing pieceState = iota
+	pieceInProgress
+	pieceDone
+)
+
+// RarestFirstPicker picks the missing piece held by the fewest connected peers,
+// breaking ties at random so that peers starting together spread out over the
+// rarest pieces instead of all asking for the same one.
+type RarestFirstPicker struct {
+	mu           sync.Mutex
+	availability []int
+	state        []pieceState
+}
+
+// NewRarestFirstPicker creates a picker for a torrent with numPieces pieces, all missing.
+func NewRarestFirstPicker(numPieces int) *RarestFirstPicker {
+	return &RarestFirstPicker{
+		availability: make([]int, numPieces),
+		state:        make([]pieceState, numPieces),
+	}
+}
+
+func (p *RarestFirstPicker) PeerHas(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if index >= 0 && index < len(p.availability) {
+		p.availability[index]++
+	}
+}
+
+func (p *RarestFirstPicker) PeerHasBitfield(bitfield []byte) {
+	p.addBitfield(bitfield, 1)
+}
+
+func (p *RarestFirstPicker) PeerGone(bitfield []byte) {
+	p.addBitfield(bitfield, -1)
+}
+
+func (p *RarestFirstPicker) addBitfield(bitfield []byte, delta int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.availability {
+		if hasBit(bitfield, i) {
+			p.availability[i] += delta
+		}
+	}
+}
+
+func (p *RarestFirstPicker) Pick(bitfield []byte) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	best, ties := -1, 0
+	for i, state := range p.state {
+		if state != pieceMissing || !hasBit(bitfield, i) {
+			continue
+		}
+		switch {
+		case best < 0 || p.availability[i] < p.availability[best]:
+			best, ties = i, 1
+		case p.availability[i] == p.availability[best]:
+			// Reservoir sampling keeps every tied piece equally likely.
+			ties++
+			if rand.IntN(ties) == 0 {
+				best = i
+			}
+		}
+	}
+	if best < 0 {
+		return 0, false
+	}
+
+	p.state[best] = pieceInProgress
+	return best, true
+}
+
+func (p *RarestFirstPicker) Remaining() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, state := range p.state {
+		if state == pieceMissing {
+			n++
+		}
+	}
+	return n
+}
+
+func (p *RarestFirstPicker) Interesting(bitfield []byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, state := range p.state {
+		if state != pieceDone && hasBit(bitfield, i) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *RarestFirstPicker) Done(index int) {
+	p.setState(index, pieceDone)
+}
+
+func (p *RarestFirstPicker) Abort(index int) {
+	p.setState(index, pieceMissing)
+}
+
+func (p *RarestFirstPicker) setState(index int, state pieceState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state[index] = state
+}
@@ -0,0 +1,180 @@
+package peering
+
+import "testing"
+
+// bitfieldOf returns a bitfield for numPieces pieces with the given pieces set.
+func bitfieldOf(numPieces int, pieces ...int) []byte {
+	bitfield := make([]byte, (numPieces+7)/8)
+	for _, i := range pieces {
+		setBit(bitfield, i)
+	}
+	return bitfield
+}
+
+func TestRarestFirstPickerPick(t *testing.T) {
+	tests := []struct {
+		name   string
+		peers  [][]int // the pieces of each connected peer
+		haves  []int   // pieces announced with have messages afterwards
+		gone   [][]int // the pieces of peers that disconnected
+		done   []int
+		picker []int // the pieces of the peer picking
+		want   []int // the pieces Pick may return
+	}{
+		{
+			name:   "rarest piece",
+			peers:  [][]int{{0, 1, 2, 3}, {0, 1, 3}, {0, 3}},
+			picker: []int{0, 1, 2, 3},
+			want:   []int{2},
+		},
+		{
+			name:   "only pieces the peer has",
+			peers:  [][]int{{0, 1, 2, 3}, {0, 1, 3}, {0, 3}},
+			picker: []int{0, 3},
+			want:   []int{0, 3},
+		},
+		{
+			name:   "have messages count",
+			peers:  [][]int{{0, 1}, {0}},
+			haves:  []int{1, 1, 0, 0, 0},
+			picker: []int{0, 1},
+			want:   []int{1},
+		},
+		{
+			name:   "departed peers no longer count",
+			peers:  [][]int{{0, 1}, {0}, {0}},
+			gone:   [][]int{{0}, {0}},
+			picker: []int{0, 1},
+			want:   []int{0, 1},
+		},
+		{
+			name:   "done pieces are skipped",
+			peers:  [][]int{{0, 1, 2}, {1, 2}},
+			done:   []int{0},
+			picker: []int{0, 1, 2},
+			want:   []int{1, 2},
+		},
+		{
+			name:   "nothing the peer has is missing",
+			peers:  [][]int{{0, 1}},
+			done:   []int{0, 1},
+			picker: []int{0, 1},
+		},
+		{
+			name:   "peer has nothing",
+			peers:  [][]int{{0, 1}},
+			picker: []int{},
+		},
+	}
+	const numPieces = 10
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewRarestFirstPicker(numPieces)
+			for _, pieces := range tt.peers {
+				p.PeerHasBitfield(bitfieldOf(numPieces, pieces...))
+			}
+			for _, i := range tt.haves {
+				p.PeerHas(i)
+			}
+			for _, pieces := range tt.gone {
+				p.PeerGone(bitfieldOf(numPieces, pieces...))
+			}
+			for _, i := range tt.done {
+				p.Pick(bitfieldOf(numPieces, i))
+				p.Done(i)
+			}
+
+			index, ok := p.Pick(bitfieldOf(numPieces, tt.picker...))
+			if len(tt.want) == 0 {
+				if ok {
+					t.Errorf("Pick = %d, want none", index)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("Pick found nothing, want one of %v", tt.want)
+			}
+			found := false
+			for _, want := range tt.want {
+				found = found || index == want
+			}
+			if !found {
+				t.Errorf("Pick = %d, want one of %v", index, tt.want)
+			}
+		})
+	}
+}
+
+func TestRarestFirstPickerAvailability(t *testing.T) {
+	p := NewRarestFirstPicker(10)
+	p.PeerHasBitfield(bitfieldOf(10, 0, 1, 9))
+	p.PeerHasBitfield(bitfieldOf(10, 1, 9))
+	p.PeerHas(9)
+	p.PeerHas(10) // out of range, ignored
+	p.PeerHas(-1)
+	p.PeerGone(bitfieldOf(10, 1))
+
+	want := []int{1, 1, 0, 0, 0, 0, 0, 0, 0, 3}
+	for i, n := range want {
+		if p.availability[i] != n {
+			t.Errorf("availability of piece %d = %d, want %d", i, p.availability[i], n)
+		}
+	}
+}
+
+func TestRarestFirstPickerBreaksTiesAtRandom(t *testing.T) {
+	// Every piece is equally rare, so each should come up first about equally often.
+	const numPieces, rounds = 4, 4000
+	all := bitfieldOf(numPieces, 0, 1, 2, 3)
+	counts := make([]int, numPieces)
+	for range rounds {
+		p := NewRarestFirstPicker(numPieces)
+		p.PeerHasBitfield(all)
+		index, ok := p.Pick(all)
+		if !ok {
+			t.Fatal("Pick found nothing")
+		}
+		counts[index]++
+	}
+	for i, n := range counts {
+		if n < rounds/numPieces/2 {
+			t.Errorf("piece %d picked first %d times out of %d: %v", i, n, rounds, counts)
+		}
+	}
+}
+
+func TestRarestFirstPickerStates(t *testing.T) {
+	p := NewRarestFirstPicker(3)
+	all := bitfieldOf(3, 0, 1, 2)
+	p.PeerHasBitfield(all)
+
+	picked := map[int]bool{}
+	for range 3 {
+		index, ok := p.Pick(all)
+		if !ok || picked[index] {
+			t.Fatalf("Pick = %d, %v after picking %v", index, ok, picked)
+		}
+		picked[index] = true
+	}
+	if _, ok := p.Pick(all); ok {
+		t.Error("Pick returned a piece that is already being downloaded")
+	}
+	if p.Remaining() != 0 || !p.Interesting(all) {
+		t.Errorf("with every piece in progress: Remaining = %d, Interesting = %v", p.Remaining(), p.Interesting(all))
+	}
+
+	// An aborted piece can be picked again, a done one cannot.
+	p.Abort(1)
+	p.Done(0)
+	p.Done(2)
+	if p.Remaining() != 1 {
+		t.Errorf("Remaining = %d, want 1", p.Remaining())
+	}
+	if index, ok := p.Pick(all); !ok || index != 1 {
+		t.Errorf("Pick = %d, %v, want the aborted piece 1", index, ok)
+	}
+	p.Done(1)
+	if p.Interesting(all) {
+		t.Error("a peer is interesting although every piece is done")
+	}
+}
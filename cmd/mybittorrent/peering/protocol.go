@@ -14,16 +14,7 @@ var reservedBytes = []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00}
 // PerformHandshake performs the BitTorrent handshake with a peer
 // Changed from performHandshake to PerformHandshake to make it public
 func PerformHandshake(conn net.Conn, infoHash []byte) ([]byte, error) {
-	// Construct handshake message
-	pstr := "BitTorrent protocol"
-	handshake := make([]byte, 0, 68)
-	handshake = append(handshake, byte(len(pstr)))
-	handshake = append(handshake, pstr...)
-	handshake = append(handshake, reservedBytes...) // Use the new reserved bytes
-	handshake = append(handshake, infoHash...)
-	handshake = append(handshake, []byte(peerID)...)
-
-	if _, err := conn.Write(handshake); err != nil {
+	if _, err := conn.Write(handshakeMessage(infoHash)); err != nil {
 		return nil, err
 	}
 
@@ -39,12 +30,51 @@ func PerformHandshake(conn net.Conn, infoHash []byte) ([]byte, error) {
 	return response, nil
 }
 
-func readMessage(conn net.Conn) (*Message, error) {
+// handshakeMessage builds the handshake we send for infoHash.
+func handshakeMessage(infoHash []byte) []byte {
+	pstr := "BitTorrent protocol"
+	handshake := make([]byte, 0, 68)
+	handshake = append(handshake, byte(len(pstr)))
+	handshake = append(handshake, pstr...)
+	handshake = append(handshake, reservedBytes...) // Use the new reserved bytes
+	handshake = append(handshake, infoHash...)
+	handshake = append(handshake, []byte(peerID)...)
+	return handshake
+}
+
+// AcceptHandshake reads the handshake a connecting peer sends and, if accept agrees to
+// serve the info hash it names, answers with our own.
+// Returns the peer's handshake or an error if it is invalid or was refused.
+func AcceptHandshake(conn net.Conn, accept func(infoHash []byte) bool) ([]byte, error) {
+	request := make([]byte, 68)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return nil, fmt.Errorf("failed to receive handshake: %v", err)
+	}
+	if request[0] != 19 || string(request[1:20]) != "BitTorrent protocol" {
+		return nil, fmt.Errorf("invalid handshake")
+	}
+
+	infoHash := request[28:48]
+	if !accept(infoHash) {
+		return nil, fmt.Errorf("unknown info hash %x", infoHash)
+	}
+	if _, err := conn.Write(handshakeMessage(infoHash)); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// readMessage reads the next message from conn, failing without reading its payload if
+// the peer announces one longer than maxLength bytes.
+func readMessage(conn net.Conn, maxLength int) (*Message, error) {
 	var length uint32
 	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
 		return nil, fmt.Errorf("failed to read message length: %v", err)
 	}
 
+	if int64(length) > int64(maxLength) {
+		return nil, fmt.Errorf("message of %d bytes exceeds the limit of %d", length, maxLength)
+	}
 	if length == 0 {
 		return &Message{Length: length}, nil
 	}
@@ -0,0 +1,271 @@
+package peering
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/storage"
+	"go.uber.org/zap"
+)
+
+// resumeSaveInterval limits how often resume data is saved while pieces complete.
+const resumeSaveInterval = 5 * time.Second
+
+// ResumeData is the fast-resume state of a download, saved next to its output so an
+// interrupted download can continue without downloading or rechecking every piece again.
+type ResumeData struct {
+	InfoHash []byte `bencode:"info-hash"`
+	// Pieces is a bitfield of the pieces that were written and verified.
+	Pieces []byte `bencode:"pieces"`
+	// Files holds the size and modification time of each of the torrent's files when
+	// the data was saved. The bitfield is only trusted while the files still match.
+	Files []ResumeFile `bencode:"files"`
+	// Peers lists the addresses of the peers known when the data was saved.
+	Peers []string `bencode:"peers"`
+}
+
+// ResumeFile records the state of one of a torrent's files on disk.
+type ResumeFile struct {
+	Size  int64 `bencode:"size"`
+	MTime int64 `bencode:"mtime"` // nanoseconds since the Unix epoch
+}
+
+// ResumePath returns where the resume data of a download to outputPath is kept.
+func ResumePath(outputPath string) string {
+	return outputPath + ".resume"
+}
+
+// LoadResumeData reads resume data saved by SaveResumeData.
+func LoadResumeData(path string) (*ResumeData, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var data ResumeData
+	if err := bencode.Unmarshal(raw, &data); err != nil {
+		return nil, fmt.Errorf("failed to parse resume data: %w", err)
+	}
+	return &data, nil
+}
+
+// SaveResumeData writes data to path, replacing any previous file in one step so that
+// an interrupted save leaves the old data in place.
+func SaveResumeData(path string, data *ResumeData) error {
+	raw, err := bencode.Marshal(data)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// NewResumeData returns resume data recording pieces, a bitfield of the verified
+// pieces, along with the current state of the torrent's files under outputPath.
+func NewResumeData(info *bencode.InnerInfo, infoHash []byte, outputPath string, pieces []byte) (*ResumeData, error) {
+	stats, err := storage.StatFiles(info, outputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	data := &ResumeData{
+		InfoHash: infoHash,
+		Pieces:   pieces,
+		Files:    make([]ResumeFile, len(stats)),
+	}
+	for i, stat := range stats {
+		data.Files[i] = ResumeFile{Size: stat.Size, MTime: unixNano(stat.ModTime)}
+	}
+	return data, nil
+}
+
+// matches reports whether every file on disk still has the size and modification
+// time recorded in the resume data.
+func (r *ResumeData) matches(stats []storage.FileStat) bool {
+	if len(r.Files) != len(stats) {
+		return false
+	}
+	for i, stat := range stats {
+		if r.Files[i].Size != stat.Size || r.Files[i].MTime != unixNano(stat.ModTime) {
+			return false
+		}
+	}
+	return true
+}
+
+// unixNano converts a modification time for resume data, recording a missing file's zero time as 0.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// peers parses the recorded peer addresses, skipping any that are malformed.
+func (r *ResumeData) peers() []Peer {
+	var peers []Peer
+	for _, addr := range r.Peers {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(host)
+		n, err := strconv.ParseUint(port, 10, 16)
+		if ip == nil || err != nil {
+			continue
+		}
+		peers = append(peers, Peer{IP: ip, Port: uint16(n)})
+	}
+	return peers
+}
+
+// DownloadResumable downloads the torrent into store like DownloadWith, keeping
+// fast-resume data for outputPath, the path store keeps the torrent's files at.
+//
+// Resume data left by an earlier run is trusted as long as every file still has the
+// size and modification time it recorded and its bitfield is well formed, and the
+// pieces it lists are skipped. Otherwise every piece already on disk is rechecked.
+//
+// Resume data is saved as pieces complete and again when the download stops, including
+// when it is interrupted by Close. Only that final save can be trusted as is: pieces
+// written after a save change the files' modification times, so after a process is
+// killed outright the files never match its last save and the next run rechecks them.
+// This is intended, since the bitfield of such a save would not cover the pieces
+// written after it. The saves made along the way still make that run recheck the
+// files instead of starting over.
+func (c *Client) DownloadResumable(store storage.Storage, outputPath string) error {
+	path := ResumePath(outputPath)
+	resume, err := LoadResumeData(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		zap.L().Debug("Ignoring resume data", zap.String("path", path), zap.Error(err))
+	}
+	if resume != nil && !bytes.Equal(resume.InfoHash, c.infoHash) {
+		zap.L().Debug("Ignoring resume data of another torrent", zap.String("path", path))
+		resume = nil
+	}
+
+	// Opening the torrent may touch the files, so they are checked against the resume data first.
+	var trusted bool
+	if resume != nil {
+		stats, err := storage.StatFiles(&c.info.Info, outputPath)
+		if err != nil {
+			return err
+		}
+		trusted = resume.matches(stats)
+		if err := checkBitfield(resume.Pieces, len(c.info.Info.Pieces)/20); trusted && err != nil {
+			zap.L().Debug("Ignoring malformed resume bitfield", zap.String("path", path), zap.Error(err))
+			trusted = false
+		}
+		c.addPeers(resume.peers())
+	}
+
+	t, err := store.OpenTorrent(&c.info.Info, c.infoHash)
+	if err != nil {
+		return err
+	}
+	rt := &resumeTorrent{
+		Torrent:    t,
+		client:     c,
+		path:       path,
+		outputPath: outputPath,
+		pieces:     make([]byte, (len(c.info.Info.Pieces)/20+7)/8),
+	}
+
+	switch {
+	case trusted:
+		err = rt.restore(resume.Pieces)
+	case resume != nil:
+		zap.L().Debug("Files changed since resume data was saved, rechecking", zap.String("path", path))
+		err = rt.recheck()
+	}
+	if err == nil {
+		err = c.DownloadTo(rt)
+	}
+	return errors.Join(err, rt.Close())
+}
+
+// resumeTorrent records the pieces marked complete in the wrapped torrent and saves
+// them as resume data.
+type resumeTorrent struct {
+	storage.Torrent
+	client     *Client
+	path       string
+	outputPath string
+
+	mu       sync.Mutex
+	pieces   []byte
+	lastSave time.Time
+}
+
+// restore marks the pieces set in bitfield complete without checking them.
+func (r *resumeTorrent) restore(bitfield []byte) error {
+	for i := range len(r.client.info.Info.Pieces) / 20 {
+		if !hasBit(bitfield, i) {
+			continue
+		}
+		if err := r.Torrent.MarkComplete(i); err != nil {
+			return err
+		}
+		setBit(r.pieces, i)
+	}
+	return nil
+}
+
+// recheck hashes every piece stored in the torrent and marks the intact ones complete.
+func (r *resumeTorrent) recheck() error {
+	result, err := storage.Verify(&r.client.info.Info, r.Torrent, 0)
+	if err != nil {
+		return err
+	}
+	return r.restore(result.Bitfield())
+}
+
+// MarkComplete marks the piece complete and saves the resume data if it has not been
+// saved for resumeSaveInterval. Failing to save does not fail the download.
+func (r *resumeTorrent) MarkComplete(index int) error {
+	if err := r.Torrent.MarkComplete(index); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	setBit(r.pieces, index)
+	if time.Since(r.lastSave) >= resumeSaveInterval {
+		if err := r.save(); err != nil {
+			zap.L().Debug("Failed to save resume data", zap.String("path", r.path), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// Close closes the torrent and saves the final resume data.
+func (r *resumeTorrent) Close() error {
+	err := r.Torrent.Close()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return errors.Join(err, r.save())
+}
+
+// save writes the resume data, with the files as they are now. Callers hold r.mu.
+func (r *resumeTorrent) save() error {
+	data, err := NewResumeData(&r.client.info.Info, r.client.infoHash, r.outputPath, r.pieces)
+	if err != nil {
+		return err
+	}
+	for _, peer := range r.client.knownPeers() {
+		data.Peers = append(data.Peers, peer.Addr())
+	}
+
+	r.lastSave = time.Now()
+	return SaveResumeData(r.path, data)
+}
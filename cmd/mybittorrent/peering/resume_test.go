@@ -0,0 +1,164 @@
+package peering
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/storage"
+)
+
+func TestResumeDataRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.bin.resume")
+	saved := &ResumeData{
+		InfoHash: []byte("01234567890123456789"),
+		Pieces:   []byte{0xa0},
+		Files:    []ResumeFile{{Size: 10, MTime: 1700000000123456789}, {}},
+		Peers:    []string{"10.0.0.1:6881", "[::1]:51413"},
+	}
+	if err := SaveResumeData(path, saved); err != nil {
+		t.Fatalf("SaveResumeData: %v", err)
+	}
+	loaded, err := LoadResumeData(path)
+	if err != nil {
+		t.Fatalf("LoadResumeData: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, saved) {
+		t.Errorf("loaded %+v, saved %+v", loaded, saved)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Error("the temporary file was left behind")
+	}
+
+	var addrs []string
+	for _, peer := range loaded.peers() {
+		addrs = append(addrs, peer.Addr())
+	}
+	if !reflect.DeepEqual(addrs, saved.Peers) {
+		t.Errorf("peers = %v, want %v", addrs, saved.Peers)
+	}
+
+	if err := os.WriteFile(path, []byte("d4:info"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadResumeData(path); err == nil {
+		t.Error("LoadResumeData accepted truncated resume data")
+	}
+}
+
+func TestDownloadResumable(t *testing.T) {
+	info, data := testTorrent(4*blockSize, blockSize)
+	numPieces := len(info.Info.Pieces) / 20
+	_, infoHash, _ := bencode.HashInfo(info)
+
+	tests := []struct {
+		name    string
+		pieces  []byte // the bitfield of the resume data
+		touch   bool   // whether the file changes after the resume data is saved
+		trusted bool
+	}{
+		{name: "files unchanged", pieces: []byte{0xf0}, trusted: true},
+		{name: "modification time changed", pieces: []byte{0xf0}, touch: true},
+		{name: "short bitfield", pieces: []byte{}},
+		{name: "long bitfield", pieces: []byte{0xf0, 0x00}},
+		{name: "spare bits set", pieces: []byte{0xff}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outputPath := filepath.Join(t.TempDir(), "data.bin")
+			// Piece 2 on disk is corrupt. Resume data that is trusted claims it anyway,
+			// while a recheck finds it and downloads it again.
+			corrupt := bytes.Clone(data)
+			corrupt[2*blockSize] ^= 0xff
+			if err := os.WriteFile(outputPath, corrupt, 0644); err != nil {
+				t.Fatal(err)
+			}
+			resume, err := NewResumeData(&info.Info, infoHash, outputPath, tt.pieces)
+			if err != nil {
+				t.Fatalf("NewResumeData: %v", err)
+			}
+			if err := SaveResumeData(ResumePath(outputPath), resume); err != nil {
+				t.Fatal(err)
+			}
+			if tt.touch {
+				later := time.Now().Add(time.Minute)
+				if err := os.Chtimes(outputPath, later, later); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			seeder, peer := startSeeder(t, info, data, func(int) bool { return true })
+			c, err := newClient(info, []Peer{peer})
+			if err != nil {
+				t.Fatalf("newClient: %v", err)
+			}
+			defer c.Close()
+			if err := c.DownloadResumable(storage.NewFileStorage(outputPath, storage.Options{}), outputPath); err != nil {
+				t.Fatalf("DownloadResumable: %v", err)
+			}
+
+			got, err := os.ReadFile(outputPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.trusted {
+				if seeder.Uploaded() != 0 || !bytes.Equal(got, corrupt) {
+					t.Errorf("trusted resume data was rechecked: seeder uploaded %d bytes", seeder.Uploaded())
+				}
+			} else {
+				if seeder.Uploaded() != blockSize || !bytes.Equal(got, data) {
+					t.Errorf("seeder uploaded %d bytes, want only the corrupt piece", seeder.Uploaded())
+				}
+			}
+
+			// The download leaves resume data that matches the files and lists every piece.
+			saved, err := LoadResumeData(ResumePath(outputPath))
+			if err != nil {
+				t.Fatalf("LoadResumeData: %v", err)
+			}
+			stats, err := storage.StatFiles(&info.Info, outputPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !saved.matches(stats) || !bytes.Equal(saved.Pieces, []byte{0xf0}) || checkBitfield(saved.Pieces, numPieces) != nil {
+				t.Errorf("saved resume data %+v does not match the finished download", saved)
+			}
+			if len(saved.Peers) == 0 || saved.Peers[0] != peer.Addr() {
+				t.Errorf("saved peers %v, want %s", saved.Peers, peer.Addr())
+			}
+		})
+	}
+}
+
+func TestDownloadResumableIgnoresOtherTorrent(t *testing.T) {
+	info, data := testTorrent(2*blockSize, blockSize)
+	outputPath := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(outputPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	resume, err := NewResumeData(&info.Info, []byte("another info hash..."), outputPath, []byte{0xc0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveResumeData(ResumePath(outputPath), resume); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without resume data of its own torrent, nothing on disk is assumed complete.
+	seeder, peer := startSeeder(t, info, data, func(int) bool { return true })
+	c, err := newClient(info, []Peer{peer})
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	defer c.Close()
+	if err := c.DownloadResumable(storage.NewFileStorage(outputPath, storage.Options{}), outputPath); err != nil {
+		t.Fatalf("DownloadResumable: %v", err)
+	}
+	if seeder.Uploaded() != int64(len(data)) {
+		t.Errorf("seeder uploaded %d bytes, want all %d", seeder.Uploaded(), len(data))
+	}
+}
@@ -0,0 +1,134 @@
+package peering
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
+)
+
+// ScrapeResult holds the swarm statistics a tracker reports for one torrent.
+type ScrapeResult struct {
+	InfoHash  []byte
+	Seeders   int
+	Completed int
+	Leechers  int
+}
+
+type scrapeResponse struct {
+	FailureReason string                `bencode:"failure reason"`
+	Files         map[string]scrapeFile `bencode:"files"`
+}
+
+type scrapeFile struct {
+	Complete   int `bencode:"complete"`
+	Downloaded int `bencode:"downloaded"`
+	Incomplete int `bencode:"incomplete"`
+}
+
+// Scrape asks the tracker behind announceURL for the swarm statistics of each info hash,
+// using a single request where the protocol allows it. HTTP trackers are scraped at the
+// URL derived by ScrapeURL and UDP trackers with the BEP 15 scrape action.
+// Info hashes the tracker does not know about are left out of the results.
+func Scrape(announceURL string, infoHashes [][]byte) ([]ScrapeResult, error) {
+	u, err := url.Parse(announceURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tracker URL %q: %w", announceURL, err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return scrapeHTTP(u, infoHashes)
+	case "udp":
+		return DefaultUDPTracker.Scrape(u, infoHashes)
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme %q", u.Scheme)
+	}
+}
+
+// ScrapeURL derives an HTTP tracker's scrape URL from its announce URL following the
+// convention that the last path segment starting with "announce" is replaced by "scrape".
+// Returns an error for trackers that do not follow the convention and so cannot be scraped.
+func ScrapeURL(announceURL string) (string, error) {
+	u, err := url.Parse(announceURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid tracker URL %q: %w", announceURL, err)
+	}
+
+	scrapeURL, err := scrapeURLFor(u)
+	if err != nil {
+		return "", err
+	}
+	return scrapeURL.String(), nil
+}
+
+func scrapeURLFor(u *url.URL) (*url.URL, error) {
+	// The escaped path is split so that an escaped slash stays part of its segment.
+	dir, last := path.Split(u.EscapedPath())
+	if !strings.HasPrefix(last, "announce") {
+		return nil, fmt.Errorf("tracker %s does not support scrape", u)
+	}
+
+	scrapeURL := *u
+	scrapeURL.RawPath = dir + "scrape" + strings.TrimPrefix(last, "announce")
+	scrapePath, err := url.PathUnescape(scrapeURL.RawPath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tracker URL %s: %w", u, err)
+	}
+	scrapeURL.Path = scrapePath
+	return &scrapeURL, nil
+}
+
+func scrapeHTTP(u *url.URL, infoHashes [][]byte) ([]ScrapeResult, error) {
+	scrapeURL, err := scrapeURLFor(u)
+	if err != nil {
+		return nil, err
+	}
+
+	params := scrapeURL.Query()
+	for _, infoHash := range infoHashes {
+		params.Add("info_hash", string(infoHash))
+	}
+	scrapeURL.RawQuery = params.Encode()
+
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Get(scrapeURL.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to contact tracker: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var scrapeResp scrapeResponse
+	if err := bencode.NewDecoder(resp.Body).Decode(&scrapeResp); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("tracker returned HTTP status %d", resp.StatusCode)
+		}
+		return nil, fmt.Errorf("failed to decode scrape response: %w", err)
+	}
+
+	if scrapeResp.FailureReason != "" {
+		return nil, &TrackerFailureError{Reason: scrapeResp.FailureReason}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tracker returned HTTP status %d", resp.StatusCode)
+	}
+
+	results := make([]ScrapeResult, 0, len(infoHashes))
+	for _, infoHash := range infoHashes {
+		file, ok := scrapeResp.Files[string(infoHash)]
+		if !ok {
+			continue
+		}
+		results = append(results, ScrapeResult{
+			InfoHash:  infoHash,
+			Seeders:   file.Complete,
+			Completed: file.Downloaded,
+			Leechers:  file.Incomplete,
+		})
+	}
+	return results, nil
+}
@@ -0,0 +1,97 @@
+package peering
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
+)
+
+func TestScrapeURL(t *testing.T) {
+	tests := []struct {
+		announce string
+		scrape   string // empty if the tracker cannot be scraped
+	}{
+		{"http://example.com/announce", "http://example.com/scrape"},
+		{"http://example.com/x/announce", "http://example.com/x/scrape"},
+		{"http://example.com/announce.php", "http://example.com/scrape.php"},
+		{"http://example.com/announce?passkey=abc", "http://example.com/scrape?passkey=abc"},
+		{"https://example.com:8443/tracker/announce?x=1&y=2", "https://example.com:8443/tracker/scrape?x=1&y=2"},
+		{"http://example.com/announce%20x", "http://example.com/scrape%20x"},
+		// Only the last segment is looked at, and it must start with announce.
+		{"http://example.com/announce/x", ""},
+		{"http://example.com/a", ""},
+		{"http://example.com/x%2Fannounce", ""}, // one segment, "x/announce"
+		{"http://example.com/a%2Fb/announce", "http://example.com/a%2Fb/scrape"},
+		{"http://example.com/announce/", ""},
+		{"http://example.com/", ""},
+		{"http://example.com", ""},
+		{"http://example.com/myannounce", ""},
+		{"://bad", ""},
+	}
+	for _, tt := range tests {
+		got, err := ScrapeURL(tt.announce)
+		switch {
+		case tt.scrape == "" && err == nil:
+			t.Errorf("ScrapeURL(%q) = %q, want an error", tt.announce, got)
+		case tt.scrape != "" && (err != nil || got != tt.scrape):
+			t.Errorf("ScrapeURL(%q) = %q, %v, want %q", tt.announce, got, err, tt.scrape)
+		}
+	}
+}
+
+func TestScrapeHTTP(t *testing.T) {
+	first := bytes.Repeat([]byte{1}, 20)
+	second := bytes.Repeat([]byte{2}, 20)
+	unknown := bytes.Repeat([]byte{3}, 20)
+
+	var paths []string
+	var asked [][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		asked = append(asked, r.URL.Query()["info_hash"])
+		if r.URL.Query().Get("passkey") != "abc" {
+			body, _ := bencode.Marshal(map[string]any{"failure reason": "bad passkey"})
+			w.Write(body)
+			return
+		}
+		body, _ := bencode.Marshal(map[string]any{"files": map[string]any{
+			string(first):  map[string]int{"complete": 5, "downloaded": 50, "incomplete": 2},
+			string(second): map[string]int{"complete": 1, "downloaded": 3, "incomplete": 7},
+		}})
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	results, err := Scrape(server.URL+"/announce?passkey=abc", [][]byte{second, unknown, first})
+	if err != nil {
+		t.Fatalf("Scrape: %v", err)
+	}
+	want := []ScrapeResult{
+		{InfoHash: second, Seeders: 1, Completed: 3, Leechers: 7},
+		{InfoHash: first, Seeders: 5, Completed: 50, Leechers: 2},
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("Scrape = %+v, want %+v", results, want)
+	}
+	// All info hashes go in a single request to the scrape URL.
+	if len(paths) != 1 || paths[0] != "/scrape" {
+		t.Errorf("tracker got requests for %v, want one for /scrape", paths)
+	}
+	if wantAsked := []string{string(second), string(unknown), string(first)}; !reflect.DeepEqual(asked[0], wantAsked) {
+		t.Errorf("tracker was asked for %q, want %q", asked[0], wantAsked)
+	}
+
+	_, err = Scrape(server.URL+"/announce?passkey=wrong", [][]byte{first})
+	var failure *TrackerFailureError
+	if !errors.As(err, &failure) || failure.Reason != "bad passkey" {
+		t.Errorf("Scrape with a failure reason returned %v", err)
+	}
+	if _, err := Scrape(server.URL+"/tracker", [][]byte{first}); err == nil {
+		t.Error("Scrape succeeded for a tracker without a scrape URL")
+	}
+}
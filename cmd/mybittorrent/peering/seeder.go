@@ -0,0 +1,358 @@
+package peering
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/storage"
+	"go.uber.org/zap"
+)
+
+// Seeder accepts connections from peers and serves the pieces of the torrents it holds.
+// Upload slots are shared among all of its peers.
+type Seeder struct {
+	// Choker assigns the upload slots, ranking peers by how fast we upload to them.
+	// It may be replaced before Serve is called.
+	Choker Choker
+
+	listener net.Listener
+	group    *chokeGroup
+
+	mu       sync.Mutex
+	torrents map[string]*seedTorrent
+	conns    map[net.Conn]struct{}
+
+	uploaded atomic.Int64
+	closed   chan struct{}
+	wg       sync.WaitGroup
+}
+
+// seedTorrent is a torrent served by a Seeder.
+type seedTorrent struct {
+	info     *bencode.InnerInfo
+	storage  storage.Torrent
+	metadata []byte // the info dictionary served to peers with ut_metadata, or nil
+
+	// handOff, when set, takes over the torrent's peers instead of the seeder serving
+	// them. It returns once it is done with the connection.
+	handOff func(conn net.Conn, extended bool) error
+}
+
+// Listen creates a seeder listening on addr, such as ":6881".
+// Connections are accepted once Serve is called.
+func Listen(addr string) (*Seeder, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+	return &Seeder{
+		Choker:   NewTitForTatChoker(DefaultUploadSlots),
+		listener: listener,
+		torrents: make(map[string]*seedTorrent),
+		conns:    make(map[net.Conn]struct{}),
+		closed:   make(chan struct{}),
+	}, nil
+}
+
+// Addr returns the address the seeder listens on.
+func (s *Seeder) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Uploaded returns the number of block bytes sent to peers.
+func (s *Seeder) Uploaded() int64 {
+	return s.uploaded.Load()
+}
+
+// Add starts serving the pieces of the torrent that t reports complete to peers that
+// connect with infoHash. The caller keeps ownership of t. Peers can fetch the info
+// dictionary with ut_metadata, served from info.RawInfo when it is set.
+func (s *Seeder) Add(info *bencode.TorrentInfo, infoHash []byte, t storage.Torrent) {
+	metadata := infoMetadata(info, infoHash)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.torrents[string(infoHash)] = &seedTorrent{info: &info.Info, storage: t, metadata: metadata}
+}
+
+// handOff passes the connections of peers that connect with infoHash to handle, after
+// the handshake, until Remove is called. handle returns once it is done with the
+// connection, which the seeder then closes.
+func (s *Seeder) handOff(infoHash []byte, handle func(conn net.Conn, extended bool) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.torrents[string(infoHash)] = &seedTorrent{handOff: handle}
+}
+
+// Remove stops accepting connections for infoHash. Peers already connected stay
+// connected until they leave or the seeder is closed.
+func (s *Seeder) Remove(infoHash []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.torrents, string(infoHash))
+}
+
+// Serve accepts connections until the seeder is closed, serving each peer on its own goroutine.
+// Returns nil once Close is called, or the error that stopped the listener.
+func (s *Seeder) Serve() error {
+	s.group = newChokeGroup(s.Choker, true)
+	go s.group.run(s.closed)
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.closed:
+				return nil
+			default:
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		select {
+		case <-s.closed:
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		default:
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			err := s.serveConn(conn)
+			zap.L().Debug("Inbound peer disconnected",
+				zap.String("peer", conn.RemoteAddr().String()),
+				zap.Error(err))
+
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+// Close stops accepting connections, disconnects every peer and waits for their
+// sessions to end.
+func (s *Seeder) Close() error {
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+		s.mu.Unlock()
+		return nil
+	default:
+		close(s.closed)
+	}
+	err := s.listener.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// serveConn accepts the peer's handshake and serves its requests until it disconnects.
+func (s *Seeder) serveConn(conn net.Conn) error {
+	var torrent *seedTorrent
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	request, err := AcceptHandshake(conn, func(infoHash []byte) bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		torrent = s.torrents[string(infoHash)]
+		return torrent != nil
+	})
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	if torrent.handOff != nil {
+		return torrent.handOff(conn, SupportsExtensions(request))
+	}
+	u := newUploadSession(s, torrent, conn, SupportsExtensions(request))
+	defer u.Close()
+	return u.run()
+}
+
+// uploadSession serves the block requests of a peer that connected to us.
+// Like peerSession, it handles the peer's messages as events as they arrive.
+type uploadSession struct {
+	*uploader
+
+	seeder  *Seeder
+	torrent *seedTorrent
+	conn    net.Conn
+	ext     *Extensions // nil when the peer does not support the extension protocol
+
+	lastSent     time.Time
+	lastReceived time.Time
+
+	incoming  chan PeerMessage
+	readErr   error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newUploadSession(s *Seeder, torrent *seedTorrent, conn net.Conn, extended bool) *uploadSession {
+	now := time.Now()
+	u := &uploadSession{
+		uploader:     newUploader(conn.RemoteAddr().String(), torrent.info, torrent.storage),
+		seeder:       s,
+		torrent:      torrent,
+		conn:         conn,
+		lastSent:     now,
+		lastReceived: now,
+		incoming:     make(chan PeerMessage, 16),
+		closed:       make(chan struct{}),
+	}
+	if extended {
+		u.ext = NewExtensions(u.send)
+		u.ext.Port = s.listener.Addr().(*net.TCPAddr).Port
+		u.ext.MaxRequests = maxQueuedRequests
+		if torrent.metadata != nil {
+			serveMetadata(u.ext, torrent.metadata)
+		}
+	}
+	go u.readLoop()
+	return u
+}
+
+// Close stops reading the peer's messages. The seeder closes the connection.
+func (u *uploadSession) Close() error {
+	u.closeOnce.Do(func() {
+		close(u.closed)
+	})
+	return nil
+}
+
+// readLoop delivers messages from the peer until the connection fails or the session is closed.
+func (u *uploadSession) readLoop() {
+	defer close(u.incoming)
+	for {
+		msg, err := readPeerMessage(u.conn, maxMessageLength(len(u.torrent.info.Pieces)/20))
+		if err != nil {
+			u.readErr = err
+			return
+		}
+		select {
+		case u.incoming <- msg:
+		case <-u.closed:
+			return
+		}
+	}
+}
+
+// send writes a message, failing if the peer stops reading for longer than a handshake timeout.
+func (u *uploadSession) send(m PeerMessage) error {
+	u.conn.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+	if err := SendPeerMessage(u.conn, m); err != nil {
+		return err
+	}
+	u.lastSent = time.Now()
+	return nil
+}
+
+// run sends the pieces we have and then answers the peer's requests whenever the
+// seeder's choker gives it an upload slot, one block at a time so that cancels and
+// other messages arriving in between are still handled.
+func (u *uploadSession) run() error {
+	if bitfield := u.torrent.bitfield(); bitfield != nil {
+		if err := u.send(Bitfield{Bits: bitfield}); err != nil {
+			return fmt.Errorf("failed to send bitfield: %v", err)
+		}
+	}
+	if u.ext != nil {
+		if err := u.ext.SendHandshake(remoteIP(u.conn)); err != nil {
+			return err
+		}
+	}
+
+	u.seeder.group.add(u.uploader)
+	defer u.seeder.group.remove(u.uploader)
+
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-u.seeder.closed:
+			return nil
+
+		case msg, ok := <-u.incoming:
+			if !ok {
+				return fmt.Errorf("connection lost: %v", u.readErr)
+			}
+			u.lastReceived = time.Now()
+			if err := u.handle(msg); err != nil {
+				return err
+			}
+
+		case choke := <-u.choke:
+			if msg := u.applyChoke(choke); msg != nil {
+				if err := u.send(msg); err != nil {
+					return fmt.Errorf("failed to send choke message: %v", err)
+				}
+			}
+
+		case <-u.serving():
+			piece, err := u.nextBlock()
+			if err != nil {
+				return err
+			}
+			if err := u.send(piece); err != nil {
+				return fmt.Errorf("failed to send piece message: %v", err)
+			}
+			u.uploaded.Add(int64(len(piece.Block)))
+			u.seeder.uploaded.Add(int64(len(piece.Block)))
+
+		case <-ticker.C:
+			if time.Since(u.lastReceived) > idleTimeout {
+				return fmt.Errorf("peer sent nothing for %v", idleTimeout)
+			}
+			if time.Since(u.lastSent) >= keepAliveInterval {
+				if err := u.send(KeepAlive{}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// handle applies one message from the peer to the session state.
+func (u *uploadSession) handle(msg PeerMessage) error {
+	switch m := msg.(type) {
+	case Interested:
+		u.setInterest(true)
+	case NotInterested:
+		u.setInterest(false)
+	case Request:
+		return u.queueRequest(m)
+	case Cancel:
+		u.cancelRequest(m)
+	case Extended:
+		if u.ext != nil {
+			return u.ext.Handle(m)
+		}
+	}
+	// We only upload on this connection, so the rest needs no action.
+	return nil
+}
+
+// bitfield returns the pieces the storage reports complete, or nil if there are none.
+func (t *seedTorrent) bitfield() []byte {
+	return completedBitfield(t.storage, len(t.info.Pieces)/20)
+}
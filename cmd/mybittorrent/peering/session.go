@@ -0,0 +1,584 @@
+package peering
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// blockSize is the length of every block request except a piece's last one.
+	blockSize = 16384
+	// handshakeTimeout bounds connecting and exchanging handshakes.
+	handshakeTimeout = 30 * time.Second
+	// maxRequestTimeouts is how many times a block may time out before the peer is given up on.
+	maxRequestTimeouts = 2
+	// keepAliveInterval is how long the connection may go without us sending anything.
+	keepAliveInterval = 2 * time.Minute
+	// idleTimeout is how long the peer may go without sending anything, keep-alives included.
+	idleTimeout = 3 * time.Minute
+	// chokeTimeout is how long a peer may keep us choked while we want its pieces.
+	chokeTimeout = time.Minute
+)
+
+// peerSession is a connection to one peer that stays open across pieces.
+// Messages from the peer are handled as events as they arrive, in any order the
+// protocol allows: the session tracks the pieces the peer has and the choke and
+// interest state on both sides, and keeps a pipeline of block requests
+// outstanding across the pieces it is downloading while the peer lets it.
+// Its uploader answers the peer's requests in turn while the choker lets it.
+type peerSession struct {
+	*uploader
+
+	client *Client
+	peer   Peer
+	conn   net.Conn
+	t      *transfer
+
+	bitfield []byte
+	extended bool        // the peer's handshake announced the extension protocol
+	ext      *Extensions // set once the transfer starts
+
+	peerChoking  bool // the peer is choking us
+	amInterested bool // we told the peer we want its pieces
+
+	chokedSince  time.Time
+	lastSent     time.Time
+	lastReceived time.Time
+	lastBlock    time.Time // when the peer last sent a requested block, for snub detection
+
+	incoming  chan PeerMessage
+	readErr   error
+	closed    chan struct{}
+	closeOnce sync.Once
+	wake      chan struct{}
+
+	active     []*pieceProgress
+	inFlight   map[blockKey]outstandingRequest
+	timeouts   map[blockKey]int
+	queueDepth int
+
+	rateBytes int
+	rateStart time.Time
+
+	delivered int // pieces verified over this session
+	havesSent int // completed pieces of the transfer announced to the peer
+}
+
+type blockKey struct {
+	index int
+	begin int
+}
+
+type outstandingRequest struct {
+	length int
+	sent   time.Time
+}
+
+// newPeerSession connects to peer, performs the handshake and starts reading
+// the peer's messages. Once done is closed, the connection is closed as well, which
+// ends the session promptly even while it waits on the peer.
+func newPeerSession(c *Client, peer Peer, done <-chan struct{}) (*peerSession, error) {
+	conn, err := net.DialTimeout("tcp", peer.Addr(), 3*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to peer: %v", err)
+	}
+
+	closed := closeOnDone(conn, done)
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	resp, err := PerformHandshake(conn, c.infoHash)
+	if err != nil {
+		close(closed)
+		conn.Close()
+		return nil, err
+	}
+	// From here on stalls are detected by request and idle timeouts instead.
+	conn.SetDeadline(time.Time{})
+
+	return startPeerSession(c, peer, conn, SupportsExtensions(resp), closed), nil
+}
+
+// acceptPeerSession starts a session on a connection from a peer that connected to us
+// and has exchanged handshakes. Like a session we open, it ends once done is closed.
+func acceptPeerSession(c *Client, conn net.Conn, extended bool, done <-chan struct{}) *peerSession {
+	addr, _ := conn.RemoteAddr().(*net.TCPAddr)
+	peer := Peer{}
+	if addr != nil {
+		peer = Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	}
+	return startPeerSession(c, peer, conn, extended, closeOnDone(conn, done))
+}
+
+// closeOnDone closes conn once done is closed, unless the returned channel is closed first.
+func closeOnDone(conn net.Conn, done <-chan struct{}) chan struct{} {
+	closed := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+			conn.Close()
+		case <-closed:
+		}
+	}()
+	return closed
+}
+
+// startPeerSession starts reading the messages of a peer we have exchanged handshakes
+// with. Closing closed stops the session.
+func startPeerSession(c *Client, peer Peer, conn net.Conn, extended bool, closed chan struct{}) *peerSession {
+	now := time.Now()
+	s := &peerSession{
+		client:       c,
+		peer:         peer,
+		conn:         conn,
+		bitfield:     make([]byte, (len(c.info.Info.Pieces)/20+7)/8),
+		extended:     extended,
+		peerChoking:  true,
+		chokedSince:  now,
+		lastSent:     now,
+		lastReceived: now,
+		incoming:     make(chan PeerMessage, 16),
+		closed:       closed,
+		wake:         make(chan struct{}, 1),
+		inFlight:     make(map[blockKey]outstandingRequest),
+		timeouts:     make(map[blockKey]int),
+		queueDepth:   c.MinRequests,
+		rateStart:    now,
+	}
+
+	go s.readLoop()
+	return s
+}
+
+// Close closes the connection to the peer.
+func (s *peerSession) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.conn.Close()
+	})
+	return err
+}
+
+// readLoop delivers messages from the peer until the connection fails or the session is closed.
+func (s *peerSession) readLoop() {
+	defer close(s.incoming)
+	for {
+		msg, err := readPeerMessage(s.conn, maxMessageLength(len(s.client.info.Info.Pieces)/20))
+		if err != nil {
+			s.readErr = err
+			return
+		}
+		select {
+		case s.incoming <- msg:
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// send writes a message, failing if the peer stops reading for longer than a request timeout.
+func (s *peerSession) send(m PeerMessage) error {
+	s.conn.SetWriteDeadline(time.Now().Add(s.client.RequestTimeout))
+	if err := SendPeerMessage(s.conn, m); err != nil {
+		return err
+	}
+	s.lastSent = time.Now()
+	return nil
+}
+
+// notify wakes the session to cancel requests for blocks another peer delivered first
+// and to announce newly stored pieces.
+func (s *peerSession) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run downloads pieces of the transfer until it is done, reporting each one on its results,
+// and uploads the pieces the transfer has stored while its choke group lets it.
+// The session stops at the first failure, since the connection may be in an unknown state
+// and the peer may be sending bad data, and hands the pieces no other session is working
+// on back to the picker.
+func (s *peerSession) run(t *transfer) error {
+	err := s.download(t)
+	for _, p := range t.leave(s) {
+		t.picker.Abort(p.index)
+	}
+	return err
+}
+
+// download handles the peer's messages as they arrive and, while the peer has us
+// unchoked, keeps up to queueDepth block requests in flight, starting pieces chosen
+// by the picker as the current ones run out of unrequested blocks.
+// It returns nil once the transfer is done.
+func (s *peerSession) download(t *transfer) error {
+	s.t = t
+	s.uploader = newUploader(s.peer.Addr(), &s.client.info.Info, t.storage)
+	s.ext = NewExtensions(s.send)
+	s.ext.Port = s.client.listenPort()
+	s.ext.MaxRequests = maxQueuedRequests
+	if s.client.metadata != nil {
+		serveMetadata(s.ext, s.client.metadata)
+	}
+	defer func() {
+		t.picker.PeerGone(s.bitfield)
+	}()
+
+	if bitfield := t.register(s); bitfield != nil {
+		if err := s.send(Bitfield{Bits: bitfield}); err != nil {
+			return fmt.Errorf("failed to send bitfield: %v", err)
+		}
+	}
+	if s.extended {
+		if err := s.ext.SendHandshake(s.peer.IP); err != nil {
+			return err
+		}
+	}
+	if t.storage != nil {
+		t.group.add(s.uploader)
+		defer t.group.remove(s.uploader)
+	}
+
+	requestTimer := time.NewTimer(s.client.RequestTimeout)
+	defer requestTimer.Stop()
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		if !s.peerChoking {
+			if err := s.fillRequests(); err != nil {
+				return err
+			}
+		}
+
+		resetTimer(requestTimer, s.nextTimeout())
+		select {
+		case <-t.done:
+			return nil
+
+		case msg, ok := <-s.incoming:
+			if !ok {
+				return fmt.Errorf("connection lost: %v", s.readErr)
+			}
+			s.lastReceived = time.Now()
+			p, err := s.handle(msg)
+			if err != nil {
+				return err
+			}
+			if p == nil {
+				continue
+			}
+
+			t.prune(s)
+			if !s.client.checkPiece(p.index, p.data) {
+				t.picker.Abort(p.index)
+				return fmt.Errorf("hash mismatch for piece %d", p.index)
+			}
+			t.picker.Done(p.index)
+			s.delivered++
+			select {
+			case t.results <- pieceResult{index: p.index, data: p.data}:
+			case <-t.done:
+				return nil
+			}
+			if err := s.updateInterest(); err != nil {
+				return err
+			}
+
+		case <-s.wake:
+			if err := s.cancelUnneeded(); err != nil {
+				return err
+			}
+			if err := s.sendHaves(); err != nil {
+				return err
+			}
+
+		case choke := <-s.choke:
+			if msg := s.applyChoke(choke); msg != nil {
+				if err := s.send(msg); err != nil {
+					return fmt.Errorf("failed to send choke message: %v", err)
+				}
+			}
+
+		case <-s.serving():
+			piece, err := s.nextBlock()
+			if err != nil {
+				return err
+			}
+			if err := s.send(piece); err != nil {
+				return fmt.Errorf("failed to send piece message: %v", err)
+			}
+			s.uploaded.Add(int64(len(piece.Block)))
+			s.client.uploaded.Add(int64(len(piece.Block)))
+
+		case <-requestTimer.C:
+			if err := s.expireRequests(); err != nil {
+				return err
+			}
+
+		case <-ticker.C:
+			if err := s.checkIdle(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// handle applies one message from the peer to the session state and returns the
+// piece it completed, if any.
+func (s *peerSession) handle(msg PeerMessage) (*pieceProgress, error) {
+	switch m := msg.(type) {
+	case Choke:
+		s.choked()
+	case Unchoke:
+		if s.peerChoking {
+			s.lastBlock = time.Now()
+		}
+		s.peerChoking = false
+	case Interested:
+		s.setInterest(true)
+	case NotInterested:
+		s.setInterest(false)
+	case Request:
+		return nil, s.queueRequest(m)
+	case Cancel:
+		s.cancelRequest(m)
+	case Have:
+		if numPieces := len(s.client.info.Info.Pieces) / 20; m.Index < 0 || m.Index >= numPieces {
+			return nil, fmt.Errorf("have for piece %d out of range, torrent has %d pieces", m.Index, numPieces)
+		}
+		if !hasBit(s.bitfield, m.Index) {
+			setBit(s.bitfield, m.Index)
+			s.t.picker.PeerHas(m.Index)
+		}
+		return nil, s.updateInterest()
+	case Bitfield:
+		if err := checkBitfield(m.Bits, len(s.client.info.Info.Pieces)/20); err != nil {
+			return nil, err
+		}
+		s.t.picker.PeerGone(s.bitfield)
+		s.bitfield = m.Bits
+		s.t.picker.PeerHasBitfield(s.bitfield)
+		return nil, s.updateInterest()
+	case Piece:
+		return s.receiveBlock(m)
+	case Extended:
+		return nil, s.ext.Handle(m)
+	}
+	// Keep-alives need no action.
+	return nil, nil
+}
+
+// choked handles a choke: the peer discards our outstanding requests, so their blocks
+// go back to be requested again once we are unchoked.
+func (s *peerSession) choked() {
+	if !s.peerChoking {
+		s.chokedSince = time.Now()
+	}
+	s.peerChoking = true
+
+	for key := range s.inFlight {
+		s.t.release(key.index, key.begin)
+	}
+	clear(s.inFlight)
+}
+
+// updateInterest tells the peer whether it has pieces we still need whenever that changes.
+func (s *peerSession) updateInterest() error {
+	interested := s.t.picker.Interesting(s.bitfield)
+	if interested == s.amInterested {
+		return nil
+	}
+
+	var msg PeerMessage = NotInterested{}
+	if interested {
+		msg = Interested{}
+		s.chokedSince = time.Now()
+	}
+	if err := s.send(msg); err != nil {
+		return fmt.Errorf("failed to send interest message: %v", err)
+	}
+	s.amInterested = interested
+	return nil
+}
+
+// checkIdle sends a keep-alive when we have been quiet for a while and gives up on a
+// peer that has gone silent or keeps us choked for too long while we want its pieces.
+// It also tells the choke group whether the peer is snubbing us, leaving requests
+// unanswered for snubTimeout while it has us unchoked.
+func (s *peerSession) checkIdle() error {
+	s.snubbed.Store(!s.peerChoking && len(s.inFlight) > 0 && time.Since(s.lastBlock) > snubTimeout)
+
+	if time.Since(s.lastReceived) > idleTimeout {
+		return fmt.Errorf("peer sent nothing for %v", idleTimeout)
+	}
+	if s.peerChoking && s.amInterested && time.Since(s.chokedSince) > chokeTimeout {
+		return fmt.Errorf("peer kept us choked for %v", chokeTimeout)
+	}
+	if time.Since(s.lastSent) >= keepAliveInterval {
+		if err := s.send(KeepAlive{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fillRequests sends block requests until queueDepth are in flight, or as many as the
+// peer's extended handshake says it accepts, if fewer.
+func (s *peerSession) fillRequests() error {
+	limit := s.queueDepth
+	if hs := s.ext.PeerHandshake(); hs != nil && hs.Reqq > 0 {
+		limit = min(limit, hs.Reqq)
+	}
+	for len(s.inFlight) < limit {
+		p, blk, ok := s.t.nextRequest(s)
+		if !ok {
+			return nil
+		}
+		if err := s.send(Request{Index: p.index, Begin: blk.Begin, Length: blk.Length}); err != nil {
+			// The request was counted but never made, and is not in flight for leave to return.
+			s.t.release(p.index, blk.Begin)
+			return fmt.Errorf("failed to send request message: %v", err)
+		}
+		if len(s.inFlight) == 0 {
+			// The snub timer runs from the first request that is waiting for an answer.
+			s.lastBlock = time.Now()
+		}
+		s.inFlight[blockKey{p.index, blk.Begin}] = outstandingRequest{length: blk.Length, sent: time.Now()}
+	}
+	return nil
+}
+
+func (s *peerSession) hasRequested(index, begin int) bool {
+	_, ok := s.inFlight[blockKey{index, begin}]
+	return ok
+}
+
+// receiveBlock stores a block and returns its piece if that was the last block missing.
+// Blocks that were not requested, or whose request was cancelled, are discarded, and
+// blocks another peer delivered first are counted as wasted.
+func (s *peerSession) receiveBlock(m Piece) (*pieceProgress, error) {
+	c := s.client
+	c.downloaded.Add(int64(len(m.Block)))
+
+	key := blockKey{index: m.Index, begin: m.Begin}
+	req, ok := s.inFlight[key]
+	if !ok {
+		c.wasted.Add(int64(len(m.Block)))
+		return nil, nil
+	}
+	if len(m.Block) != req.length {
+		return nil, fmt.Errorf("block at offset %d of piece %d has length %d, requested %d", m.Begin, m.Index, len(m.Block), req.length)
+	}
+	delete(s.inFlight, key)
+	s.recordDownload(len(m.Block))
+	s.lastBlock = time.Now()
+	s.downloaded.Add(int64(len(m.Block)))
+
+	p, duplicate := s.t.receive(s, m.Index, m.Begin, m.Block)
+	if duplicate {
+		c.wasted.Add(int64(len(m.Block)))
+	}
+	return p, nil
+}
+
+// sendHaves announces the pieces the transfer stored since the last call, except ones
+// the peer already has.
+func (s *peerSession) sendHaves() error {
+	for _, index := range s.t.newHaves(s) {
+		if hasBit(s.bitfield, index) {
+			continue
+		}
+		if err := s.send(Have{Index: index}); err != nil {
+			return fmt.Errorf("failed to send have message: %v", err)
+		}
+	}
+	return nil
+}
+
+// cancelUnneeded cancels requests for blocks that other peers delivered first and
+// forgets pieces that are finished.
+func (s *peerSession) cancelUnneeded() error {
+	for key, req := range s.inFlight {
+		if s.t.needed(key.index, key.begin) {
+			continue
+		}
+		if err := s.send(Cancel{Index: key.index, Begin: key.begin, Length: req.length}); err != nil {
+			return fmt.Errorf("failed to send cancel message: %v", err)
+		}
+		s.t.release(key.index, key.begin)
+		delete(s.inFlight, key)
+	}
+	s.t.prune(s)
+	return nil
+}
+
+// expireRequests cancels requests that went unanswered for longer than the request timeout
+// and queues their blocks to be requested again, shrinking the pipeline since the peer
+// is evidently slower than it was sized for.
+func (s *peerSession) expireRequests() error {
+	now := time.Now()
+	expired := false
+	for key, req := range s.inFlight {
+		if now.Sub(req.sent) < s.client.RequestTimeout {
+			continue
+		}
+
+		if err := s.send(Cancel{Index: key.index, Begin: key.begin, Length: req.length}); err != nil {
+			return fmt.Errorf("failed to send cancel message: %v", err)
+		}
+		delete(s.inFlight, key)
+
+		s.t.release(key.index, key.begin)
+
+		s.timeouts[key]++
+		if s.timeouts[key] >= maxRequestTimeouts {
+			return fmt.Errorf("peer did not answer request for piece %d at offset %d", key.index, key.begin)
+		}
+		expired = true
+	}
+
+	if expired {
+		s.queueDepth = max(s.client.MinRequests, s.queueDepth/2)
+	}
+	return nil
+}
+
+// nextTimeout returns how long until the oldest outstanding request times out.
+func (s *peerSession) nextTimeout() time.Duration {
+	timeout := s.client.RequestTimeout
+	for _, req := range s.inFlight {
+		timeout = min(timeout, time.Until(req.sent.Add(s.client.RequestTimeout)))
+	}
+	return max(timeout, 0)
+}
+
+// recordDownload measures the peer's download rate and sizes the request queue to
+// cover RequestQueueTime of transfer at that rate, as libtorrent does.
+func (s *peerSession) recordDownload(n int) {
+	s.rateBytes += n
+	elapsed := time.Since(s.rateStart)
+	if elapsed < time.Second {
+		return
+	}
+
+	rate := float64(s.rateBytes) / elapsed.Seconds()
+	s.rateBytes = 0
+	s.rateStart = time.Now()
+
+	c := s.client
+	depth := int(rate * c.RequestQueueTime.Seconds() / blockSize)
+	s.queueDepth = min(max(depth, c.MinRequests), c.MaxRequests)
+}
+
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+}
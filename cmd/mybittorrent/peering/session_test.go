@@ -0,0 +1,53 @@
+package peering
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFillRequestsSendFailure(t *testing.T) {
+	info, _ := testTorrent(2*blockSize, 2*blockSize)
+	c := &Client{info: info, RequestTimeout: time.Second}
+	picker := NewRarestFirstPicker(1)
+	tr := newTransfer(c, picker, nil, nil, nil)
+
+	// The peer is gone, so the first request cannot be sent.
+	conn, peer := net.Pipe()
+	peer.Close()
+	defer conn.Close()
+	s := &peerSession{
+		client:     c,
+		conn:       conn,
+		t:          tr,
+		bitfield:   []byte{0x80},
+		inFlight:   make(map[blockKey]outstandingRequest),
+		timeouts:   make(map[blockKey]int),
+		queueDepth: 4,
+	}
+	s.ext = NewExtensions(s.send)
+	picker.PeerHasBitfield(s.bitfield)
+
+	if err := s.fillRequests(); err == nil {
+		t.Fatal("fillRequests succeeded without a peer to send to")
+	}
+	p := tr.pieces[0]
+	if p == nil {
+		t.Fatal("no piece was started")
+	}
+	for i, n := range p.requested {
+		if n != 0 {
+			t.Errorf("block %d counted %d requests after the request failed", i, n)
+		}
+	}
+	if len(s.inFlight) != 0 {
+		t.Errorf("%d requests in flight after the request failed", len(s.inFlight))
+	}
+
+	// Another session in endgame on the same piece still sees its blocks as unrequested.
+	other := &peerSession{client: c, t: tr, bitfield: []byte{0x80}, inFlight: make(map[blockKey]outstandingRequest)}
+	tr.join(other, p)
+	if got, blk, ok := tr.nextRequest(other); !ok || got != p || blk.Begin != 0 {
+		t.Errorf("nextRequest = block at %d, %v, want block 0 of piece 0", blk.Begin, ok)
+	}
+}
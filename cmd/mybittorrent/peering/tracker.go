@@ -1,73 +1,184 @@
 package peering
 
 import (
-	"encoding/binary"
 	"fmt"
-	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
 )
 
+// GetPeersFromTracker announces infoHash to a single tracker and returns the peers it knows about.
+// It is used for magnet links, where the torrent's length is not known yet.
 func GetPeersFromTracker(trackerURL string, infoHash []byte) ([]Peer, error) {
-	params := url.Values{
-		"info_hash":  []string{string(infoHash)},
-		"peer_id":    []string{peerID},
-		"port":       []string{"6881"},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
-		"left":       []string{"100"},
-		"compact":    []string{"1"},
+	trackerReq := &TrackerRequest{
+		InfoHash: infoHash,
+		PeerID:   peerID,
+		Port:     6881,
+		// The real length is unknown until the metadata has been fetched, and
+		// some trackers refuse to return peers to a client that reports left=0.
+		Left:    100,
+		Compact: 1,
 	}
 
-	fullURL := fmt.Sprintf("%s?%s", trackerURL, params.Encode())
+	trackerResp, err := announce(trackerURL, trackerReq)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(trackerResp.Peers) == 0 {
+		return nil, fmt.Errorf("no peers found")
+	}
+
+	return trackerResp.Peers, nil
+}
+
+// announce sends req to the tracker at trackerURL, picking the protocol from the URL scheme.
+func announce(trackerURL string, req *TrackerRequest) (*TrackerResponse, error) {
+	u, err := url.Parse(trackerURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tracker URL %q: %w", trackerURL, err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return announceHTTP(u, req)
+	case "udp":
+		return DefaultUDPTracker.Announce(u, req)
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme %q", u.Scheme)
+	}
+}
+
+// announceHTTP performs an HTTP announce as described in BEP 3.
+// Query parameters already present in the tracker URL, such as passkeys, are preserved.
+func announceHTTP(u *url.URL, req *TrackerRequest) (*TrackerResponse, error) {
+	params := u.Query()
+	params.Set("info_hash", string(req.InfoHash))
+	params.Set("peer_id", req.PeerID)
+	params.Set("port", strconv.Itoa(req.Port))
+	params.Set("uploaded", strconv.Itoa(req.Uploaded))
+	params.Set("downloaded", strconv.Itoa(req.Downloaded))
+	params.Set("left", strconv.Itoa(req.Left))
+	params.Set("compact", strconv.Itoa(req.Compact))
+	if req.Event != EventNone {
+		params.Set("event", req.Event)
+	}
+	if req.TrackerID != "" {
+		params.Set("trackerid", req.TrackerID)
+	}
+
+	announceURL := *u
+	announceURL.RawQuery = params.Encode()
 
 	client := &http.Client{Timeout: 15 * time.Second}
-	resp, err := client.Get(fullURL)
+	resp, err := client.Get(announceURL.String())
 	if err != nil {
 		return nil, fmt.Errorf("failed to contact tracker: %w", err)
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read tracker response: %w", err)
+	// Trackers may report a failure reason along with an error status,
+	// so the body is decoded before the status is looked at.
+	var raw httpTrackerResponse
+	if err := bencode.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("tracker returned HTTP status %d", resp.StatusCode)
+		}
+		return nil, fmt.Errorf("failed to decode tracker response: %w", err)
 	}
 
-	trackerResp, _, err := bencode.Decode[map[string]any](string(body))
+	if raw.FailureReason != "" {
+		return nil, &TrackerFailureError{Reason: raw.FailureReason}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tracker returned HTTP status %d", resp.StatusCode)
+	}
+
+	return raw.toResponse()
+}
+
+// httpTrackerResponse mirrors the bencoded body of an HTTP announce response.
+type httpTrackerResponse struct {
+	FailureReason  string             `bencode:"failure reason"`
+	WarningMessage string             `bencode:"warning message"`
+	Interval       int                `bencode:"interval"`
+	MinInterval    int                `bencode:"min interval"`
+	TrackerID      string             `bencode:"tracker id"`
+	Complete       int                `bencode:"complete"`
+	Incomplete     int                `bencode:"incomplete"`
+	Peers          bencode.RawMessage `bencode:"peers"`
+	Peers6         string             `bencode:"peers6"`
+}
+
+// dictionaryPeer is one entry of the non-compact peer list of BEP 3.
+type dictionaryPeer struct {
+	PeerID string `bencode:"peer id"`
+	IP     string `bencode:"ip"`
+	Port   int    `bencode:"port"`
+}
+
+func (r *httpTrackerResponse) toResponse() (*TrackerResponse, error) {
+	resp := &TrackerResponse{
+		Interval:    r.Interval,
+		MinInterval: r.MinInterval,
+		TrackerID:   r.TrackerID,
+		Complete:    r.Complete,
+		Incomplete:  r.Incomplete,
+	}
+	if r.WarningMessage != "" {
+		resp.Warning = &TrackerWarningError{Message: r.WarningMessage}
+	}
+
+	peers, err := parsePeerList(r.Peers)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode tracker response: %w", err)
+		return nil, fmt.Errorf("failed to parse peers: %w", err)
 	}
 
-	peersData, ok := trackerResp["peers"].(string)
-	if !ok {
-		return nil, fmt.Errorf("invalid peers data format")
+	peers6, err := ParsePeers6(r.Peers6)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse peers6: %w", err)
 	}
 
-	var peers []Peer
-	peerCount := len(peersData) / 6
+	resp.Peers = append(peers, peers6...)
+	return resp, nil
+}
 
-	for i := 0; i < peerCount; i++ {
-		offset := i * 6
-		ip := net.IPv4(
-			peersData[offset],
-			peersData[offset+1],
-			peersData[offset+2],
-			peersData[offset+3],
-		)
-		port := binary.BigEndian.Uint16([]byte(peersData[offset+4 : offset+6]))
-		peers = append(peers, Peer{
-			IP:   ip,
-			Port: port,
-		})
+// parsePeerList decodes the peers value of an announce response, which is either
+// a compact string of IPv4 peers or a list of peer dictionaries.
+func parsePeerList(raw bencode.RawMessage) ([]Peer, error) {
+	if len(raw) == 0 {
+		return nil, nil
 	}
 
-	if len(peers) == 0 {
-		return nil, fmt.Errorf("no peers found")
+	if raw[0] != 'l' {
+		var compact string
+		if err := bencode.Unmarshal(raw, &compact); err != nil {
+			return nil, err
+		}
+		return ParsePeers(compact)
+	}
+
+	var entries []dictionaryPeer
+	if err := bencode.Unmarshal(raw, &entries); err != nil {
+		return nil, err
 	}
 
+	peers := make([]Peer, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Port <= 0 || entry.Port > 65535 {
+			continue
+		}
+		// The ip key may also hold a DNS name. Those are skipped rather than
+		// resolved one by one while the announce response is being parsed.
+		ip := net.ParseIP(entry.IP)
+		if ip == nil {
+			continue
+		}
+		peers = append(peers, Peer{IP: ip, Port: uint16(entry.Port)})
+	}
 	return peers, nil
 }
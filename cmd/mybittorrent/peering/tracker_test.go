@@ -0,0 +1,167 @@
+package peering
+
+import (
+	"errors"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
+)
+
+func TestToResponse(t *testing.T) {
+	v6 := "\x20\x01\x0d\xb8" + strings.Repeat("\x00", 11) + "\x01" + "\x1a\xe1"
+	tests := []struct {
+		name  string
+		body  string
+		peers []string // Addr of each peer, in order
+		want  TrackerResponse
+	}{
+		{
+			name:  "compact peers",
+			body:  "d8:completei5e10:incompletei2e8:intervali1800e12:min intervali60e5:peers12:\x0a\x00\x00\x01\x1a\xe1\xc0\xa8\x01\x02\x00\x50e",
+			peers: []string{"10.0.0.1:6881", "192.168.1.2:80"},
+			want:  TrackerResponse{Interval: 1800, MinInterval: 60, Complete: 5, Incomplete: 2},
+		},
+		{
+			name:  "dictionary peers",
+			body:  "d8:intervali900e5:peersld2:ip8:10.0.0.17:peer id20:-XX0001-0123456789014:porti6881eed2:ip3:::14:porti51413eeee",
+			peers: []string{"10.0.0.1:6881", "[::1]:51413"},
+			want:  TrackerResponse{Interval: 900},
+		},
+		{
+			// Host names are not resolved, and ports outside 1-65535 are dropped.
+			name:  "dictionary peers skipped",
+			body:  "d5:peersld2:ip11:example.com4:porti1eed2:ip8:10.0.0.24:porti0eed2:ip8:10.0.0.34:porti65536eed2:ip8:10.0.0.44:porti1eeee",
+			peers: []string{"10.0.0.4:1"},
+		},
+		{
+			name:  "peers6 after peers",
+			body:  "d5:peers6:\x0a\x00\x00\x01\x1a\xe16:peers618:" + v6 + "e",
+			peers: []string{"10.0.0.1:6881", "[2001:db8::1]:6881"},
+		},
+		{
+			name: "no peers",
+			body: "d8:intervali60e10:tracker id3:abce",
+			want: TrackerResponse{Interval: 60, TrackerID: "abc"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var raw httpTrackerResponse
+			if err := bencode.Unmarshal([]byte(tt.body), &raw); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := raw.toResponse()
+			if err != nil {
+				t.Fatalf("toResponse: %v", err)
+			}
+			var addrs []string
+			for _, p := range resp.Peers {
+				addrs = append(addrs, p.Addr())
+			}
+			if !reflect.DeepEqual(addrs, tt.peers) {
+				t.Errorf("peers = %v, want %v", addrs, tt.peers)
+			}
+			resp.Peers = nil
+			if !reflect.DeepEqual(*resp, tt.want) {
+				t.Errorf("response = %+v, want %+v", *resp, tt.want)
+			}
+		})
+	}
+}
+
+func TestToResponseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"compact peers length", "d5:peers5:abcdee"},
+		{"peers6 length", "d6:peers617:" + strings.Repeat("x", 17) + "e"},
+		{"peers of the wrong type", "d5:peersi1ee"},
+		{"dictionary peer of the wrong type", "d5:peersli1eee"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var raw httpTrackerResponse
+			if err := bencode.Unmarshal([]byte(tt.body), &raw); err != nil {
+				t.Fatal(err)
+			}
+			if resp, err := raw.toResponse(); err == nil {
+				t.Errorf("toResponse = %+v, want an error", resp)
+			}
+		})
+	}
+}
+
+func TestParsePeers6(t *testing.T) {
+	tests := []struct {
+		data  string
+		peers []string
+	}{
+		{"", nil},
+		{strings.Repeat("\x00", 15) + "\x01\x00\x50", []string{"[::1]:80"}},
+		{
+			"\xfe\x80" + strings.Repeat("\x00", 13) + "\x02\x1a\xe1" + "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\x0a\x00\x00\x01\xff\xff",
+			[]string{"[fe80::2]:6881", "10.0.0.1:65535"},
+		},
+	}
+	for _, tt := range tests {
+		peers, err := ParsePeers6(tt.data)
+		if err != nil {
+			t.Errorf("ParsePeers6(%q): %v", tt.data, err)
+			continue
+		}
+		var addrs []string
+		for _, p := range peers {
+			addrs = append(addrs, p.Addr())
+		}
+		if !reflect.DeepEqual(addrs, tt.peers) {
+			t.Errorf("ParsePeers6(%q) = %v, want %v", tt.data, addrs, tt.peers)
+		}
+	}
+
+	for _, n := range []int{1, 17, 19} {
+		if _, err := ParsePeers6(strings.Repeat("x", n)); err == nil {
+			t.Errorf("ParsePeers6 accepted %d bytes", n)
+		}
+	}
+}
+
+func TestAnnounceHTTPFailureAndWarning(t *testing.T) {
+	tracker := newFakeHTTPTracker(t, func(_ int, query url.Values) map[string]any {
+		switch query.Get("passkey") {
+		case "bad":
+			return map[string]any{"failure reason": "unregistered torrent", "interval": 60}
+		case "warn":
+			return map[string]any{"warning message": "slow down", "interval": 60, "peers": ""}
+		}
+		return map[string]any{"interval": 60, "peers": ""}
+	})
+	req := &TrackerRequest{InfoHash: []byte("01234567890123456789"), PeerID: peerID, Port: DefaultPort, Compact: 1}
+
+	_, err := announce(tracker.announceURL()+"?passkey=bad", req)
+	var failure *TrackerFailureError
+	if !errors.As(err, &failure) || failure.Reason != "unregistered torrent" {
+		t.Errorf("announce with a failure reason returned %v", err)
+	}
+
+	resp, err := announce(tracker.announceURL()+"?passkey=warn", req)
+	if err != nil {
+		t.Fatalf("announce with a warning: %v", err)
+	}
+	if resp.Warning == nil || resp.Warning.Message != "slow down" || resp.Interval != 60 {
+		t.Errorf("announce with a warning returned %+v", resp)
+	}
+
+	resp, err = announce(tracker.announceURL()+"?passkey=ok", req)
+	if err != nil || resp.Warning != nil {
+		t.Errorf("announce returned %+v, %v", resp, err)
+	}
+	// The passkey in the tracker URL is sent along with the announce parameters.
+	last := tracker.queries()[2]
+	if last.Get("passkey") != "ok" || last.Get("info_hash") != "01234567890123456789" || last.Get("compact") != "1" {
+		t.Errorf("tracker got query %v", last)
+	}
+}
@@ -0,0 +1,97 @@
+package peering
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// TrackerManager announces to a torrent's trackers following the BEP 12 multitracker rules:
+// tiers are tried in order, trackers within a tier are shuffled once up front and tried
+// in order, and a tracker that answers is moved to the front of its tier so it is tried
+// first next time.
+type TrackerManager struct {
+	mu    sync.Mutex
+	tiers [][]string
+}
+
+// NewTrackerManager creates a manager over the given tiers of tracker URLs.
+// Empty tiers are dropped and the remaining tiers are copied before shuffling.
+func NewTrackerManager(tiers [][]string) *TrackerManager {
+	m := &TrackerManager{}
+	for _, tier := range tiers {
+		if len(tier) == 0 {
+			continue
+		}
+		shuffled := slices.Clone(tier)
+		rand.Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+		m.tiers = append(m.tiers, shuffled)
+	}
+	return m
+}
+
+// Tiers returns a snapshot of the current tracker order.
+func (m *TrackerManager) Tiers() [][]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tiers := make([][]string, len(m.tiers))
+	for i, tier := range m.tiers {
+		tiers[i] = slices.Clone(tier)
+	}
+	return tiers
+}
+
+// Announce sends req to the first tracker that answers, falling through to the
+// next tracker and then the next tier on failure.
+// Returns the response along with the URL of the tracker that produced it,
+// or an error joining every tracker's failure.
+func (m *TrackerManager) Announce(req *TrackerRequest) (*TrackerResponse, string, error) {
+	var errs []error
+	for tierIndex, tier := range m.Tiers() {
+		for _, trackerURL := range tier {
+			resp, err := announce(trackerURL, req)
+			if err != nil {
+				zap.L().Debug("Tracker announce failed",
+					zap.String("tracker", trackerURL),
+					zap.Error(err))
+				errs = append(errs, fmt.Errorf("%s: %w", trackerURL, err))
+				continue
+			}
+
+			if resp.Warning != nil {
+				zap.L().Warn("Tracker sent a warning",
+					zap.String("tracker", trackerURL),
+					zap.Error(resp.Warning))
+			}
+
+			m.promote(tierIndex, trackerURL)
+			return resp, trackerURL, nil
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil, "", fmt.Errorf("no trackers available")
+	}
+	return nil, "", fmt.Errorf("all trackers failed: %w", errors.Join(errs...))
+}
+
+// promote moves trackerURL to the front of its tier.
+func (m *TrackerManager) promote(tierIndex int, trackerURL string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tier := m.tiers[tierIndex]
+	i := slices.Index(tier, trackerURL)
+	if i <= 0 {
+		return
+	}
+	copy(tier[1:i+1], tier[:i])
+	tier[0] = trackerURL
+}
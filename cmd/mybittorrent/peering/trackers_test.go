@@ -0,0 +1,141 @@
+package peering
+
+import (
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestTrackerManagerAnnounce(t *testing.T) {
+	tests := []struct {
+		name      string
+		tiers     [][]string // stub trackers by name; those starting with "bad" refuse announces
+		contacted []string   // the trackers announced to, in order
+		answered  string
+		after     [][]string // the tiers after the announce
+		again     []string   // the trackers announced to the next time
+	}{
+		{
+			name:      "first tracker answers",
+			tiers:     [][]string{{"a", "b"}, {"c"}},
+			contacted: []string{"a"},
+			answered:  "a",
+			after:     [][]string{{"a", "b"}, {"c"}},
+			again:     []string{"a"},
+		},
+		{
+			name:      "answering tracker moves to the front of its tier",
+			tiers:     [][]string{{"bad1", "bad2", "a", "b"}},
+			contacted: []string{"bad1", "bad2", "a"},
+			answered:  "a",
+			after:     [][]string{{"a", "bad1", "bad2", "b"}},
+			again:     []string{"a"},
+		},
+		{
+			name:      "falls through to the next tier",
+			tiers:     [][]string{{"bad1", "bad2"}, {"bad3", "a"}, {"b"}},
+			contacted: []string{"bad1", "bad2", "bad3", "a"},
+			answered:  "a",
+			after:     [][]string{{"bad1", "bad2"}, {"a", "bad3"}, {"b"}},
+			// Earlier tiers are still tried first.
+			again: []string{"bad1", "bad2", "a"},
+		},
+		{
+			name:      "every tracker fails",
+			tiers:     [][]string{{"bad1"}, {"bad2", "bad3"}},
+			contacted: []string{"bad1", "bad2", "bad3"},
+			after:     [][]string{{"bad1"}, {"bad2", "bad3"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var contacted []string
+			urls := map[string]string{} // name by URL
+			tiers := make([][]string, len(tt.tiers))
+			for i, tier := range tt.tiers {
+				for _, name := range tier {
+					tracker := newFakeHTTPTracker(t, func(int, url.Values) map[string]any {
+						mu.Lock()
+						contacted = append(contacted, name)
+						mu.Unlock()
+						if strings.HasPrefix(name, "bad") {
+							return map[string]any{"failure reason": name + " refuses"}
+						}
+						return map[string]any{"interval": 60, "peers": ""}
+					})
+					urls[tracker.announceURL()] = name
+					tiers[i] = append(tiers[i], tracker.announceURL())
+				}
+			}
+			// The tiers are set directly, skipping the shuffle, so the order is known.
+			m := &TrackerManager{tiers: tiers}
+
+			_, answered, err := m.Announce(testAnnounce())
+			if tt.answered == "" {
+				if err == nil {
+					t.Fatal("Announce succeeded with every tracker failing")
+				}
+				for _, name := range tt.contacted {
+					if !strings.Contains(err.Error(), name+" refuses") {
+						t.Errorf("error %q does not include the failure of %s", err, name)
+					}
+				}
+			} else if err != nil || urls[answered] != tt.answered {
+				t.Fatalf("Announce answered by %s (%v), want %s", urls[answered], err, tt.answered)
+			}
+			if !slices.Equal(contacted, tt.contacted) {
+				t.Errorf("contacted %v, want %v", contacted, tt.contacted)
+			}
+
+			var after [][]string
+			for _, tier := range m.Tiers() {
+				var names []string
+				for _, u := range tier {
+					names = append(names, urls[u])
+				}
+				after = append(after, names)
+			}
+			if !reflect.DeepEqual(after, tt.after) {
+				t.Errorf("tiers after the announce = %v, want %v", after, tt.after)
+			}
+
+			// The next announce tries the tracker that answered first within its tier.
+			if tt.answered != "" {
+				contacted = nil
+				if _, again, err := m.Announce(testAnnounce()); err != nil || urls[again] != tt.answered {
+					t.Errorf("second announce answered by %s (%v), want %s", urls[again], err, tt.answered)
+				}
+				if !slices.Equal(contacted, tt.again) {
+					t.Errorf("second announce contacted %v, want %v", contacted, tt.again)
+				}
+			}
+		})
+	}
+}
+
+func TestNewTrackerManager(t *testing.T) {
+	tiers := [][]string{{"a", "b", "c"}, {}, {"d"}}
+	m := NewTrackerManager(tiers)
+
+	got := m.Tiers()
+	if len(got) != 2 {
+		t.Fatalf("got %d tiers, want 2 without the empty one", len(got))
+	}
+	// Trackers are shuffled within their tier, never across tiers.
+	first := slices.Clone(got[0])
+	slices.Sort(first)
+	if !slices.Equal(first, tiers[0]) || !slices.Equal(got[1], tiers[2]) {
+		t.Errorf("tiers = %v, want the trackers of %v", got, tiers)
+	}
+	if !slices.Equal(tiers[0], []string{"a", "b", "c"}) {
+		t.Error("NewTrackerManager shuffled the caller's tier")
+	}
+
+	if _, _, err := NewTrackerManager(nil).Announce(testAnnounce()); err == nil {
+		t.Error("Announce without trackers succeeded")
+	}
+}
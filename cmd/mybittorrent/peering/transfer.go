@@ -0,0 +1,278 @@
+package peering
+
+import (
+	"sync"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/storage"
+)
+
+// transfer is the state shared by the peer sessions of one download: the piece picker
+// and the pieces being downloaded. A piece normally belongs to the session that picked
+// it, but once every piece has been picked the download enters endgame and sessions
+// also request blocks that are still outstanding at other peers. Whichever copy of a
+// block arrives first is kept, and the sessions holding the other requests cancel them.
+//
+// When the transfer has storage, its sessions also upload the pieces stored so far,
+// sharing the upload slots of its choke group.
+type transfer struct {
+	client  *Client
+	picker  PiecePicker
+	results chan<- pieceResult
+	done    <-chan struct{}
+	storage storage.Torrent // nil if pieces are not stored
+	group   *chokeGroup
+
+	mu       sync.Mutex
+	pieces   map[int]*pieceProgress
+	sessions map[*peerSession]struct{}
+	haves    []int // pieces stored since the transfer started, in order
+}
+
+// pieceProgress tracks a piece being downloaded. Its fields are guarded by the transfer's mutex.
+type pieceProgress struct {
+	index     int
+	data      []byte
+	blocks    []Block
+	requested []int // outstanding requests for each block, across all sessions
+	received  []bool
+	missing   int
+	finished  bool // completed or abandoned; sessions drop it when they notice
+	sessions  map[*peerSession]struct{}
+}
+
+func newTransfer(c *Client, picker PiecePicker, store storage.Torrent, results chan<- pieceResult, done <-chan struct{}) *transfer {
+	return &transfer{
+		client:   c,
+		picker:   picker,
+		results:  results,
+		done:     done,
+		storage:  store,
+		group:    newChokeGroup(c.Choker, false),
+		pieces:   make(map[int]*pieceProgress),
+		sessions: make(map[*peerSession]struct{}),
+	}
+}
+
+// register adds s to the sessions told about stored pieces and returns the bitfield
+// it should send first, or nil if nothing is stored yet.
+func (t *transfer) register(s *peerSession) []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sessions[s] = struct{}{}
+	s.havesSent = len(t.haves)
+	if t.storage == nil {
+		return nil
+	}
+	return completedBitfield(t.storage, len(t.client.info.Info.Pieces)/20)
+}
+
+// stored records that a piece was written to storage and wakes the sessions to announce it.
+func (t *transfer) stored(index int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.haves = append(t.haves, index)
+	for s := range t.sessions {
+		s.notify()
+	}
+}
+
+// newHaves returns the pieces stored since s last asked.
+func (t *transfer) newHaves(s *peerSession) []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	haves := t.haves[s.havesSent:]
+	s.havesSent = len(t.haves)
+	return haves
+}
+
+// blockIndex returns the position of the block starting at begin, or -1 if there is none.
+func (p *pieceProgress) blockIndex(begin int) int {
+	i := begin / blockSize
+	if begin%blockSize != 0 || i >= len(p.blocks) {
+		return -1
+	}
+	return i
+}
+
+// nextRequest chooses the next block s should request and counts the request.
+// Unrequested blocks of the session's own pieces come first, then the first block of a
+// newly picked piece. In endgame, blocks the session has not requested itself are taken
+// from any unfinished piece its peer has, least requested first.
+func (t *transfer) nextRequest(s *peerSession) (*pieceProgress, Block, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, p := range s.active {
+		if p.finished {
+			continue
+		}
+		for i, blk := range p.blocks {
+			if !p.received[i] && p.requested[i] == 0 {
+				p.requested[i]++
+				return p, blk, true
+			}
+		}
+	}
+
+	if index, ok := t.picker.Pick(s.bitfield); ok {
+		length := t.client.getPieceLength(index)
+		blocks := dividePiece(length, blockSize)
+		p := &pieceProgress{
+			index:     index,
+			data:      make([]byte, length),
+			blocks:    blocks,
+			requested: make([]int, len(blocks)),
+			received:  make([]bool, len(blocks)),
+			missing:   len(blocks),
+			sessions:  make(map[*peerSession]struct{}),
+		}
+		t.pieces[index] = p
+		t.join(s, p)
+		p.requested[0]++
+		return p, blocks[0], true
+	}
+
+	if t.picker.Remaining() > 0 {
+		return nil, Block{}, false
+	}
+
+	var best *pieceProgress
+	bestBlock := -1
+	for _, p := range t.pieces {
+		if p.finished || !hasBit(s.bitfield, p.index) {
+			continue
+		}
+		for i, blk := range p.blocks {
+			if p.received[i] || s.hasRequested(p.index, blk.Begin) {
+				continue
+			}
+			if best == nil || p.requested[i] < best.requested[bestBlock] {
+				best, bestBlock = p, i
+			}
+		}
+	}
+	if best == nil {
+		return nil, Block{}, false
+	}
+
+	t.join(s, best)
+	best.requested[bestBlock]++
+	return best, best.blocks[bestBlock], true
+}
+
+func (t *transfer) join(s *peerSession, p *pieceProgress) {
+	if _, ok := p.sessions[s]; !ok {
+		p.sessions[s] = struct{}{}
+		s.active = append(s.active, p)
+	}
+}
+
+// receive stores a block delivered to s and returns its piece if the block completed it.
+// duplicate reports that the block was not needed, because another peer delivered it
+// first or its piece is already finished.
+func (t *transfer) receive(s *peerSession, index, begin int, block []byte) (complete *pieceProgress, duplicate bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p := t.pieces[index]
+	if p == nil || p.finished {
+		return nil, true
+	}
+	i := p.blockIndex(begin)
+	if p.requested[i] > 0 {
+		p.requested[i]--
+	}
+	if p.received[i] {
+		return nil, true
+	}
+
+	copy(p.data[begin:], block)
+	p.received[i] = true
+	p.missing--
+
+	// Other sessions may hold requests for this block, or for any block of a finished piece.
+	for other := range p.sessions {
+		if other != s {
+			other.notify()
+		}
+	}
+
+	if p.missing > 0 {
+		return nil, false
+	}
+	p.finished = true
+	delete(t.pieces, index)
+	return p, false
+}
+
+// release returns a request that was dropped, cancelled or timed out, so the block can
+// be requested again.
+func (t *transfer) release(index, begin int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if p := t.pieces[index]; p != nil {
+		if i := p.blockIndex(begin); i >= 0 && p.requested[i] > 0 {
+			p.requested[i]--
+		}
+	}
+}
+
+// needed reports whether a block s requested is still wanted.
+func (t *transfer) needed(index, begin int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p := t.pieces[index]
+	if p == nil || p.finished {
+		return false
+	}
+	return !p.received[p.blockIndex(begin)]
+}
+
+// leave removes s from every piece it was working on and returns the pieces no other
+// session is working on, which are abandoned.
+func (t *transfer) leave(s *peerSession) []*pieceProgress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.sessions, s)
+	for key := range s.inFlight {
+		if p := t.pieces[key.index]; p != nil {
+			if i := p.blockIndex(key.begin); i >= 0 && p.requested[i] > 0 {
+				p.requested[i]--
+			}
+		}
+	}
+
+	var abandoned []*pieceProgress
+	for _, p := range s.active {
+		delete(p.sessions, s)
+		if !p.finished && len(p.sessions) == 0 {
+			p.finished = true
+			delete(t.pieces, p.index)
+			abandoned = append(abandoned, p)
+		}
+	}
+	s.active = nil
+	return abandoned
+}
+
+// prune drops finished pieces from the session's list.
+func (t *transfer) prune(s *peerSession) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	active := s.active[:0]
+	for _, p := range s.active {
+		if p.finished {
+			delete(p.sessions, s)
+			continue
+		}
+		active = append(active, p)
+	}
+	s.active = active
+}
@@ -0,0 +1,153 @@
+package peering
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/storage"
+)
+
+// endgamePeer is a peer with every piece whose answers the test sends by hand.
+type endgamePeer struct {
+	conn     net.Conn
+	messages chan PeerMessage // what the client sent, closed when the connection fails
+}
+
+// listenEndgamePeer returns a peer to hand the client and the connection it makes, once
+// the client has connected and been unchoked. The caller closes the connection.
+func listenEndgamePeer(t *testing.T, numPieces int) (Peer, <-chan *endgamePeer) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	connected := make(chan *endgamePeer, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		if _, err := AcceptHandshake(conn, func([]byte) bool { return true }); err != nil {
+			return
+		}
+		bitfield := make([]byte, (numPieces+7)/8)
+		for i := range numPieces {
+			setBit(bitfield, i)
+		}
+		SendPeerMessage(conn, Bitfield{Bits: bitfield})
+		SendPeerMessage(conn, Unchoke{})
+
+		p := &endgamePeer{conn: conn, messages: make(chan PeerMessage, 64)}
+		connected <- p
+		defer close(p.messages)
+		for {
+			msg, err := ReadPeerMessage(conn)
+			if err != nil {
+				return
+			}
+			p.messages <- msg
+		}
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+	return Peer{IP: addr.IP, Port: uint16(addr.Port)}, connected
+}
+
+// await reads the messages the client sends to p until one that match accepts, skipping
+// the others, and fails the test if none comes.
+func (p *endgamePeer) await(t *testing.T, what string, match func(PeerMessage) bool) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg, ok := <-p.messages:
+			if !ok {
+				t.Fatalf("connection closed while waiting for %s", what)
+			}
+			if match(msg) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestEndgame(t *testing.T) {
+	// Two pieces of one block each, so that every piece is picked as soon as both are
+	// requested and each peer is then asked for the other's piece as well.
+	info, data := testTorrent(2*blockSize, blockSize)
+	first, firstConnected := listenEndgamePeer(t, 2)
+	second, secondConnected := listenEndgamePeer(t, 2)
+
+	c, err := newClient(info, []Peer{first, second})
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	defer c.Close()
+	c.StallTimeout = 10 * time.Second
+	_, infoHash, _ := bencode.HashInfo(info)
+	torrent, err := storage.NewMemoryStorage().OpenTorrent(&info.Info, infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded := make(chan error, 1)
+	go func() { downloaded <- c.DownloadTo(torrent) }()
+
+	var peers []*endgamePeer
+	for _, connected := range []<-chan *endgamePeer{firstConnected, secondConnected} {
+		select {
+		case p := <-connected:
+			defer p.conn.Close()
+			peers = append(peers, p)
+		case <-time.After(5 * time.Second):
+			t.Fatal("the client did not connect to every peer")
+		}
+	}
+	for _, p := range peers {
+		requested := make(map[int]bool)
+		p.await(t, "requests for both pieces", func(msg PeerMessage) bool {
+			if m, ok := msg.(Request); ok {
+				requested[m.Index] = true
+			}
+			return len(requested) == 2
+		})
+	}
+
+	// The first peer delivers piece 0, so the second one's request for it is cancelled.
+	block := func(index int) Piece {
+		return Piece{Index: index, Begin: 0, Block: data[index*blockSize : (index+1)*blockSize]}
+	}
+	if err := SendPeerMessage(peers[0].conn, block(0)); err != nil {
+		t.Fatal(err)
+	}
+	peers[1].await(t, "a cancel for piece 0", func(msg PeerMessage) bool {
+		m, ok := msg.(Cancel)
+		return ok && m.Index == 0 && m.Begin == 0 && m.Length == blockSize
+	})
+
+	// The second peer's copy crossed the cancel and is wasted; its piece 1 finishes
+	// the download.
+	if err := SendPeerMessage(peers[1].conn, block(0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := SendPeerMessage(peers[1].conn, block(1)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-downloaded:
+		if err != nil {
+			t.Fatalf("DownloadTo: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the download did not finish")
+	}
+
+	stats := c.Stats()
+	if stats.Verified != 2*blockSize || stats.Downloaded != 3*blockSize || stats.Wasted != blockSize {
+		t.Errorf("client counted %d bytes verified and %d downloaded of which %d wasted, want %d, %d and %d",
+			stats.Verified, stats.Downloaded, stats.Wasted, 2*blockSize, 3*blockSize, blockSize)
+	}
+}
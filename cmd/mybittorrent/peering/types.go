@@ -1,6 +1,10 @@
 package peering
 
-import "net"
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
 
 type TrackerRequest struct {
 	InfoHash   []byte `json:"info_hash"`
@@ -10,11 +14,50 @@ type TrackerRequest struct {
 	Downloaded int    `json:"downloaded"`
 	Left       int    `json:"left"`
 	Compact    int    `json:"compact"`
+	Event      string `json:"event"`
+	TrackerID  string `json:"trackerid"`
 }
 
+// Tracker announce events. A regular periodic announce carries no event.
+const (
+	EventNone      = ""
+	EventStarted   = "started"
+	EventCompleted = "completed"
+	EventStopped   = "stopped"
+)
+
+// TrackerResponse is a tracker's answer to an announce. Peers from the compact,
+// dictionary and IPv6 encodings are all merged into Peers.
 type TrackerResponse struct {
-	Interval int    `json:"interval"`
-	Peers    string `json:"peers"`
+	Interval    int
+	MinInterval int
+	TrackerID   string
+	Complete    int
+	Incomplete  int
+	Peers       []Peer
+
+	// Warning is set when the tracker attached a warning message to an otherwise
+	// successful response.
+	Warning *TrackerWarningError
+}
+
+// TrackerFailureError is returned when a tracker rejects an announce or scrape
+// with a failure reason.
+type TrackerFailureError struct {
+	Reason string
+}
+
+func (e *TrackerFailureError) Error() string {
+	return fmt.Sprintf("tracker failure: %s", e.Reason)
+}
+
+// TrackerWarningError holds a warning message sent along with a successful tracker response.
+type TrackerWarningError struct {
+	Message string
+}
+
+func (e *TrackerWarningError) Error() string {
+	return fmt.Sprintf("tracker warning: %s", e.Message)
 }
 
 // Peer represents a BitTorrent peer with its connection information
@@ -23,6 +66,11 @@ type Peer struct {
 	Port uint16
 }
 
+// Addr returns the peer's address in a form suitable for net.Dial.
+func (p Peer) Addr() string {
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
+}
+
 type Message struct {
 	Length  uint32
 	ID      byte
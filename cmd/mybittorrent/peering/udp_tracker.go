@@ -0,0 +1,309 @@
+package peering
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// UDP tracker protocol constants from BEP 15.
+const (
+	udpProtocolID = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	// udpConnectionTTL is how long a connection ID may be reused after it was received.
+	udpConnectionTTL = time.Minute
+	// udpMaxScrapeHashes is the largest number of info hashes a single scrape may carry.
+	udpMaxScrapeHashes = 74
+
+	// BEP15MaxRetries is the number of retransmissions BEP 15 specifies, which takes
+	// over two hours to give up on a tracker that does not answer.
+	BEP15MaxRetries = 8
+	// defaultUDPRetries bounds the time spent on a dead tracker to 1m45s, so that
+	// announces fail over to the next tracker in reasonable time.
+	defaultUDPRetries = 2
+)
+
+// UDPTrackerClient speaks the UDP tracker protocol (BEP 15).
+// Connection IDs are cached per tracker address and reused until they expire,
+// and every request is retransmitted on the BEP 15 schedule of BaseTimeout * 2^n,
+// cut short after MaxRetries retransmissions.
+type UDPTrackerClient struct {
+	// BaseTimeout is the timeout of the first attempt; BEP 15 specifies 15 seconds.
+	BaseTimeout time.Duration
+	// MaxRetries is the number of retransmissions after the first attempt. BEP 15
+	// specifies BEP15MaxRetries, but clients default to far fewer.
+	MaxRetries int
+
+	mu          sync.Mutex
+	connections map[string]udpConnection
+	key         uint32
+}
+
+type udpConnection struct {
+	id       uint64
+	obtained time.Time
+}
+
+// DefaultUDPTracker is the client used for udp:// announce URLs.
+var DefaultUDPTracker = NewUDPTrackerClient()
+
+// NewUDPTrackerClient returns a client using the BEP 15 timeouts, retransmitting
+// twice before it gives up. Set MaxRetries to BEP15MaxRetries for the full schedule.
+func NewUDPTrackerClient() *UDPTrackerClient {
+	var key [4]byte
+	rand.Read(key[:])
+	return &UDPTrackerClient{
+		BaseTimeout: 15 * time.Second,
+		MaxRetries:  defaultUDPRetries,
+		connections: make(map[string]udpConnection),
+		key:         binary.BigEndian.Uint32(key[:]),
+	}
+}
+
+// Announce sends req to the UDP tracker at u.
+// The peer list holds IPv4 or IPv6 addresses depending on the address family
+// the tracker was reached over.
+func (c *UDPTrackerClient) Announce(u *url.URL, req *TrackerRequest) (*TrackerResponse, error) {
+	conn, err := dialUDPTracker(u)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	build := func(connectionID uint64, transactionID uint32) []byte {
+		packet := make([]byte, 98)
+		binary.BigEndian.PutUint64(packet[0:8], connectionID)
+		binary.BigEndian.PutUint32(packet[8:12], udpActionAnnounce)
+		binary.BigEndian.PutUint32(packet[12:16], transactionID)
+		copy(packet[16:36], req.InfoHash)
+		copy(packet[36:56], req.PeerID)
+		binary.BigEndian.PutUint64(packet[56:64], uint64(req.Downloaded))
+		binary.BigEndian.PutUint64(packet[64:72], uint64(req.Left))
+		binary.BigEndian.PutUint64(packet[72:80], uint64(req.Uploaded))
+		binary.BigEndian.PutUint32(packet[80:84], udpEvent(req.Event))
+		binary.BigEndian.PutUint32(packet[84:88], 0) // IP address: use the sender's
+		binary.BigEndian.PutUint32(packet[88:92], c.key)
+		binary.BigEndian.PutUint32(packet[92:96], 0xFFFFFFFF) // num_want: tracker default
+		binary.BigEndian.PutUint16(packet[96:98], uint16(req.Port))
+		return packet
+	}
+
+	payload, err := c.request(conn, udpActionAnnounce, build)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < 12 {
+		return nil, fmt.Errorf("announce response too short: %d bytes", len(payload))
+	}
+
+	resp := &TrackerResponse{
+		Interval:   int(binary.BigEndian.Uint32(payload[0:4])),
+		Incomplete: int(binary.BigEndian.Uint32(payload[4:8])),
+		Complete:   int(binary.BigEndian.Uint32(payload[8:12])),
+	}
+	parse := ParsePeers
+	if conn.RemoteAddr().(*net.UDPAddr).IP.To4() == nil {
+		parse = ParsePeers6
+	}
+	resp.Peers, err = parse(string(payload[12:]))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse peers: %w", err)
+	}
+	return resp, nil
+}
+
+// Scrape asks the UDP tracker at u for the swarm statistics of each info hash.
+// Hashes are sent in batches of at most 74, the most a single packet may hold.
+func (c *UDPTrackerClient) Scrape(u *url.URL, infoHashes [][]byte) ([]ScrapeResult, error) {
+	conn, err := dialUDPTracker(u)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	results := make([]ScrapeResult, 0, len(infoHashes))
+	for start := 0; start < len(infoHashes); start += udpMaxScrapeHashes {
+		batch := infoHashes[start:min(start+udpMaxScrapeHashes, len(infoHashes))]
+
+		build := func(connectionID uint64, transactionID uint32) []byte {
+			packet := make([]byte, 16, 16+20*len(batch))
+			binary.BigEndian.PutUint64(packet[0:8], connectionID)
+			binary.BigEndian.PutUint32(packet[8:12], udpActionScrape)
+			binary.BigEndian.PutUint32(packet[12:16], transactionID)
+			for _, infoHash := range batch {
+				packet = append(packet, infoHash...)
+			}
+			return packet
+		}
+
+		payload, err := c.request(conn, udpActionScrape, build)
+		if err != nil {
+			return nil, err
+		}
+		if len(payload) < 12*len(batch) {
+			return nil, fmt.Errorf("scrape response too short: %d bytes for %d hashes", len(payload), len(batch))
+		}
+
+		for i, infoHash := range batch {
+			entry := payload[i*12 : (i+1)*12]
+			results = append(results, ScrapeResult{
+				InfoHash:  infoHash,
+				Seeders:   int(binary.BigEndian.Uint32(entry[0:4])),
+				Completed: int(binary.BigEndian.Uint32(entry[4:8])),
+				Leechers:  int(binary.BigEndian.Uint32(entry[8:12])),
+			})
+		}
+	}
+	return results, nil
+}
+
+// udpEvent maps an announce event onto its BEP 15 numeric code.
+func udpEvent(event string) uint32 {
+	switch event {
+	case EventCompleted:
+		return 1
+	case EventStarted:
+		return 2
+	case EventStopped:
+		return 3
+	default:
+		return 0
+	}
+}
+
+func dialUDPTracker(u *url.URL) (*net.UDPConn, error) {
+	if u.Port() == "" {
+		return nil, fmt.Errorf("UDP tracker URL %q has no port", u)
+	}
+	addr, err := net.ResolveUDPAddr("udp", u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve tracker: %w", err)
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to contact tracker: %w", err)
+	}
+	return conn, nil
+}
+
+// request performs one action against the tracker, obtaining or reusing a connection ID
+// first. Each attempt n waits BaseTimeout * 2^n for a reply before retransmitting, and
+// the connection ID is refreshed whenever it expires between attempts.
+// Returns the response payload following the action and transaction ID.
+func (c *UDPTrackerClient) request(conn *net.UDPConn, action uint32, build func(connectionID uint64, transactionID uint32) []byte) ([]byte, error) {
+	trackerAddr := conn.RemoteAddr().String()
+
+	for attempt := 0; attempt <= c.MaxRetries; attempt++ {
+		connectionID, err := c.connectionID(conn, trackerAddr, attempt)
+		if err != nil {
+			if isTimeout(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		transactionID := newTransactionID()
+		payload, err := c.exchange(conn, build(connectionID, transactionID), action, transactionID, c.timeout(attempt))
+		if err != nil {
+			if isTimeout(err) {
+				continue
+			}
+			// The tracker may have rejected an expired connection ID; don't reuse it.
+			c.mu.Lock()
+			delete(c.connections, trackerAddr)
+			c.mu.Unlock()
+			return nil, err
+		}
+		return payload, nil
+	}
+
+	return nil, fmt.Errorf("tracker %s did not respond after %d attempts", trackerAddr, c.MaxRetries+1)
+}
+
+// connectionID returns a cached connection ID for the tracker or performs a connect exchange.
+func (c *UDPTrackerClient) connectionID(conn *net.UDPConn, trackerAddr string, attempt int) (uint64, error) {
+	c.mu.Lock()
+	cached, ok := c.connections[trackerAddr]
+	c.mu.Unlock()
+	if ok && time.Since(cached.obtained) < udpConnectionTTL {
+		return cached.id, nil
+	}
+
+	transactionID := newTransactionID()
+	packet := make([]byte, 16)
+	binary.BigEndian.PutUint64(packet[0:8], udpProtocolID)
+	binary.BigEndian.PutUint32(packet[8:12], udpActionConnect)
+	binary.BigEndian.PutUint32(packet[12:16], transactionID)
+
+	payload, err := c.exchange(conn, packet, udpActionConnect, transactionID, c.timeout(attempt))
+	if err != nil {
+		return 0, err
+	}
+	if len(payload) < 8 {
+		return 0, fmt.Errorf("connect response too short: %d bytes", len(payload))
+	}
+
+	id := binary.BigEndian.Uint64(payload[0:8])
+	c.mu.Lock()
+	c.connections[trackerAddr] = udpConnection{id: id, obtained: time.Now()}
+	c.mu.Unlock()
+	return id, nil
+}
+
+// exchange sends packet and waits up to timeout for the reply carrying transactionID.
+// Replies for other transactions, such as late answers to earlier attempts, are ignored.
+func (c *UDPTrackerClient) exchange(conn *net.UDPConn, packet []byte, action, transactionID uint32, timeout time.Duration) ([]byte, error) {
+	if _, err := conn.Write(packet); err != nil {
+		return nil, fmt.Errorf("failed to send tracker request: %w", err)
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 65536)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n < 8 || binary.BigEndian.Uint32(buf[4:8]) != transactionID {
+			continue
+		}
+
+		switch got := binary.BigEndian.Uint32(buf[0:4]); got {
+		case action:
+			return bytes.Clone(buf[8:n]), nil
+		case udpActionError:
+			return nil, &TrackerFailureError{Reason: string(buf[8:n])}
+		default:
+			return nil, fmt.Errorf("unexpected tracker action %d, want %d", got, action)
+		}
+	}
+}
+
+func (c *UDPTrackerClient) timeout(attempt int) time.Duration {
+	return c.BaseTimeout << attempt
+}
+
+func newTransactionID() uint32 {
+	var id [4]byte
+	rand.Read(id[:])
+	return binary.BigEndian.Uint32(id[:])
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
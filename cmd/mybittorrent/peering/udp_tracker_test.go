@@ -0,0 +1,373 @@
+package peering
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUDPTracker is a stand-in BEP 15 tracker. It hands out a new connection ID on
+// every connect and rejects requests carrying any other, and answers announces with
+// peers and scrapes with per-hash statistics. drop and mangle let a test lose or
+// tamper with replies.
+type fakeUDPTracker struct {
+	conn  net.PacketConn
+	peers []byte // compact peers returned by announces
+
+	mu           sync.Mutex
+	connectionID uint64
+	connects     int
+	announces    [][]byte
+	received     int
+	drop         func(n int) bool            // whether to ignore the nth packet received, from 0
+	mangle       func(reply []byte) [][]byte // replaces a reply with what is sent instead
+}
+
+func newFakeUDPTracker(t *testing.T, network, addr string, peers []byte) *fakeUDPTracker {
+	t.Helper()
+	conn, err := net.ListenPacket(network, addr)
+	if err != nil {
+		t.Skipf("cannot listen on %s %s: %v", network, addr, err)
+	}
+	f := &fakeUDPTracker{conn: conn, peers: peers}
+	t.Cleanup(func() { conn.Close() })
+	go f.serve()
+	return f
+}
+
+func (f *fakeUDPTracker) url() *url.URL {
+	return &url.URL{Scheme: "udp", Host: f.conn.LocalAddr().String(), Path: "/announce"}
+}
+
+func (f *fakeUDPTracker) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := f.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		drop := f.drop != nil && f.drop(f.received)
+		f.received++
+		var replies [][]byte
+		if !drop {
+			replies = [][]byte{f.reply(bytes.Clone(buf[:n]))}
+			if f.mangle != nil {
+				replies = f.mangle(replies[0])
+			}
+		}
+		f.mu.Unlock()
+		for _, reply := range replies {
+			f.conn.WriteTo(reply, addr)
+		}
+	}
+}
+
+// reply answers packet. f.mu must be held.
+func (f *fakeUDPTracker) reply(packet []byte) []byte {
+	connectionID := binary.BigEndian.Uint64(packet[0:8])
+	action := binary.BigEndian.Uint32(packet[8:12])
+	transactionID := binary.BigEndian.Uint32(packet[12:16])
+
+	if action == udpActionConnect {
+		if connectionID != udpProtocolID {
+			return udpPacket(udpActionError, transactionID, []byte("bad protocol id"))
+		}
+		f.connects++
+		f.connectionID = 0xC0FFEE00 + uint64(f.connects)
+		return udpPacket(udpActionConnect, transactionID, binary.BigEndian.AppendUint64(nil, f.connectionID))
+	}
+	if connectionID != f.connectionID {
+		return udpPacket(udpActionError, transactionID, []byte("connection id expired"))
+	}
+
+	switch action {
+	case udpActionAnnounce:
+		f.announces = append(f.announces, packet)
+		body := binary.BigEndian.AppendUint32(nil, 1800) // interval
+		body = binary.BigEndian.AppendUint32(body, 3)    // leechers
+		body = binary.BigEndian.AppendUint32(body, 5)    // seeders
+		return udpPacket(udpActionAnnounce, transactionID, append(body, f.peers...))
+	case udpActionScrape:
+		var body []byte
+		for i := range (len(packet) - 16) / 20 {
+			body = binary.BigEndian.AppendUint32(body, uint32(10*i+1)) // seeders
+			body = binary.BigEndian.AppendUint32(body, uint32(10*i+2)) // completed
+			body = binary.BigEndian.AppendUint32(body, uint32(10*i+3)) // leechers
+		}
+		return udpPacket(udpActionScrape, transactionID, body)
+	}
+	return udpPacket(udpActionError, transactionID, []byte("unknown action"))
+}
+
+func (f *fakeUDPTracker) stats() (connects, announces, received int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.connects, len(f.announces), f.received
+}
+
+func udpPacket(action, transactionID uint32, body []byte) []byte {
+	packet := binary.BigEndian.AppendUint32(nil, action)
+	packet = binary.BigEndian.AppendUint32(packet, transactionID)
+	return append(packet, body...)
+}
+
+func testUDPTrackerClient() *UDPTrackerClient {
+	c := NewUDPTrackerClient()
+	c.BaseTimeout = 50 * time.Millisecond
+	return c
+}
+
+func testAnnounce() *TrackerRequest {
+	return &TrackerRequest{
+		InfoHash:   bytes.Repeat([]byte{0xAB}, 20),
+		PeerID:     peerID,
+		Port:       51413,
+		Uploaded:   100,
+		Downloaded: 200,
+		Left:       300,
+		Event:      EventStarted,
+	}
+}
+
+func TestUDPTrackerAnnounceAndScrape(t *testing.T) {
+	tracker := newFakeUDPTracker(t, "udp4", "127.0.0.1:0", []byte{10, 0, 0, 1, 0x1A, 0xE1, 10, 0, 0, 2, 0xC8, 0xD5})
+	c := testUDPTrackerClient()
+
+	resp, err := c.Announce(tracker.url(), testAnnounce())
+	if err != nil {
+		t.Fatalf("Announce: %v", err)
+	}
+	if resp.Interval != 1800 || resp.Incomplete != 3 || resp.Complete != 5 {
+		t.Errorf("got interval %d, incomplete %d, complete %d, want 1800, 3, 5", resp.Interval, resp.Incomplete, resp.Complete)
+	}
+	want := []Peer{{IP: net.IPv4(10, 0, 0, 1), Port: 6881}, {IP: net.IPv4(10, 0, 0, 2), Port: 51413}}
+	if len(resp.Peers) != len(want) {
+		t.Fatalf("got %d peers, want %d", len(resp.Peers), len(want))
+	}
+	for i, peer := range resp.Peers {
+		if !peer.IP.Equal(want[i].IP) || peer.Port != want[i].Port {
+			t.Errorf("peer %d is %s, want %s", i, peer.Addr(), want[i].Addr())
+		}
+	}
+
+	tracker.mu.Lock()
+	packet := tracker.announces[0]
+	tracker.mu.Unlock()
+	fields := []struct {
+		name      string
+		got, want uint64
+	}{
+		{"connection id", binary.BigEndian.Uint64(packet[0:8]), 0xC0FFEE01},
+		{"downloaded", binary.BigEndian.Uint64(packet[56:64]), 200},
+		{"left", binary.BigEndian.Uint64(packet[64:72]), 300},
+		{"uploaded", binary.BigEndian.Uint64(packet[72:80]), 100},
+		{"event", uint64(binary.BigEndian.Uint32(packet[80:84])), 2},
+		{"port", uint64(binary.BigEndian.Uint16(packet[96:98])), 51413},
+	}
+	for _, f := range fields {
+		if f.got != f.want {
+			t.Errorf("announce %s = %d, want %d", f.name, f.got, f.want)
+		}
+	}
+	if !bytes.Equal(packet[16:36], testAnnounce().InfoHash) || string(packet[36:56]) != peerID {
+		t.Error("announce carries the wrong info hash or peer id")
+	}
+
+	hashes := [][]byte{bytes.Repeat([]byte{1}, 20), bytes.Repeat([]byte{2}, 20)}
+	results, err := c.Scrape(tracker.url(), hashes)
+	if err != nil {
+		t.Fatalf("Scrape: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d scrape results, want 2", len(results))
+	}
+	for i, r := range results {
+		if !bytes.Equal(r.InfoHash, hashes[i]) || r.Seeders != 10*i+1 || r.Completed != 10*i+2 || r.Leechers != 10*i+3 {
+			t.Errorf("scrape result %d is %+v", i, r)
+		}
+	}
+
+	if connects, _, _ := tracker.stats(); connects != 1 {
+		t.Errorf("connected %d times, want the connection id reused", connects)
+	}
+}
+
+func TestUDPTrackerScrapeBatches(t *testing.T) {
+	tracker := newFakeUDPTracker(t, "udp4", "127.0.0.1:0", nil)
+	c := testUDPTrackerClient()
+
+	hashes := make([][]byte, udpMaxScrapeHashes+1)
+	for i := range hashes {
+		hashes[i] = bytes.Repeat([]byte{byte(i)}, 20)
+	}
+	results, err := c.Scrape(tracker.url(), hashes)
+	if err != nil {
+		t.Fatalf("Scrape: %v", err)
+	}
+	if len(results) != len(hashes) {
+		t.Fatalf("got %d scrape results, want %d", len(results), len(hashes))
+	}
+	// The last hash went out alone in a second packet.
+	if last := results[len(results)-1]; !bytes.Equal(last.InfoHash, hashes[len(hashes)-1]) || last.Seeders != 1 {
+		t.Errorf("last scrape result is %+v", last)
+	}
+	if _, _, received := tracker.stats(); received != 3 {
+		t.Errorf("tracker received %d packets, want a connect and two scrapes", received)
+	}
+}
+
+func TestUDPTrackerTransactionMismatch(t *testing.T) {
+	tracker := newFakeUDPTracker(t, "udp4", "127.0.0.1:0", nil)
+	// Every reply is preceded by a copy answering another transaction, which the
+	// client must skip rather than take as the answer or an error.
+	tracker.mu.Lock()
+	tracker.mangle = func(reply []byte) [][]byte {
+		stray := bytes.Clone(reply)
+		binary.BigEndian.PutUint32(stray[4:8], binary.BigEndian.Uint32(reply[4:8])+1)
+		binary.BigEndian.PutUint32(stray[0:4], udpActionError)
+		return [][]byte{stray, reply}
+	}
+	tracker.mu.Unlock()
+	c := testUDPTrackerClient()
+
+	resp, err := c.Announce(tracker.url(), testAnnounce())
+	if err != nil {
+		t.Fatalf("Announce: %v", err)
+	}
+	if resp.Interval != 1800 {
+		t.Errorf("got interval %d, want 1800", resp.Interval)
+	}
+	if _, _, received := tracker.stats(); received != 2 {
+		t.Errorf("tracker received %d packets, want 2 without retransmissions", received)
+	}
+}
+
+func TestUDPTrackerReplyTooShort(t *testing.T) {
+	tracker := newFakeUDPTracker(t, "udp4", "127.0.0.1:0", nil)
+	tracker.mu.Lock()
+	tracker.mangle = func(reply []byte) [][]byte {
+		if binary.BigEndian.Uint32(reply[0:4]) == udpActionAnnounce {
+			reply = reply[:12]
+		}
+		return [][]byte{reply}
+	}
+	tracker.mu.Unlock()
+	_, err := testUDPTrackerClient().Announce(tracker.url(), testAnnounce())
+	if err == nil || !strings.Contains(err.Error(), "too short") {
+		t.Errorf("Announce returned %v, want a short response error", err)
+	}
+}
+
+func TestUDPTrackerConnectionExpiry(t *testing.T) {
+	tracker := newFakeUDPTracker(t, "udp4", "127.0.0.1:0", nil)
+	c := testUDPTrackerClient()
+	u := tracker.url()
+
+	if _, err := c.Announce(u, testAnnounce()); err != nil {
+		t.Fatalf("Announce: %v", err)
+	}
+
+	// Past its TTL the connection ID is not reused.
+	c.mu.Lock()
+	for addr, conn := range c.connections {
+		conn.obtained = conn.obtained.Add(-udpConnectionTTL)
+		c.connections[addr] = conn
+	}
+	c.mu.Unlock()
+	if _, err := c.Announce(u, testAnnounce()); err != nil {
+		t.Fatalf("Announce after expiry: %v", err)
+	}
+	if connects, _, _ := tracker.stats(); connects != 2 {
+		t.Fatalf("connected %d times, want a reconnect once the id expired", connects)
+	}
+
+	// A tracker that forgot the connection ID rejects it before the TTL is up. The
+	// failure is reported and the ID dropped, so the next announce reconnects.
+	tracker.mu.Lock()
+	tracker.connectionID = 0
+	tracker.mu.Unlock()
+	_, err := c.Announce(u, testAnnounce())
+	var failure *TrackerFailureError
+	if !errors.As(err, &failure) || failure.Reason != "connection id expired" {
+		t.Fatalf("Announce with a rejected connection id returned %v", err)
+	}
+	if _, err := c.Announce(u, testAnnounce()); err != nil {
+		t.Fatalf("Announce after rejection: %v", err)
+	}
+	if connects, announces, _ := tracker.stats(); connects != 3 || announces != 3 {
+		t.Errorf("got %d connects and %d announces, want 3 and 3", connects, announces)
+	}
+}
+
+func TestUDPTrackerIPv6Peers(t *testing.T) {
+	peers := append(net.ParseIP("2001:db8::1").To16(), 0x1A, 0xE1)
+	tracker := newFakeUDPTracker(t, "udp6", "[::1]:0", peers)
+
+	resp, err := testUDPTrackerClient().Announce(tracker.url(), testAnnounce())
+	if err != nil {
+		t.Fatalf("Announce: %v", err)
+	}
+	if len(resp.Peers) != 1 || !resp.Peers[0].IP.Equal(net.ParseIP("2001:db8::1")) || resp.Peers[0].Port != 6881 {
+		t.Errorf("got peers %v, want [2001:db8::1]:6881", resp.Peers)
+	}
+}
+
+func TestUDPTrackerRetransmission(t *testing.T) {
+	tests := []struct {
+		name       string
+		drop       func(n int) bool
+		maxRetries int
+		received   int // packets the tracker sees
+		wantErr    bool
+	}{
+		// The connect and then the announce are lost once each.
+		{"lost replies", func(n int) bool { return n == 0 || n == 2 }, 2, 4, false},
+		{"dead tracker", func(int) bool { return true }, 2, 3, true},
+		{"no retries", func(int) bool { return true }, 0, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newFakeUDPTracker(t, "udp4", "127.0.0.1:0", nil)
+			tracker.mu.Lock()
+			tracker.drop = tt.drop
+			tracker.mu.Unlock()
+			c := testUDPTrackerClient()
+			c.BaseTimeout = 20 * time.Millisecond
+			c.MaxRetries = tt.maxRetries
+
+			start := time.Now()
+			_, err := c.Announce(tracker.url(), testAnnounce())
+			elapsed := time.Since(start)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Announce returned %v, want error %v", err, tt.wantErr)
+			}
+			if _, _, received := tracker.stats(); received != tt.received {
+				t.Errorf("tracker received %d packets, want %d", received, tt.received)
+			}
+			if tt.wantErr {
+				// Every attempt waited out its doubled timeout.
+				if want := c.BaseTimeout * (1<<(tt.maxRetries+1) - 1); elapsed < want {
+					t.Errorf("gave up after %v, want at least %v", elapsed, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewUDPTrackerClientDefaults(t *testing.T) {
+	c := NewUDPTrackerClient()
+	if c.BaseTimeout != 15*time.Second || c.MaxRetries != defaultUDPRetries {
+		t.Errorf("got BaseTimeout %v and MaxRetries %d", c.BaseTimeout, c.MaxRetries)
+	}
+	// The default gives up within two minutes, well short of the BEP 15 schedule.
+	if total := c.BaseTimeout * (1<<(c.MaxRetries+1) - 1); total > 2*time.Minute {
+		t.Errorf("default schedule waits %v for a dead tracker", total)
+	}
+}
@@ -0,0 +1,174 @@
+package peering
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/storage"
+)
+
+const (
+	// maxRequestLength is the longest block a peer may request. Clients request
+	// blockSize bytes, and a request for more than this closes the connection.
+	maxRequestLength = 128 * 1024
+	// maxQueuedRequests bounds the requests a peer may have waiting to be answered.
+	maxQueuedRequests = 512
+)
+
+// ready is always ready to receive from, for select cases that should fire whenever enabled.
+var ready = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// uploader is the uploading side of a connection: it answers the peer's block requests
+// from storage while the peer's choke group lets it. Sessions feed it the peer's
+// messages from their own goroutine; only the counters and choking decisions are
+// shared with the group.
+type uploader struct {
+	addr        string
+	connectedAt time.Time
+	info        *bencode.InnerInfo
+	storage     storage.Torrent // nil when there is nothing to upload
+	group       *chokeGroup
+
+	amChoking      bool      // we are choking the peer
+	peerInterested bool      // the peer is interested in our pieces
+	requests       []Request // waiting to be answered, oldest first
+	choke          chan bool // the group's latest choking decision
+
+	interested atomic.Bool  // peerInterested, for the group
+	snubbed    atomic.Bool  // the peer stopped sending the blocks we requested
+	uploaded   atomic.Int64 // block bytes sent to the peer
+	downloaded atomic.Int64 // block bytes received from the peer
+}
+
+func newUploader(addr string, info *bencode.InnerInfo, store storage.Torrent) *uploader {
+	return &uploader{
+		addr:        addr,
+		connectedAt: time.Now(),
+		info:        info,
+		storage:     store,
+		amChoking:   true,
+		choke:       make(chan bool, 1),
+	}
+}
+
+// setInterest records whether the peer wants our pieces, rechoking when that changes
+// so that a free upload slot does not wait for the next round.
+func (u *uploader) setInterest(interested bool) {
+	if interested == u.peerInterested {
+		return
+	}
+	u.peerInterested = interested
+	u.interested.Store(interested)
+	if u.group != nil {
+		u.group.rechoke(false)
+	}
+}
+
+// setChoking passes a choking decision to the session, replacing any it has not applied yet.
+// It is called by the choke group and never blocks.
+func (u *uploader) setChoking(choke bool) {
+	for {
+		select {
+		case u.choke <- choke:
+			return
+		default:
+		}
+		select {
+		case <-u.choke:
+		default:
+		}
+	}
+}
+
+// applyChoke applies a choking decision and returns the message that tells the peer,
+// or nil if nothing changed. Choking drops the requests still queued, which the peer
+// discards as well.
+func (u *uploader) applyChoke(choke bool) PeerMessage {
+	if choke == u.amChoking {
+		return nil
+	}
+	u.amChoking = choke
+	if choke {
+		u.requests = nil
+		return Choke{}
+	}
+	return Unchoke{}
+}
+
+// queueRequest checks a request and queues it to be answered. Requests made while the
+// peer is choked, or for pieces we do not have, are dropped, while malformed requests
+// end the session.
+func (u *uploader) queueRequest(req Request) error {
+	if u.amChoking || u.storage == nil {
+		return nil
+	}
+	numPieces := len(u.info.Pieces) / 20
+	if req.Index < 0 || req.Index >= numPieces {
+		return fmt.Errorf("request for piece %d out of range, torrent has %d pieces", req.Index, numPieces)
+	}
+	pieceLength := min(u.info.PieceLength, u.info.TotalLength()-req.Index*u.info.PieceLength)
+	if req.Length <= 0 || req.Length > maxRequestLength || req.Begin < 0 || req.Begin+req.Length > pieceLength {
+		return fmt.Errorf("invalid request for %d bytes at offset %d of piece %d", req.Length, req.Begin, req.Index)
+	}
+	if len(u.requests) >= maxQueuedRequests {
+		return fmt.Errorf("peer has more than %d requests queued", maxQueuedRequests)
+	}
+	if !u.storage.Completed(req.Index) {
+		return nil
+	}
+	u.requests = append(u.requests, req)
+	return nil
+}
+
+// cancelRequest drops a queued request the peer no longer wants.
+func (u *uploader) cancelRequest(m Cancel) {
+	for i, req := range u.requests {
+		if req.Index == m.Index && req.Begin == m.Begin && req.Length == m.Length {
+			u.requests = append(u.requests[:i], u.requests[i+1:]...)
+			return
+		}
+	}
+}
+
+// serving returns a channel that is ready while there are requests to answer, and nil,
+// which blocks forever in a select, otherwise.
+func (u *uploader) serving() <-chan struct{} {
+	if u.amChoking || len(u.requests) == 0 {
+		return nil
+	}
+	return ready
+}
+
+// nextBlock reads the oldest queued block from storage.
+func (u *uploader) nextBlock() (Piece, error) {
+	req := u.requests[0]
+	u.requests = u.requests[1:]
+
+	block := make([]byte, req.Length)
+	if _, err := u.storage.ReadAt(req.Index, block, int64(req.Begin)); err != nil {
+		return Piece{}, fmt.Errorf("failed to read block at offset %d of piece %d: %w", req.Begin, req.Index, err)
+	}
+	return Piece{Index: req.Index, Begin: req.Begin, Block: block}, nil
+}
+
+// completedBitfield returns the pieces t reports complete, or nil if there are none.
+func completedBitfield(t storage.Torrent, numPieces int) []byte {
+	bitfield := make([]byte, (numPieces+7)/8)
+	have := false
+	for i := range numPieces {
+		if t.Completed(i) {
+			setBit(bitfield, i)
+			have = true
+		}
+	}
+	if !have {
+		return nil
+	}
+	return bitfield
+}
@@ -2,6 +2,7 @@ package peering
 
 import (
 	"encoding/binary"
+	"fmt"
 )
 
 // dividePiece splits a piece into blocks of specified size
@@ -28,3 +29,30 @@ func encodeRequest(index, begin, length int) []byte {
 	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
 	return payload
 }
+
+// hasBit reports whether the bit for index is set in a bitfield-message style bitfield.
+func hasBit(bitfield []byte, index int) bool {
+	byteIndex := index / 8
+	if byteIndex >= len(bitfield) {
+		return false
+	}
+	return bitfield[byteIndex]>>(7-index%8)&1 != 0
+}
+
+// setBit sets the bit for index, which must lie within bitfield. Bitfields are sized
+// for the torrent up front, so that indexes peers send cannot make them grow.
+func setBit(bitfield []byte, index int) {
+	bitfield[index/8] |= 1 << (7 - index%8)
+}
+
+// checkBitfield checks that a bitfield a peer sent covers exactly numPieces pieces
+// and has none of its spare bits set, as BEP 3 requires.
+func checkBitfield(bitfield []byte, numPieces int) error {
+	if len(bitfield) != (numPieces+7)/8 {
+		return fmt.Errorf("bitfield has %d bytes, expected %d", len(bitfield), (numPieces+7)/8)
+	}
+	if spare := numPieces % 8; spare != 0 && bitfield[len(bitfield)-1]&(0xff>>spare) != 0 {
+		return fmt.Errorf("bitfield has spare bits set")
+	}
+	return nil
+}
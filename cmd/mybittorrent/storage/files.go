@@ -0,0 +1,310 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
+)
+
+// Options controls how the files of a torrent are created.
+type Options struct {
+	// Sparse leaves the parts of a file that have not been written yet as holes
+	// instead of allocating them when the file is opened.
+	Sparse bool
+	// ReadOnly opens existing files for reading only, without creating or resizing
+	// them. Reading from a file that does not exist fails with fs.ErrNotExist.
+	ReadOnly bool
+}
+
+// FileStorage stores torrents in their own files, laid out under a path on disk.
+type FileStorage struct {
+	outputPath string
+	opts       Options
+}
+
+// NewFileStorage returns a storage that keeps a torrent's files at outputPath.
+// Single-file torrents are stored at outputPath directly, while multi-file
+// torrents are laid out in a directory named after the torrent under outputPath.
+func NewFileStorage(outputPath string, opts Options) *FileStorage {
+	return &FileStorage{outputPath: outputPath, opts: opts}
+}
+
+// OpenTorrent creates or opens the torrent's files. See OpenFiles.
+func (s *FileStorage) OpenTorrent(info *bencode.InnerInfo, infoHash []byte) (Torrent, error) {
+	return OpenFiles(info, s.outputPath, s.opts)
+}
+
+// Files stores a torrent's data in the torrent's own files. The files are treated as
+// one contiguous byte stream, the same one the pieces are cut from, so a piece is
+// written at its offset as soon as it is verified even when it straddles files.
+type Files struct {
+	geometry pieceGeometry
+	entries  []fileEntry
+	handles  []*os.File
+
+	mu       sync.Mutex
+	complete []bool
+}
+
+// fileEntry maps a file of the torrent onto the contiguous byte stream formed by its pieces.
+type fileEntry struct {
+	path   string
+	offset int64
+	length int64
+}
+
+// OpenFiles creates or opens the files of the torrent described by info and sizes them
+// to their final length, keeping any data they already hold. With opts.ReadOnly the files
+// that exist are opened as they are instead.
+func OpenFiles(info *bencode.InnerInfo, outputPath string, opts Options) (*Files, error) {
+	entries, err := fileLayout(info, outputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	geometry := newPieceGeometry(info)
+	s := &Files{
+		geometry: geometry,
+		entries:  entries,
+		complete: make([]bool, geometry.numPieces),
+	}
+	for _, entry := range entries {
+		f, err := openEntry(entry, opts)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.handles = append(s.handles, f)
+	}
+	return s, nil
+}
+
+func openEntry(entry fileEntry, opts Options) (*os.File, error) {
+	if opts.ReadOnly {
+		f, err := os.Open(entry.path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %v", entry.path, err)
+		}
+		return f, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(entry.path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory for %s: %v", entry.path, err)
+	}
+
+	f, err := os.OpenFile(entry.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", entry.path, err)
+	}
+	if err := allocate(f, entry.length, opts.Sparse); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to allocate %s: %v", entry.path, err)
+	}
+	return f, nil
+}
+
+// allocate sizes f to length. Unless sparse is set, the part of the file that does not
+// exist yet is filled with zeros so that running out of disk space shows up right away
+// rather than halfway through the download.
+func allocate(f *os.File, length int64, sparse bool) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	if sparse || size >= length {
+		return f.Truncate(length)
+	}
+
+	zeros := make([]byte, 1<<20)
+	for off := size; off < length; {
+		n := min(int64(len(zeros)), length-off)
+		if _, err := f.WriteAt(zeros[:n], off); err != nil {
+			return err
+		}
+		off += n
+	}
+	return nil
+}
+
+// ReadAt reads from the files the piece spans. Reading from a file missing from files
+// opened with Options.ReadOnly fails with fs.ErrNotExist.
+func (s *Files) ReadAt(index int, p []byte, off int64) (int, error) {
+	start, err := s.geometry.offset(index, off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	return s.span(p, start, (*os.File).ReadAt)
+}
+
+// WriteAt writes p to the files the piece spans, straight through to the operating system.
+func (s *Files) WriteAt(index int, p []byte, off int64) (int, error) {
+	start, err := s.geometry.offset(index, off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	return s.span(p, start, (*os.File).WriteAt)
+}
+
+// span applies op to the part of every file that p covers when placed at off.
+func (s *Files) span(p []byte, off int64, op func(f *os.File, b []byte, off int64) (int, error)) (int, error) {
+	n := 0
+	err := forEachSpan(s.entries, off, len(p), func(i int, fileOff int64, lo, hi int) error {
+		if s.handles[i] == nil {
+			return fmt.Errorf("%s: %w", s.entries[i].path, fs.ErrNotExist)
+		}
+		m, err := op(s.handles[i], p[lo:hi], fileOff)
+		n += m
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.entries[i].path, err)
+		}
+		return nil
+	})
+	return n, err
+}
+
+// MarkComplete records the piece as complete in memory; nothing is written to the files.
+func (s *Files) MarkComplete(index int) error {
+	if _, err := s.geometry.offset(index, 0, 0); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.complete[index] = true
+	return nil
+}
+
+// Completed reports whether the piece was marked complete since the files were opened.
+func (s *Files) Completed(index int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return index >= 0 && index < len(s.complete) && s.complete[index]
+}
+
+// Close flushes and closes every file.
+func (s *Files) Close() error {
+	var errs []error
+	for _, f := range s.handles {
+		if f == nil {
+			continue
+		}
+		if err := f.Sync(); err != nil {
+			errs = append(errs, err)
+		}
+		if err := f.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// forEachSpan calls fn for every file that the range [off, off+n) of the torrent's byte
+// stream touches, with the offset of the range within the file and the part lo:hi of
+// the range that the file holds.
+func forEachSpan(entries []fileEntry, off int64, n int, fn func(i int, fileOff int64, lo, hi int) error) error {
+	done := 0
+	for i, entry := range entries {
+		if done == n {
+			break
+		}
+		end := entry.offset + entry.length
+		if off >= end {
+			continue
+		}
+
+		chunk := int(min(int64(n-done), end-off))
+		if err := fn(i, off-entry.offset, done, done+chunk); err != nil {
+			return err
+		}
+		done += chunk
+		off += int64(chunk)
+	}
+	return nil
+}
+
+// fileLayout resolves where every file of the torrent is stored on disk: outputPath
+// itself for a single-file torrent, or the torrent's name under outputPath as the root
+// of a multi-file torrent's tree. Names and paths that would escape outputPath are
+// rejected, as are files whose paths collide, even if only on a case-insensitive
+// file system, or that lie inside another file.
+func fileLayout(info *bencode.InnerInfo, outputPath string) ([]fileEntry, error) {
+	if !info.IsMultiFile() {
+		return []fileEntry{{path: outputPath, offset: 0, length: int64(info.Length)}}, nil
+	}
+	if !filepath.IsLocal(info.Name) || strings.ContainsAny(info.Name, `/\`) {
+		return nil, fmt.Errorf("unsafe torrent name %q", info.Name)
+	}
+	root := filepath.Join(outputPath, info.Name)
+
+	entries := make([]fileEntry, 0, len(info.Files))
+	seen := make(map[string]int, len(info.Files)) // file index by folded path
+	var offset int64
+	for i, file := range info.Files {
+		relative := filepath.Join(file.Path...)
+		if !filepath.IsLocal(relative) {
+			return nil, fmt.Errorf("unsafe path for file %d: %q", i, relative)
+		}
+		key := strings.ToLower(relative)
+		if j, ok := seen[key]; ok {
+			return nil, fmt.Errorf("file %d has the same path as file %d: %q", i, j, relative)
+		}
+		seen[key] = i
+		entries = append(entries, fileEntry{
+			path:   filepath.Join(root, relative),
+			offset: offset,
+			length: int64(file.Length),
+		})
+		offset += int64(file.Length)
+	}
+
+	for i, file := range info.Files {
+		for dir := filepath.Dir(filepath.Join(file.Path...)); dir != "."; dir = filepath.Dir(dir) {
+			if j, ok := seen[strings.ToLower(dir)]; ok {
+				return nil, fmt.Errorf("file %d lies inside file %d: %q", i, j, dir)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// FileStat is the size and modification time of one of a torrent's files on disk.
+type FileStat struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// StatFiles reports the size and modification time of every file of the torrent laid
+// out under outputPath, in the order of the torrent's file list. A file that does not
+// exist is reported with a zero size and time.
+func StatFiles(info *bencode.InnerInfo, outputPath string) ([]FileStat, error) {
+	entries, err := fileLayout(info, outputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make([]FileStat, len(entries))
+	for i, entry := range entries {
+		stats[i].Path = entry.path
+		fi, err := os.Stat(entry.path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		stats[i].Size = fi.Size()
+		stats[i].ModTime = fi.ModTime()
+	}
+	return stats, nil
+}
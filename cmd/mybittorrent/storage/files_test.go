@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
+)
+
+func TestFileLayout(t *testing.T) {
+	files := func(paths ...[]string) []bencode.File {
+		var fs []bencode.File
+		for _, path := range paths {
+			fs = append(fs, bencode.File{Length: 1, Path: path})
+		}
+		return fs
+	}
+	tests := []struct {
+		name  string
+		info  bencode.InnerInfo
+		paths []string // relative to the output path; nil if the layout is rejected
+	}{
+		{"single file at the output path", bencode.InnerInfo{Name: "ignored", Length: 1}, []string{""}},
+		{
+			"multi-file under the torrent's name",
+			bencode.InnerInfo{Name: "album", Files: files([]string{"a"}, []string{"sub", "b"})},
+			[]string{"album/a", "album/sub/b"},
+		},
+		{"empty name", bencode.InnerInfo{Name: "", Files: files([]string{"a"})}, nil},
+		{"name escapes", bencode.InnerInfo{Name: "..", Files: files([]string{"a"})}, nil},
+		{"name with a separator", bencode.InnerInfo{Name: "x/y", Files: files([]string{"a"})}, nil},
+		{"absolute name", bencode.InnerInfo{Name: "/etc", Files: files([]string{"a"})}, nil},
+		{"path escapes", bencode.InnerInfo{Name: "t", Files: files([]string{"..", "a"})}, nil},
+		{"duplicate paths", bencode.InnerInfo{Name: "t", Files: files([]string{"a", "b"}, []string{"c"}, []string{"a", "b"})}, nil},
+		{"paths equal after case folding", bencode.InnerInfo{Name: "t", Files: files([]string{"Readme"}, []string{"README"})}, nil},
+		{"paths equal after cleaning", bencode.InnerInfo{Name: "t", Files: files([]string{"a", ".", "b"}, []string{"a", "b"})}, nil},
+		{"file inside another file", bencode.InnerInfo{Name: "t", Files: files([]string{"a"}, []string{"A", "b"})}, nil},
+		{
+			"same name in different directories",
+			bencode.InnerInfo{Name: "t", Files: files([]string{"x", "a"}, []string{"y", "a"}, []string{"ab"})},
+			[]string{"t/x/a", "t/y/a", "t/ab"},
+		},
+	}
+	outputPath := filepath.Join("out", "dir")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := fileLayout(&tt.info, outputPath)
+			if tt.paths == nil {
+				if err == nil {
+					t.Errorf("fileLayout accepted the torrent, laying it out as %v", entries)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("fileLayout: %v", err)
+			}
+			var got, want []string
+			for i, entry := range entries {
+				got = append(got, entry.path)
+				want = append(want, filepath.Join(outputPath, filepath.FromSlash(tt.paths[i])))
+				if entry.offset != int64(i) {
+					t.Errorf("file %d at offset %d, want %d", i, entry.offset, i)
+				}
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("paths = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestFilesRoundTripUnderName(t *testing.T) {
+	// Downloading, verifying and seeding all find a multi-file torrent's files in the
+	// same place.
+	data := []byte("abcdefghijklmnopqrstuvwxyz!")
+	info := testInfo(data, 10, 15, 0, 12)
+	info.Name = "album"
+	dir := t.TempDir()
+
+	files, err := NewFileStorage(dir, Options{}).OpenTorrent(info, []byte("infohash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for start := 0; start < len(data); start += info.PieceLength {
+		if _, err := files.WriteAt(start/info.PieceLength, data[start:min(start+info.PieceLength, len(data))], 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := files.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := os.ReadFile(filepath.Join(dir, "album", "c")); err != nil || !bytes.Equal(got, data[15:]) {
+		t.Errorf("album/c holds %q, %v", got, err)
+	}
+	readOnly, err := OpenFiles(info, dir, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readOnly.Close()
+	result, err := Verify(info, readOnly, 1)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if result.Verified() != len(result.Pieces) {
+		t.Errorf("verified %d of %d pieces", result.Verified(), len(result.Pieces))
+	}
+	stats, err := StatFiles(info, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats[0].Path != filepath.Join(dir, "album", "a") || stats[2].Size != 12 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
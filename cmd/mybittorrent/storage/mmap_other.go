@@ -0,0 +1,25 @@
+//go:build !unix
+
+package storage
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
+)
+
+// MmapStorage is not available on this platform.
+type MmapStorage struct{}
+
+// NewMmapStorage reports that memory-mapped storage is not supported on this platform.
+func NewMmapStorage(outputPath string, opts Options) (*MmapStorage, error) {
+	return nil, errMmapUnsupported
+}
+
+// OpenTorrent always fails, since memory-mapped storage is not supported on this platform.
+func (s *MmapStorage) OpenTorrent(info *bencode.InnerInfo, infoHash []byte) (Torrent, error) {
+	return nil, errMmapUnsupported
+}
+
+var errMmapUnsupported = fmt.Errorf("mmap storage is not supported on %s", runtime.GOOS)
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"fmt"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
+)
+
+// Storage is where the client keeps the data of the torrents it downloads.
+// Implementations other than the ones in this package can be plugged into
+// the client to keep pieces anywhere, such as in a blob store.
+type Storage interface {
+	// OpenTorrent prepares storage for the torrent described by info.
+	OpenTorrent(info *bencode.InnerInfo, infoHash []byte) (Torrent, error)
+}
+
+// Torrent holds the pieces of one torrent. Offsets are relative to the start of a piece.
+// The client writes each piece in full before marking it complete, and may read and
+// write different pieces concurrently.
+type Torrent interface {
+	// ReadAt reads len(p) bytes of the piece starting at off.
+	ReadAt(index int, p []byte, off int64) (int, error)
+	// WriteAt writes p into the piece starting at off.
+	WriteAt(index int, p []byte, off int64) (int, error)
+	// MarkComplete records that the piece has been written and has passed its hash check.
+	MarkComplete(index int) error
+	// Completed reports whether the piece was marked complete.
+	Completed(index int) bool
+	// Close flushes any buffered data and releases the storage.
+	Close() error
+}
+
+// pieceGeometry locates pieces in the byte stream formed by a torrent's files.
+type pieceGeometry struct {
+	pieceLength int64
+	totalLength int64
+	numPieces   int
+}
+
+func newPieceGeometry(info *bencode.InnerInfo) pieceGeometry {
+	return pieceGeometry{
+		pieceLength: int64(info.PieceLength),
+		totalLength: int64(info.TotalLength()),
+		numPieces:   len(info.Pieces) / 20,
+	}
+}
+
+// offset converts a range within a piece into an offset in the torrent's byte stream.
+func (g pieceGeometry) offset(index int, off int64, n int) (int64, error) {
+	if index < 0 || index >= g.numPieces {
+		return 0, fmt.Errorf("piece index %d out of range, torrent has %d pieces", index, g.numPieces)
+	}
+	start := int64(index) * g.pieceLength
+	length := min(g.pieceLength, g.totalLength-start)
+	if off < 0 || off+int64(n) > length {
+		return 0, fmt.Errorf("range %d+%d outside of piece %d of %d bytes", off, n, index, length)
+	}
+	return start + off, nil
+}
@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
+)
+
+// VerifyResult reports which pieces of a torrent's stored data match their hashes.
+type VerifyResult struct {
+	// Pieces holds whether each piece passed its hash check.
+	Pieces []bool
+	// Files reports the completeness of each of the torrent's files.
+	Files []FileResult
+}
+
+// FileResult reports how many of the pieces holding a file's data passed their hash check.
+// A piece that straddles files counts towards each of them.
+type FileResult struct {
+	// Path is the file's path within the torrent, or the torrent's name for a single-file torrent.
+	Path     string
+	Length   int64
+	Pieces   int
+	Verified int
+}
+
+// Complete reports whether every piece of the file passed its hash check.
+func (f FileResult) Complete() bool {
+	return f.Verified == f.Pieces
+}
+
+// Verified returns the number of pieces that passed their hash check.
+func (r *VerifyResult) Verified() int {
+	n := 0
+	for _, ok := range r.Pieces {
+		if ok {
+			n++
+		}
+	}
+	return n
+}
+
+// Bitfield returns the verified pieces as a bitfield, most significant bit first,
+// in the form peers exchange.
+func (r *VerifyResult) Bitfield() []byte {
+	bitfield := make([]byte, (len(r.Pieces)+7)/8)
+	for i, ok := range r.Pieces {
+		if ok {
+			bitfield[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return bitfield
+}
+
+// Verify hashes the pieces stored in t and checks them against info, spreading the work
+// over workers goroutines, or one per CPU if workers is not positive. Pieces that cannot
+// be read because their data is missing, such as from a file that does not exist or is
+// too short, fail the check. Any other read error aborts the verification.
+func Verify(info *bencode.InnerInfo, t Torrent, workers int) (*VerifyResult, error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	geometry := newPieceGeometry(info)
+	result := &VerifyResult{Pieces: make([]bool, geometry.numPieces)}
+
+	indexes := make(chan int)
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// No piece is longer than the torrent itself.
+			buf := make([]byte, min(geometry.pieceLength, geometry.totalLength))
+			for index := range indexes {
+				length := min(geometry.pieceLength, geometry.totalLength-int64(index)*geometry.pieceLength)
+				data := buf[:length]
+				if _, err := t.ReadAt(index, data, 0); err != nil {
+					if errors.Is(err, fs.ErrNotExist) || errors.Is(err, io.EOF) {
+						continue
+					}
+					errs <- fmt.Errorf("failed to read piece %d: %w", index, err)
+					return
+				}
+				hash := sha1.Sum(data)
+				// Each worker writes distinct elements, so no lock is needed.
+				result.Pieces[index] = bytes.Equal(hash[:], info.Pieces[index*20:(index+1)*20])
+			}
+		}()
+	}
+
+	var err error
+feed:
+	for i := range geometry.numPieces {
+		select {
+		case indexes <- i:
+		case err = <-errs:
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+	if err == nil {
+		select {
+		case err = <-errs:
+		default:
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result.Files = fileResults(info, geometry, result.Pieces)
+	return result, nil
+}
+
+// fileResults tallies the verified pieces of every file of the torrent.
+func fileResults(info *bencode.InnerInfo, geometry pieceGeometry, pieces []bool) []FileResult {
+	type file struct {
+		path   string
+		length int64
+	}
+	files := []file{{path: info.Name, length: int64(info.Length)}}
+	if info.IsMultiFile() {
+		files = files[:0]
+		for _, f := range info.Files {
+			files = append(files, file{path: filepath.Join(f.Path...), length: int64(f.Length)})
+		}
+	}
+
+	results := make([]FileResult, len(files))
+	var offset int64
+	for i, f := range files {
+		results[i] = FileResult{Path: f.path, Length: f.length}
+		if f.length > 0 {
+			first := int(offset / geometry.pieceLength)
+			last := int((offset + f.length - 1) / geometry.pieceLength)
+			for index := first; index <= last; index++ {
+				results[i].Pieces++
+				if pieces[index] {
+					results[i].Verified++
+				}
+			}
+		}
+		offset += f.length
+	}
+	return results
+}
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/cmd/mybittorrent/bencode"
+)
+
+// testInfo describes data as a torrent of files with the given lengths.
+func testInfo(data []byte, pieceLength int, lengths ...int) *bencode.InnerInfo {
+	info := &bencode.InnerInfo{Name: "test", PieceLength: pieceLength}
+	for start := 0; start < len(data); start += pieceLength {
+		hash := sha1.Sum(data[start:min(start+pieceLength, len(data))])
+		info.Pieces = append(info.Pieces, hash[:]...)
+	}
+	for i, length := range lengths {
+		info.Files = append(info.Files, bencode.File{Length: length, Path: []string{string(rune('a' + i))}})
+	}
+	if len(lengths) == 1 {
+		info.Files, info.Length = nil, lengths[0]
+	}
+	return info
+}
+
+// openMemory stores the torrent's pieces in a MemoryTorrent, writing each piece of
+// data that write accepts.
+func openMemory(t *testing.T, info *bencode.InnerInfo, data []byte, write func(index int) bool) *MemoryTorrent {
+	t.Helper()
+	torrent, err := NewMemoryStorage().OpenTorrent(info, []byte("infohash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for start := 0; start < len(data); start += info.PieceLength {
+		index := start / info.PieceLength
+		if !write(index) {
+			continue
+		}
+		if _, err := torrent.WriteAt(index, data[start:min(start+info.PieceLength, len(data))], 0); err != nil {
+			t.Fatalf("WriteAt(%d): %v", index, err)
+		}
+	}
+	return torrent.(*MemoryTorrent)
+}
+
+func TestVerify(t *testing.T) {
+	data := []byte("abcdefghijklmnopqrstuvwxyz!")
+	// Files of 15, 0 and 12 bytes in 10-byte pieces: piece 1 straddles a and c.
+	info := testInfo(data, 10, 15, 0, 12)
+
+	tests := []struct {
+		name     string
+		write    func(index int) bool
+		pieces   []bool
+		bitfield []byte
+		complete []bool
+	}{
+		{"complete", func(int) bool { return true }, []bool{true, true, true}, []byte{0xE0}, []bool{true, true, true}},
+		{"missing last piece", func(i int) bool { return i != 2 }, []bool{true, true, false}, []byte{0xC0}, []bool{true, true, false}},
+		{"missing straddling piece", func(i int) bool { return i != 1 }, []bool{true, false, true}, []byte{0xA0}, []bool{false, true, false}},
+		{"empty", func(int) bool { return false }, []bool{false, false, false}, []byte{0x00}, []bool{false, true, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			torrent := openMemory(t, info, data, tt.write)
+			for _, workers := range []int{0, 1, 3} {
+				result, err := Verify(info, torrent, workers)
+				if err != nil {
+					t.Fatalf("Verify: %v", err)
+				}
+				for i, want := range tt.pieces {
+					if result.Pieces[i] != want {
+						t.Errorf("%d workers: piece %d verified %v, want %v", workers, i, result.Pieces[i], want)
+					}
+				}
+				if !bytes.Equal(result.Bitfield(), tt.bitfield) {
+					t.Errorf("%d workers: bitfield %08b, want %08b", workers, result.Bitfield(), tt.bitfield)
+				}
+				for i, want := range tt.complete {
+					if result.Files[i].Complete() != want {
+						t.Errorf("%d workers: file %s complete %v, want %v (%+v)", workers, result.Files[i].Path, !want, want, result.Files[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyFileResults(t *testing.T) {
+	data := []byte("abcdefghijklmnopqrstuvwxyz!")
+	info := testInfo(data, 10, 15, 0, 12)
+	torrent := openMemory(t, info, data, func(i int) bool { return i != 2 })
+
+	result, err := Verify(info, torrent, 1)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	want := []FileResult{
+		{Path: "a", Length: 15, Pieces: 2, Verified: 2},
+		{Path: "b", Length: 0, Pieces: 0, Verified: 0},
+		{Path: "c", Length: 12, Pieces: 2, Verified: 1},
+	}
+	if len(result.Files) != len(want) {
+		t.Fatalf("got %d file results, want %d", len(result.Files), len(want))
+	}
+	for i := range want {
+		if result.Files[i] != want[i] {
+			t.Errorf("file %d: got %+v, want %+v", i, result.Files[i], want[i])
+		}
+	}
+	if result.Verified() != 2 {
+		t.Errorf("Verified() = %d, want 2", result.Verified())
+	}
+}
+
+// readSizes records the capacity of every buffer pieces are read into.
+type readSizes struct {
+	Torrent
+	caps []int
+}
+
+func (r *readSizes) ReadAt(index int, p []byte, off int64) (int, error) {
+	r.caps = append(r.caps, cap(p))
+	return r.Torrent.ReadAt(index, p, off)
+}
+
+func TestVerifySmallTorrentLargePieces(t *testing.T) {
+	// A torrent shorter than its piece length is read into a buffer of its own size.
+	data := []byte("tiny")
+	info := testInfo(data, 64<<20, len(data))
+	torrent := &readSizes{Torrent: openMemory(t, info, data, func(int) bool { return true })}
+
+	result, err := Verify(info, torrent, 4)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if result.Verified() != 1 {
+		t.Errorf("Verified() = %d, want 1", result.Verified())
+	}
+	for _, c := range torrent.caps {
+		if c > len(data) {
+			t.Errorf("piece read into a %d-byte buffer, want at most %d", c, len(data))
+		}
+	}
+}
+
+func TestMemoryTorrent(t *testing.T) {
+	data := []byte("abcdefghijklmnopqrstuvwxyz!")
+	info := testInfo(data, 10, len(data))
+	s := NewMemoryStorage()
+	torrent, err := s.OpenTorrent(info, []byte("infohash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := torrent.WriteAt(2, data[20:], 0); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+	if err := torrent.MarkComplete(2); err != nil {
+		t.Fatalf("MarkComplete: %v", err)
+	}
+	// The same info hash opens the same torrent.
+	again, err := s.OpenTorrent(info, []byte("infohash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.Completed(2) || again.Completed(1) {
+		t.Error("reopened torrent lost which pieces are complete")
+	}
+	got := make([]byte, 4)
+	if _, err := again.ReadAt(2, got, 3); err != nil || string(got) != "xyz!" {
+		t.Errorf("ReadAt = %q, %v, want xyz!", got, err)
+	}
+
+	ranges := []struct {
+		index int
+		off   int64
+		n     int
+	}{
+		{-1, 0, 1},
+		{3, 0, 1},
+		{2, 0, 8}, // the last piece has 7 bytes
+		{0, -1, 1},
+		{0, 5, 6},
+	}
+	for _, r := range ranges {
+		if _, err := torrent.WriteAt(r.index, make([]byte, r.n), r.off); err == nil {
+			t.Errorf("WriteAt(%d, %d bytes, %d) succeeded outside the piece", r.index, r.n, r.off)
+		}
+		if _, err := torrent.ReadAt(r.index, make([]byte, r.n), r.off); err == nil {
+			t.Errorf("ReadAt(%d, %d bytes, %d) succeeded outside the piece", r.index, r.n, r.off)
+		}
+	}
+	if err := torrent.MarkComplete(3); err == nil {
+		t.Error("MarkComplete succeeded for a piece out of range")
+	}
+	if torrent.Completed(-1) || torrent.Completed(3) {
+		t.Error("Completed reported a piece out of range")
+	}
+}